@@ -2,22 +2,39 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
+	"archive/zip"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/remeh/sizedwaitgroup"
 )
 
 var (
 	archiveCount        = EnvInt("ARCHIVE_OFFSET", 0, "Archive numbering offset")
-	archiveTar          *tar.Writer
-	archiveGzip         *gzip.Writer
-	archiveFile         *os.File
-	archiveBytesWritten int64
+	compression         = Env("COMPRESSION", "gzip", "Archive compression, gzip or zstd")
+	gzipLevel           = EnvInt("GZIP_LEVEL", 6, "Gzip compression level, 0 to store and 9 for best")
+	zstdLevel           = EnvInt("ZSTD_LEVEL", 3, "Zstd compression level, 1 for fastest and 22 for best")
+	archiveNameTemplate = Env("ARCHIVE_NAME_TEMPLATE", "", "Archive name with {date}, {timestamp}, {seq}, {prefix} and {partition} tokens, overrides ARCHIVE_NAME")
+	archiveSeqWidth     = EnvInt("ARCHIVE_SEQ_WIDTH", 7, "Digits the {seq} token is zero padded to")
+	maxArchiveBytesStr  = Env("MAX_ARCHIVE_BYTES", "", "Limit the size of the tar stream of each archive, headers included")
+	maxArchiveBytes     int64
+	maxFilesPerArchive  = EnvInt("MAX_FILES_PER_ARCHIVE", 0, "Limit the number of files in each archive, 0 for no limit")
+	compressEachFile    = Env("COMPRESS_EACH_FILE", "", "Compress each file in a gzip member or zstd frame of its own, so RESTORE_MANIFEST can restore it alone") != ""
+	archiveWriters      = EnvInt("ARCHIVE_WRITERS", 1, "Archives written at once, each by a writer of its own")
+
+	archiveSeqMu sync.Mutex // Guards archiveCount, shared by the writers
 
 	doneArchiving = make(chan struct{})
 )
@@ -26,147 +43,482 @@ var (
 type ArchiveFile struct {
 	Filename string
 	Contents []string
+	Uploaded bool            // Streamed to the bucket as it was written
+	CRC32C   string          // Checksum of the archive, with VERIFY_UPLOAD
+	Sources  []SourceObject  // The objects archived, with DELETE_SOURCE, CHECKPOINT_FILE or STATE_FILE
+	Volumes  []archiveVolume // The files to upload instead of Filename, with VOLUME_SIZE
+	Tagging  string          // The tags to upload it with, with ARCHIVE_TAGS
+}
+
+// tarArchive is an archive being written.  Several are open at once when
+// partitioning by PARTITION_DEPTH.
+type tarArchive struct {
+	name         string
+	partition    string
+	contents     []string
+	sources      []SourceObject // With DELETE_SOURCE, CHECKPOINT_FILE or STATE_FILE
+	tw           *tar.Writer
+	compressor   io.WriteCloser
+	fileBytes    *countingWriter // Position in the archive as written, which the compressor writes to
+	stored       bool            // The compressor only stores, with STORE_COMPRESSED
+	memberStart  int64           // Where the gzip member or zstd frame being written starts
+	memberTar    int64           // Position in the tar stream when it started
+	tarBytes     *countingWriter // Position in the uncompressed tar stream
+	zw           *zip.Writer     // Instead of tw, with ARCHIVE_FORMAT zip
+	zipBytes     int64           // Size of the zip entries so far as if stored, for MAX_ARCHIVE_BYTES
+	file         io.WriteCloser  // Local file, an s3StreamWriter when streaming, or a volumeWriter
+	encrypter    *encryptWriter  // Between fileBytes and file, with encryption
+	checksum     hash.Hash32     // CRC32C of the archive as written, with VERIFY_UPLOAD
+	bytesWritten int64
+	opened       time.Time // Modification time given to entries without their own
+	tagging      string    // Tags to upload the archive with, with ARCHIVE_TAGS
 }
 
 // Archiver listens for WorkFile on tasksCh, archives them, and sends to a bucket.
+// ARCHIVE_WRITERS write at once, each to archives of its own, taking the
+// next file ready from tasksCh.
 func Archiver(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *ArchiveFile) {
-	log.Println("Starting archiver...")
+	Infof("Starting archiver...")
 	defer close(doneCh)
 
-	var tgzFile string
-	var contents []string
+	swg := sizedwaitgroup.New(archiveWriters)
+	for i := 0; i < archiveWriters; i++ {
+		swg.Add()
+		go func() {
+			defer swg.Done()
+			archiveWriter(ctx, tasksCh, doneCh)
+		}()
+	}
+	swg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+	// Every writer is done with the manifest now
+	if err := archiveManifest.write(manifestFile); err != nil {
+		Errorf("failed to write manifest %s: %v", manifestFile, err)
+	}
+	Println("Closing archiver...")
+}
+
+// archiveWriter is one of the Archiver's writers.  It finishes its open
+// archives when tasksCh is closed.
+func archiveWriter(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *ArchiveFile) {
+	open := newOpenArchives()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case task, ok := <-tasksCh:
-			if debug {
-				log.Printf("Archiver task: %#v %v\n", task, ok)
-			}
+			Debugf("Archiver task: %#v %v\n", task, ok)
 
 			if !ok {
-				if tgzFile == "" {
-					return
-				}
-				CloseArchive()
-				FileContents := make([]string, len(contents))
-				for i := range contents {
-					FileContents[i] = contents[i]
+				for _, a := range open.takeAll() {
+					doneCh <- a.done()
 				}
-				doneCh <- &ArchiveFile{Filename: tgzFile, Contents: FileContents}
-				contents = nil
-				Println("Closing archiver...")
 				return
 			}
 
-			if archiveFile == nil {
-				// Open the initial file
-				tgzFile = OpenArchive()
+			partition := partitionKey(task.Filename)
+			a := open.get(partition)
+			if a == nil {
+				// Open the first file of the partition
+				if old := open.evict(); old != nil {
+					doneCh <- old.done()
+				}
+				a = OpenArchive(ctx, partition)
+				open.put(a)
 			}
 
-			if debug {
-				log.Println("Written", archiveBytesWritten, "Size Cap", sizeCapLimit)
-			}
-			if archiveBytesWritten > 0 && archiveBytesWritten+task.Size > sizeCapLimit {
+			Debugf("Written %d Size Cap %d", a.bytesWritten, sizeCapLimit)
+			if a.full(task) {
 				// If the internal size is above the capacity limit, roll files
-				CloseArchive()
-				FileContents := make([]string, len(contents))
-				for i := range contents {
-					FileContents[i] = contents[i]
-				}
-				doneCh <- &ArchiveFile{Filename: tgzFile, Contents: FileContents}
-				contents = nil
-				archiveBytesWritten = 0
-				tgzFile = OpenArchive()
+				doneCh <- a.done()
+				a = OpenArchive(ctx, partition)
+				open.put(a)
 			}
 
-			if debug {
-				log.Println("Writing", task.Filename, "to tar with size", task.Size)
-			}
+			a.write(task)
+		}
+	}
+}
 
-			contents = append(contents, task.Filename)
+// full reports whether task would take a over SIZECAP, MAX_ARCHIVE_BYTES or
+// MAX_FILES_PER_ARCHIVE, so a new archive is needed for it.  An empty archive
+// always takes it.
+func (a *tarArchive) full(task *WorkFile) bool {
+	used, size, trailer := int64(0), int64(0), int64(0)
+	if maxArchiveBytes > 0 && a.zw != nil {
+		// Counted before compression, like the tar stream
+		used, size, trailer = a.zipBytes, zipEntrySize(task), zipTrailerSize
+	} else if maxArchiveBytes > 0 {
+		used, size, trailer = a.tarBytes.n, tarEntrySize(task), tarTrailerSize
+	}
+	return a.bytesWritten > 0 && a.bytesWritten+task.Size > sizeCapLimit ||
+		maxArchiveBytes > 0 && used > 0 && used+size+trailer > maxArchiveBytes ||
+		maxFilesPerArchive > 0 && len(a.contents) >= maxFilesPerArchive
+}
 
-			// Create a tar header for the file
-			header := &tar.Header{
-				Name: task.Filename,
-				Size: task.Size,
-				Mode: 0600, // Set file permissions
-			}
+// write adds task to the archive and the manifest, and releases it.
+func (a *tarArchive) write(task *WorkFile) {
+	Debugf("Writing %s to tar with size %d", task.Filename, task.Size)
 
-			if err := archiveTar.WriteHeader(header); err != nil {
-				log.Fatalf("failed to write tar header for %s: %v", task.Filename, err)
-			}
+	a.contents = append(a.contents, task.Filename)
+	if deleteSource || checkpointFile != "" || jobStateFile != "" {
+		a.sources = append(a.sources, task.Listed)
+	}
+	if a.zw != nil {
+		a.writeZip(task)
+		return
+	}
 
-			if task.Size == 0 {
-				// Empty files don't need anything written, just the header
-				continue
+	var sum string // Known ahead of writing with DEDUP
+	if dedup && task.Size > 0 {
+		var err error
+		if sum = task.sha256(); sum == "" {
+			// Read once more, as it wasn't computed during the download
+			if sum, err = taskSHA256(task); err != nil {
+				fatalf("failed to read %s for archiving: %v", task.Filename, err)
+			}
+		}
+		if first, ok := dedupFirst(sum, task.Filename, a.name); ok {
+			// The contents are written already, so only a link to them is needed
+			a.startEntry(a.stored)
+			entry := a.entryAt(ManifestEntry{Key: task.Filename, Size: task.Size, SHA256: sum, Archive: a.name,
+				Compression: compression, ETag: task.ETag, DuplicateOf: first.key, Checksum: task.manifestChecksum()})
+			if err := a.tw.WriteHeader(linkHeader(task, first, a.name, a.opened)); err != nil {
+				fatalf("failed to write tar header for %s: %v", task.Filename, err)
 			}
-			archiveBytesWritten += task.Size
+			entry.Offset = a.tarBytes.n
+			archiveManifest.add(entry)
+			task.Release()
+			return
+		}
+	}
 
-			if task.TempFile == "" {
-				if n, err := io.Copy(archiveTar, bytes.NewReader(task.Bytes)); err != nil {
-					log.Fatalf("failed to write file %s to tar: %v", task.Filename, err)
-				} else if debug {
-					log.Println("Wrote", n, "bytes to tar")
-				}
-			} else {
-				fh, err := os.Open(task.TempFile)
-				if err != nil {
-					log.Fatalf("failed to open temp file %s: %v", task.TempFile, err)
-				}
+	store := a.stored
+	if task.Size > 0 {
+		// Runs of compressed files share a stretch stored as it is
+		store = isCompressed(task)
+	}
+	a.startEntry(store)
+	entry := a.entryAt(ManifestEntry{Key: task.Filename, Size: task.Size, Archive: a.name,
+		Compression: compression, ETag: task.ETag, Checksum: task.manifestChecksum()})
+	if err := a.tw.WriteHeader(tarHeader(task, a.opened)); err != nil {
+		fatalf("failed to write tar header for %s: %v", task.Filename, err)
+	}
+	entry.Offset = a.tarBytes.n
+	h := sha256.New()
+	if task.Size == 0 {
+		// Empty files don't need anything written, just the header
+		entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+		archiveManifest.add(entry)
+		task.Release()
+		return
+	}
+	a.bytesWritten += task.Size
 
-				if n, err := io.Copy(archiveTar, fh); err != nil {
-					log.Fatalf("failed to write file %s to tar: %v", task.Filename, err)
-				} else if debug {
-					log.Println("Wrote", n, "bytes to tar")
-				}
-				fh.Close()
-				os.Remove(task.TempFile)
-			}
-			if debug {
-				log.Println("Wrote", task.Filename, "to tar")
-			}
+	fh, err := task.Reader()
+	if err != nil {
+		fatalf("failed to open %s for archiving: %v", task.Filename, err)
+	}
+	sp := startSpan("compress", task.Filename).set("archive.key", a.name).set("compression", compression)
+	n, err := io.Copy(io.MultiWriter(a.tw, h), fh)
+	if sp.set("bytes", n).finish(err); err != nil {
+		fatalf("failed to write file %s to tar: %v", task.Filename, err)
+	}
+	Debugf("Wrote %d bytes to tar", n)
+	fh.Close()
+	// The manifest has the hash of what was written, checked against the
+	// one taken before, to catch the contents changing on the way
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if want := cmp.Or(sum, task.sha256()); want != "" && want != entry.SHA256 {
+		fatalf("contents of %s changed since they were downloaded: SHA-256 %s, expected %s", task.Filename, entry.SHA256, want)
+	}
+	task.Release()
+	archiveManifest.add(entry)
+	Debugf("Wrote %s to tar", task.Filename)
+}
+
+// done closes the archive and returns it for the Uploader.
+func (a *tarArchive) done() *ArchiveFile {
+	vw, _ := a.file.(*volumeWriter) // Before Close lets go of it
+	a.Close()
+	af := &ArchiveFile{Filename: a.name, Contents: a.contents, Uploaded: streamUpload, CRC32C: a.closedChecksum(),
+		Sources: a.sources, Tagging: a.tagging}
+	if vw != nil {
+		af.Volumes = vw.files
+	}
+	return af
+}
+
+// entryTime returns the modification time of the entry for task: that of the
+// object if known, otherwise opened, the time its archive was opened.
+// REPRODUCIBLE gives every entry the same time.
+func entryTime(task *WorkFile, opened time.Time) time.Time {
+	if reproducible {
+		return reproducibleTime
+	}
+	if task.LastModified.IsZero() {
+		return opened
+	}
+	return task.LastModified.Truncate(time.Second)
+}
+
+// tarTrailerSize is the two zero blocks that end a tar stream.
+const tarTrailerSize = 2 * 512
+
+// tarHeader returns the tar header for the entry of task in an archive opened
+// at opened.  Keys that don't fit the USTAR name fields, being too long or not
+// ASCII, are kept whole in a PAX path record.
+func tarHeader(task *WorkFile, opened time.Time) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       task.Filename,
+		Size:       task.Size,
+		Mode:       0600, // Set file permissions
+		ModTime:    entryTime(task, opened),
+		PAXRecords: paxRecords(task),
+		Format:     tar.FormatPAX,
+	}
+	if isDirectoryKey(task.Filename, task.Size) {
+		// A folder placeholder, kept as a directory entry
+		hdr.Typeflag, hdr.Mode = tar.TypeDir, 0700
+	}
+	return hdr
+}
+
+// tarEntrySize returns the bytes a file takes in the tar stream: its headers,
+// measured by writing them to a scratch tar writer, and the contents padded
+// to a whole block.
+func tarEntrySize(task *WorkFile) int64 {
+	cw := &countingWriter{w: io.Discard}
+	tar.NewWriter(cw).WriteHeader(tarHeader(task, time.Unix(0, 0))) // An error stops the Archiver anyway
+	return cw.n + (task.Size+511)/512*512
+}
+
+// defaultArchiveName returns the archive name template with the extension of
+// the chosen compression.
+func defaultArchiveName() string {
+	if archiveFormat == "zip" {
+		return "archive_%07d.zip"
+	}
+	if compression == "zstd" {
+		return "archive_%07d.tar.zst"
+	}
+	return "archive_%07d.tgz"
+}
+
+// archiveName returns the name of archive number seq of partition, opened at
+// t.
+func archiveName(seq int, t time.Time, partition string) string {
+	if archiveNameTemplate == "" {
+		return fmt.Sprintf(ArchiveName, seq)
+	}
+	t = t.UTC()
+	prefix := strings.Trim(strings.ReplaceAll(prefixFilter, "/", "-"), "-")
+	return strings.NewReplacer(
+		"{date}", t.Format("20060102"),
+		"{timestamp}", t.Format("20060102T150405Z"),
+		"{seq}", fmt.Sprintf("%0*d", archiveSeqWidth, seq),
+		"{prefix}", prefix,
+		"{partition}", strings.ReplaceAll(partition, "/", "-"),
+	).Replace(archiveNameTemplate)
+}
+
+// checkArchiveSettings validates the archive settings before any work starts.
+func checkArchiveSettings() {
+	if compression != "gzip" && compression != "zstd" {
+		log.Fatalf("COMPRESSION %q is unknown; must be gzip or zstd", compression)
+	}
+	if zstdLevel < 1 || zstdLevel > 22 {
+		log.Fatalf("ZSTD_LEVEL value %d is invalid; must be between 1 and 22", zstdLevel)
+	}
+	if archiveNameTemplate != "" && !strings.Contains(archiveNameTemplate, "{seq}") {
+		// Without a sequence number rotated archives would overwrite each other
+		log.Fatalf("ARCHIVE_NAME_TEMPLATE %q must contain {seq}", archiveNameTemplate)
+	}
+	if archiveSeqWidth < 1 || archiveSeqWidth > 20 {
+		log.Fatalf("ARCHIVE_SEQ_WIDTH value %d is invalid; must be between 1 and 20", archiveSeqWidth)
+	}
+	if maxArchiveBytesStr != "" {
+		var err error
+		if maxArchiveBytes, err = parseByteSize(maxArchiveBytesStr); err != nil {
+			log.Fatalf("failed to parse MAX_ARCHIVE_BYTES: %v", err)
+		} else if maxArchiveBytes < 100 {
+			log.Fatalf("MAX_ARCHIVE_BYTES value %d is too small; must be at least 100 bytes", maxArchiveBytes)
 		}
 	}
+	if archiveWriters < 1 {
+		log.Fatalf("ARCHIVE_WRITERS value %d is too small; must be at least 1", archiveWriters)
+	}
+	if archiveWriters > 1 && reproducible {
+		// Which writer a file goes to depends on timing
+		log.Fatalf("ARCHIVE_WRITERS can't be more than 1 with REPRODUCIBLE")
+	}
+	if maxFilesPerArchive < 0 {
+		log.Fatalf("MAX_FILES_PER_ARCHIVE value %d is invalid; must be 0 or more", maxFilesPerArchive)
+	}
+	if gzipLevel < gzip.NoCompression || gzipLevel > gzip.BestCompression {
+		log.Fatalf("GZIP_LEVEL value %d is invalid; must be between 0 and 9", gzipLevel)
+	}
+	checkGzipSettings()
+	checkZipSettings()
+	checkVolumeSettings()
 }
 
-func OpenArchive() string {
+// OpenArchive creates the next archive, for the keys of partition, and
+// prepares to write to it.
+func OpenArchive(ctx context.Context, partition string) *tarArchive {
 	// Create a .tgz file on disk and prepare to write to it
+	archiveSeqMu.Lock()
 	archiveCount++
-	tgzFilePath := fmt.Sprintf(ArchiveName, archiveCount)
+	seq := archiveCount
+	jobStateOpened(seq)
+	archiveSeqMu.Unlock()
+	a := &tarArchive{partition: partition, opened: time.Now().Truncate(time.Second), tagging: archiveTagging(seq)}
+	a.name = archiveName(seq, a.opened, partition)
 	var err error
-	archiveFile, err = os.Create(tgzFilePath)
+	if volumeSize > 0 {
+		a.file = newVolumeWriter(ctx, a.name, a.tagging) // Creates each volume as it is reached
+	} else {
+		a.file, err = createArchiveFile(ctx, a.name, a.tagging)
+	}
 	if err != nil {
 		// No sense proceeding if the archives cannot be created
 		log.Fatalf("failed to create tgz file: %v", err)
 	}
-	if debug {
-		log.Println("created archive", tgzFilePath)
+	Debugf("created archive %s", a.name)
+
+	var out io.Writer = a.file
+	if verifyUploads && volumeSize == 0 { // Volumes have checksums of their own
+		a.checksum = newArchiveChecksum()
+		out = io.MultiWriter(a.file, a.checksum)
+	}
+	if archiveEncryption() {
+		// Offsets in the manifest stay those of the archive decrypted
+		if a.encrypter, err = newEncryptWriter(ctx, out); err != nil {
+			log.Fatalf("failed to start encrypting archive: %v", err)
+		}
+		out = a.encrypter
+	}
+	a.fileBytes = &countingWriter{w: out}
+
+	if archiveFormat == "zip" {
+		// The zip writer compresses each entry itself
+		a.zw = newZipWriter(a.fileBytes)
+		return a
 	}
 
-	// Create a gzip writer and tar writer
-	archiveGzip, err = gzip.NewWriterLevel(archiveFile, gzip.BestSpeed)
+	// Create a compressor and tar writer
+	if a.compressor, err = newCompressor(a.fileBytes, false); err != nil {
+		fatalf("failed to create compressor for tgz file: %v", err)
+	}
+	a.tarBytes = &countingWriter{w: a.compressor}
+	a.tw = tar.NewWriter(a.tarBytes)
+	return a
+}
+
+// createArchiveFile creates the local file name to write an archive to, or
+// starts streaming it to DST_BUCKET with STREAM_UPLOAD, tagged with tagging.
+func createArchiveFile(ctx context.Context, name, tagging string) (io.WriteCloser, error) {
+	if streamUpload {
+		return newS3StreamWriter(ctx, dstClient(), dstBucket, dstKey(name), &archiveUpload{Tagging: tagging})
+	}
+	return os.Create(name)
+}
+
+// newCompressor returns the COMPRESSION writer to out, or one that only
+// stores what is written if store is set.
+func newCompressor(out io.Writer, store bool) (io.WriteCloser, error) {
+	switch {
+	case compression == "zstd" && store:
+		return newZstdStoreWriter(out), nil
+	case compression == "zstd":
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zstdLevel))}
+		if reproducible {
+			opts = append(opts, zstd.WithEncoderConcurrency(1))
+		}
+		return zstd.NewWriter(out, opts...)
+	case store:
+		return gzip.NewWriterLevel(out, gzip.NoCompression)
+	case gzipWorkers > 1:
+		return newParallelGzipWriter(out, gzipLevel, gzipWorkers, gzipBlockSize)
+	}
+	return gzip.NewWriterLevel(out, gzipLevel)
+}
+
+// startEntry gets the archive ready for the next entry.  The archive
+// switches to storing the entries that follow as they are if store is set,
+// or back to compressing them, and with COMPRESS_EACH_FILE each entry gets
+// a new start, by ending the gzip member or zstd frame and starting
+// another.  Readers carry on across them, so it is still one tar stream.
+func (a *tarArchive) startEntry(store bool) {
+	fresh := a.tarBytes.n == a.memberTar // Nothing is in the member yet
+	if a.stored == store && (fresh || !compressEachFile) {
+		return
+	}
+	if err := a.tw.Flush(); err != nil { // The padding of the entry before
+		fatalf("failed to write to tar: %v", err)
+	}
+	if err := a.compressor.Close(); err != nil {
+		fatalf("failed to close %s writer: %v", compression, err)
+	}
+	a.memberStart, a.memberTar = a.fileBytes.n, a.tarBytes.n
+	c, err := newCompressor(a.fileBytes, store)
 	if err != nil {
-		log.Fatalf("failed to create compressor for tgz file: %v", err)
+		fatalf("failed to create compressor for tgz file: %v", err)
+	}
+	a.compressor, a.tarBytes.w, a.stored = c, c, store
+}
+
+// entryAt returns e with where its gzip member or zstd frame starts, for
+// RESTORE_MANIFEST to read it alone, with COMPRESS_EACH_FILE.
+func (a *tarArchive) entryAt(e ManifestEntry) ManifestEntry {
+	if compressEachFile {
+		e.EntryCompression, e.EntryOffset = compression, a.memberStart
+	}
+	return e
+}
+
+// closedChecksum returns the CRC32C of the archive once closed, if
+// VERIFY_UPLOAD is set.
+func (a *tarArchive) closedChecksum() string {
+	if a.checksum == nil {
+		return ""
 	}
-	archiveTar = tar.NewWriter(archiveGzip)
-	return tgzFilePath
+	return encodeCRC32C(a.checksum)
 }
 
-func CloseArchive() {
-	if archiveFile == nil {
+func (a *tarArchive) Close() {
+	if a.file == nil {
 		return
 	}
-	if err := archiveTar.Close(); err != nil {
-		log.Printf("failed to close tar writer: %v", err)
+	if a.zw != nil {
+		if err := a.zw.Close(); err != nil { // Writes the central directory
+			Errorf("failed to close zip writer: %v", err)
+		}
+	} else {
+		if err := a.tw.Close(); err != nil {
+			Errorf("failed to close tar writer: %v", err)
+		}
+		if err := a.compressor.Close(); err != nil {
+			Errorf("failed to close %s writer: %v", compression, err)
+		}
 	}
-	archiveGzip.Flush()
-	if err := archiveGzip.Close(); err != nil {
-		log.Printf("failed to close gzip writer: %v", err)
+	if a.encrypter != nil {
+		if err := a.encrypter.Close(); err != nil {
+			Errorf("failed to finish encrypting archive: %v", err)
+		}
+	}
+	if f, ok := a.file.(*os.File); ok {
+		f.Sync()
 	}
-	archiveFile.Sync()
-	if err := archiveFile.Close(); err != nil {
-		log.Printf("failed to close tgz file: %v", err)
+	if err := a.file.Close(); err != nil {
+		if streamUpload {
+			// There is no local copy to upload again
+			fatalf("failed to upload archive: %v", err)
+		}
+		Errorf("failed to close tgz file: %v", err)
 	}
-	archiveFile = nil
+	a.file = nil
 }
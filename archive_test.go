@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	stdgzip "compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarGzip writes files to a tar stream through newCompressor.
+func tarGzip(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	c, err := newCompressor(&buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(c)
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// untarGzip reads a tar.gz stream with the standard library.
+func untarGzip(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	zr, err := stdgzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestGzipTarRoundTrip(t *testing.T) {
+	defer func(c string, level int) { compression, gzipLevel = c, level }(compression, gzipLevel)
+	compression = "gzip"
+	files := map[string][]byte{
+		"empty":    {},
+		"text.txt": bytes.Repeat([]byte("the quick brown fox "), 10000),
+		"dir/b":    []byte("b"),
+	}
+	for _, level := range []int{0, 1, 6, 9} {
+		t.Run(fmt.Sprint("level ", level), func(t *testing.T) {
+			gzipLevel = level
+			data := tarGzip(t, files)
+			got := untarGzip(t, data)
+			if len(got) != len(files) {
+				t.Fatalf("got %d files, want %d", len(got), len(files))
+			}
+			for name, want := range files {
+				if !bytes.Equal(got[name], want) {
+					t.Errorf("%s: got %d bytes, want %d", name, len(got[name]), len(want))
+				}
+			}
+			if level > 0 && len(data) >= len(files["text.txt"]) {
+				t.Errorf("level %d came to %d bytes, not compressed", level, len(data))
+			}
+		})
+	}
+}
+
+func TestTarLongAndUnicodeKeys(t *testing.T) {
+	keys := []string{
+		strings.Repeat("long-directory-name/", 14) + "file.txt", // 288 bytes
+		strings.Repeat("k", 300),
+		"photos/🎉 party/写真-2024.jpg",
+		"文档/報告書/리포트.pdf",
+	}
+	if len(keys[1]) != 300 {
+		t.Fatalf("key is %d bytes, want 300", len(keys[1]))
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, key := range keys {
+		wf := &WorkFile{Filename: key, Size: int64(len(key)), Bytes: []byte(key)}
+		if err := tw.WriteHeader(tarHeader(wf, time.Now())); err != nil {
+			t.Fatalf("%q: %v", key, err)
+		}
+		tw.Write(wf.Bytes)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	for _, key := range keys {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		if hdr.Name != key || string(data) != key {
+			t.Errorf("got %q holding %q, want %q", hdr.Name, data, key)
+		}
+		if hdr.PAXRecords["path"] != key {
+			t.Errorf("%q isn't kept whole in a PAX path record", key)
+		}
+	}
+}
+
+func TestDirectoryPlaceholders(t *testing.T) {
+	defer func(keys string) { directoryKeys = keys }(directoryKeys)
+	objects := map[string][]byte{
+		"photos/":           {},
+		"photos/2024/":      {},
+		"photos/2024/a.jpg": []byte("jpeg"),
+		"empty.txt":         {},
+	}
+	placeholder := map[string]bool{"photos/": true, "photos/2024/": true}
+
+	// Placeholders are skipped with DIRECTORY_KEYS skip, and nothing else is
+	for _, mode := range []string{"dir", "skip"} {
+		directoryKeys = mode
+		for key, data := range objects {
+			want := mode == "dir" || !placeholder[key]
+			if got := entrySelected(&MetaEntry{Key: key, Size: int64(len(data))}); got != want {
+				t.Errorf("DIRECTORY_KEYS %s: %s selected %v, want %v", mode, key, got, want)
+			}
+		}
+	}
+
+	// Or downloaded and archived as directory entries
+	_, got := runDownloader(t, newMemStore(objects))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for key, data := range got {
+		wf := &WorkFile{Filename: key, Size: int64(len(data)), Bytes: data}
+		if err := tw.WriteHeader(tarHeader(wf, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	dir := t.TempDir()
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	written := make(map[string]bool)
+	n := 0
+	for ; ; n++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isDir := hdr.Typeflag == tar.TypeDir; isDir != placeholder[hdr.Name] {
+			t.Errorf("%s is a directory entry: %v, want %v", hdr.Name, isDir, placeholder[hdr.Name])
+		}
+		if err := extractToDir(root, tr, hdr, written); err != nil {
+			t.Errorf("%s: %v", hdr.Name, err)
+		}
+	}
+	if n != len(objects) {
+		t.Errorf("archived %d entries, want %d", n, len(objects))
+	}
+	for key := range placeholder {
+		if info, err := os.Stat(filepath.Join(dir, key)); err != nil || !info.IsDir() {
+			t.Errorf("%s wasn't restored as a directory", key)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "photos/2024/a.jpg")); err != nil || string(data) != "jpeg" {
+		t.Errorf("photos/2024/a.jpg restored as %q, %v", data, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var checkpointFile = Env("CHECKPOINT_FILE", "", "File recording the newest object archived, so the next run only archives objects new or changed since")
+
+// Checkpoint is the newest last modified time of the objects archived by a
+// run, along with the ETags of the objects modified at that very time, so
+// objects written in the same second after the listing aren't missed.
+type Checkpoint struct {
+	LastModified time.Time         `json:"last_modified"`
+	Keys         map[string]string `json:"keys,omitempty"` // ETag by key, of the objects at LastModified
+}
+
+var (
+	// lastCheckpoint is the one read at the start of the run, if any.
+	lastCheckpoint *Checkpoint
+
+	// nextCheckpoint collects the archived and failed objects for the
+	// checkpoint written at the end of the run.
+	nextCheckpoint = struct {
+		sync.Mutex
+		Checkpoint
+		failedBefore time.Time // Earliest last modified time of a failed object
+		unknown      bool      // A failed object had no last modified time
+	}{}
+)
+
+// initCheckpoint reads CHECKPOINT_FILE, if there is one yet.
+func initCheckpoint() {
+	if checkpointFile == "" {
+		return
+	}
+	data, err := os.ReadFile(checkpointFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		Infof("No checkpoint in %s yet, so every object is archived", checkpointFile)
+		return
+	} else if err != nil {
+		log.Fatalf("failed to read CHECKPOINT_FILE: %v", err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		log.Fatalf("CHECKPOINT_FILE %s is invalid: %v", checkpointFile, err)
+	}
+	lastCheckpoint = &cp
+	Infof("Archiving objects modified since the checkpoint at %s", cp.LastModified.Format(time.RFC3339))
+}
+
+// checkpointSelected reports whether an object last modified at lastModified
+// is new or changed since the last checkpoint.
+func checkpointSelected(key, etag string, lastModified time.Time) bool {
+	cp := lastCheckpoint
+	if cp == nil {
+		return true
+	}
+	if lastModified.Before(cp.LastModified) {
+		return false
+	}
+	if lastModified.Equal(cp.LastModified) {
+		prior, ok := cp.Keys[key]
+		return !ok || prior != etag
+	}
+	return true
+}
+
+// checkpointArchived records objects whose archive was uploaded.
+func checkpointArchived(objs []SourceObject) {
+	if checkpointFile == "" {
+		return
+	}
+	nextCheckpoint.Lock()
+	defer nextCheckpoint.Unlock()
+	for _, o := range objs {
+		if o.LastModified.IsZero() {
+			continue
+		}
+		switch {
+		case o.LastModified.After(nextCheckpoint.LastModified):
+			nextCheckpoint.LastModified = o.LastModified
+			nextCheckpoint.Keys = map[string]string{o.Key: o.ETag}
+		case o.LastModified.Equal(nextCheckpoint.LastModified):
+			nextCheckpoint.Keys[o.Key] = o.ETag
+		}
+	}
+}
+
+// checkpointFailed records an object that failed, so the checkpoint stays
+// before it and the next run tries it again.
+func checkpointFailed(lastModified time.Time) {
+	if checkpointFile == "" {
+		return
+	}
+	nextCheckpoint.Lock()
+	defer nextCheckpoint.Unlock()
+	if lastModified.IsZero() {
+		nextCheckpoint.unknown = true
+	} else if nextCheckpoint.failedBefore.IsZero() || lastModified.Before(nextCheckpoint.failedBefore) {
+		nextCheckpoint.failedBefore = lastModified
+	}
+}
+
+// writeCheckpoint saves the checkpoint for the next run, by way of a temp
+// file renamed over the old one so a crash leaves one or the other whole.
+// When files failed, the checkpoint is put just before the earliest of them
+// so the next run tries them again, even if that moves it back.
+func writeCheckpoint() {
+	if checkpointFile == "" {
+		return
+	}
+	nextCheckpoint.Lock()
+	defer nextCheckpoint.Unlock()
+	cp := nextCheckpoint.Checkpoint
+	last := lastCheckpoint
+	switch {
+	case nextCheckpoint.unknown:
+		Warnf("Keeping the old checkpoint, as a file without a last modified time failed")
+		return
+	case !nextCheckpoint.failedBefore.IsZero() && !cp.LastModified.Before(nextCheckpoint.failedBefore):
+		cp = Checkpoint{LastModified: nextCheckpoint.failedBefore.Add(-time.Second)}
+	case cp.LastModified.IsZero() || last != nil && cp.LastModified.Before(last.LastModified):
+		return // Nothing newer was archived
+	case last != nil && cp.LastModified.Equal(last.LastModified):
+		for k, v := range last.Keys {
+			if _, ok := cp.Keys[k]; !ok {
+				cp.Keys[k] = v
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		Errorf("failed to encode checkpoint: %v", err)
+		return
+	}
+	if err := writeFileAtomic(checkpointFile, append(data, '\n')); err != nil {
+		Errorf("failed to write checkpoint %s: %v", checkpointFile, err)
+		return
+	}
+	Infof("Checkpoint at %s written to %s", cp.LastModified.Format(time.RFC3339), checkpointFile)
+}
+
+// writeFileAtomic replaces path with data by writing a temp file beside it,
+// syncing it and renaming it into place.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
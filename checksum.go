@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	verifyETag        = Env("DISABLE_ETAG_CHECK", "", "Disable the MD5 check of in-memory downloads against the ETag") == ""
+	checksumAlgorithm = strings.ToUpper(Env("CHECKSUM_ALGORITHM", "", "Verify downloads with the S3 checksum: CRC32, CRC32C, SHA1 or SHA256"))
+)
+
+// partRange is an inclusive byte range of an object along with the checksum
+// S3 recorded for it, if known.
+type partRange struct {
+	start, end int64
+	checksum   string
+	parts      []partRange // The stored parts merged into the range, checked one by one, if any
+}
+
+// verified reports whether the range has a checksum to check it with.
+func (r partRange) verified() bool {
+	return r.checksum != "" || len(r.parts) > 0
+}
+
+// mergeParts joins adjacent parts into n ranges, or as few more as it takes
+// for each to hold the same number of parts, keeping the parts in each to be
+// checked on their own.  Parts stored by an upload may be more, or smaller,
+// than are worth a GET each.
+func mergeParts(parts []partRange, n int) []partRange {
+	if n >= len(parts) {
+		return parts
+	}
+	per := (len(parts) + n - 1) / n
+	merged := make([]partRange, 0, n)
+	for group := range slices.Chunk(parts, per) {
+		merged = append(merged, partRange{start: group[0].start, end: group[len(group)-1].end, parts: group})
+	}
+	return merged
+}
+
+// partsChecker hashes a range merged by mergeParts as it streams, checking
+// each of its stored parts as it is completed.  The embedded hash is that of
+// the whole range.
+type partsChecker struct {
+	hash.Hash
+	parts []partRange // Still to complete
+	cur   hash.Hash   // Of the first of parts
+	pos   int64       // In the object
+	err   error       // From the first part that didn't match
+}
+
+func newPartsChecker(r partRange) *partsChecker {
+	return &partsChecker{Hash: newChecksum(), parts: r.parts, cur: newChecksum(), pos: r.start}
+}
+
+func (c *partsChecker) Write(p []byte) (int, error) {
+	c.Hash.Write(p)
+	n := len(p)
+	for len(p) > 0 && len(c.parts) > 0 {
+		part := c.parts[0]
+		k := min(int64(len(p)), part.end+1-c.pos)
+		c.cur.Write(p[:k])
+		c.pos += k
+		p = p[k:]
+		if c.pos > part.end {
+			if err := compareChecksum(c.cur, part.checksum); err != nil && c.err == nil {
+				c.err = fmt.Errorf("stored part at offset %d: %w", part.start, err)
+			}
+			c.cur.Reset()
+			c.parts = c.parts[1:]
+		}
+	}
+	return n, nil
+}
+
+// checkETag compares the MD5 of data with the object's ETag.  ETags from
+// multipart uploads (those with a dash) are not an MD5 and are skipped.
+func checkETag(etag string, data []byte) error {
+	etag = strings.Trim(etag, `"`)
+	if etag == "" || strings.Contains(etag, "-") {
+		return nil
+	}
+	sum := md5.Sum(data)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, etag) {
+		return fmt.Errorf("ETag %w: expected %s, got %s", errChecksumMismatch, etag, got)
+	}
+	return nil
+}
+
+// newChecksum returns a hash for the configured CHECKSUM_ALGORITHM, or nil if
+// checksum verification is disabled or the algorithm is unknown.
+func newChecksum() hash.Hash {
+	switch checksumAlgorithm {
+	case "CRC32":
+		return crc32.NewIEEE()
+	case "CRC32C":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "SHA1":
+		return sha1.New()
+	case "SHA256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// pickChecksum returns the value matching the configured algorithm.
+func pickChecksum(crc, crcc, sha1, sha256 *string) string {
+	switch checksumAlgorithm {
+	case "CRC32":
+		return aws.ToString(crc)
+	case "CRC32C":
+		return aws.ToString(crcc)
+	case "SHA1":
+		return aws.ToString(sha1)
+	case "SHA256":
+		return aws.ToString(sha256)
+	}
+	return ""
+}
+
+// compareChecksum checks the sum in h against the base64 value from S3.
+func compareChecksum(h hash.Hash, expected string) error {
+	return compareSum(encodeSum(h), expected)
+}
+
+// compareSum checks the base64 sum got against the base64 value from S3.
+func compareSum(got, expected string) error {
+	if got != expected {
+		return fmt.Errorf("%s %w: expected %s, got %s", checksumAlgorithm, errChecksumMismatch, expected, got)
+	}
+	return nil
+}
+
+// encodeSum returns the sum in h in base64, as S3 gives checksums.
+func encodeSum(h hash.Hash) string {
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// combineSums returns the base64 checksum of the whole of an object from the
+// hashes of each of its ranges, in order, as they were downloaded, so it
+// needn't be read again.  It returns "" if a range has no hash, or for SHA-1
+// and SHA-256 with more than one range, as those can't be put together.
+func combineSums(ranges []partRange, sums []hash.Hash) string {
+	if len(sums) == 0 || slices.Contains(sums, nil) {
+		return ""
+	}
+	if len(sums) == 1 {
+		return encodeSum(sums[0])
+	}
+	var poly uint32
+	switch checksumAlgorithm {
+	case "CRC32":
+		poly = crc32.IEEE
+	case "CRC32C":
+		poly = crc32.Castagnoli
+	default:
+		return ""
+	}
+	crc := sums[0].(hash.Hash32).Sum32()
+	for i, h := range sums[1:] {
+		r := ranges[i+1]
+		crc = crc32Combine(poly, crc, h.(hash.Hash32).Sum32(), r.end-r.start+1)
+	}
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc))
+}
+
+// crc32Combine returns the CRC-32 of a followed by b from their CRCs, crcA and
+// crcB, and the length of b, for the reversed polynomial poly.  This is
+// crc32_combine from zlib: it applies lenB zero bits to crcA with powers of
+// the polynomial's shift matrix, squared for each bit of lenB.
+func crc32Combine(poly, crcA, crcB uint32, lenB int64) uint32 {
+	if lenB <= 0 {
+		return crcA
+	}
+	times := func(mat *[32]uint32, vec uint32) uint32 {
+		var sum uint32
+		for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+			if vec&1 != 0 {
+				sum ^= mat[i]
+			}
+		}
+		return sum
+	}
+	square := func(sq, mat *[32]uint32) {
+		for i := range sq {
+			sq[i] = times(mat, mat[i])
+		}
+	}
+	var even, odd [32]uint32
+	odd[0] = poly // The operator for one zero bit
+	for i, row := 1, uint32(1); i < 32; i, row = i+1, row<<1 {
+		odd[i] = row
+	}
+	square(&even, &odd) // Two zero bits
+	square(&odd, &even) // Four
+	for {
+		// The first square gives one zero byte
+		square(&even, &odd)
+		if lenB&1 != 0 {
+			crcA = times(&even, crcA)
+		}
+		if lenB >>= 1; lenB == 0 {
+			break
+		}
+		square(&odd, &even)
+		if lenB&1 != 0 {
+			crcA = times(&odd, crcA)
+		}
+		if lenB >>= 1; lenB == 0 {
+			break
+		}
+	}
+	return crcA ^ crcB
+}
+
+// ObjectChecksum looks up the checksums S3 holds for the object.  When the
+// object was uploaded in parts with checksums, the parts are returned as
+// ranges so each can be verified on its own.  Otherwise the whole-object
+// checksum is returned, which is empty if there isn't one.
+func (s *S3Store) ObjectChecksum(ctx context.Context, key, versionID string, size int64) (whole string, parts []partRange, err error) {
+	input := &s3.GetObjectAttributesInput{
+		Bucket:    aws.String(s.Bucket),
+		Key:       aws.String(key),
+		VersionId: versionIDParam(versionID),
+		ObjectAttributes: []types.ObjectAttributes{
+			types.ObjectAttributesChecksum,
+			types.ObjectAttributesObjectParts,
+		},
+		MaxParts:     aws.Int32(1000),
+		RequestPayer: requestPayer(s.RequesterPays),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = sseCustomerParams(s.SSECustomerKey)
+
+	var offset int64
+	for {
+		attr, err := s.Client.GetObjectAttributes(ctx, input)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get object attributes: %w", err)
+		}
+		if c := attr.Checksum; c != nil && input.PartNumberMarker == nil && c.ChecksumType != types.ChecksumTypeComposite {
+			whole = pickChecksum(c.ChecksumCRC32, c.ChecksumCRC32C, c.ChecksumSHA1, c.ChecksumSHA256)
+		}
+		if attr.ObjectParts == nil {
+			break
+		}
+		for _, p := range attr.ObjectParts.Parts {
+			sum := pickChecksum(p.ChecksumCRC32, p.ChecksumCRC32C, p.ChecksumSHA1, p.ChecksumSHA256)
+			if sum == "" || aws.ToInt64(p.Size) <= 0 {
+				// Without a checksum for every part they can't be verified
+				return whole, nil, nil
+			}
+			parts = append(parts, partRange{start: offset, end: offset + *p.Size - 1, checksum: sum})
+			offset += *p.Size
+		}
+		if !aws.ToBool(attr.ObjectParts.IsTruncated) {
+			break
+		}
+		input.PartNumberMarker = attr.ObjectParts.NextPartNumberMarker
+	}
+	if offset != size {
+		parts = nil
+	}
+	return whole, parts, nil
+}
+
+// verifyParts checks each part of data against the checksum S3 recorded.
+func verifyParts(data []byte, parts []partRange) error {
+	for i, p := range parts {
+		h := newChecksum()
+		h.Write(data[p.start : p.end+1])
+		if err := compareChecksum(h, p.checksum); err != nil {
+			return fmt.Errorf("part %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// verifyFile reads the file back to check it against a whole-object checksum,
+// and returns its checksum.  This is only needed when the object was fetched
+// in several parallel ranges whose hashes combineSums can't put together: the
+// SHA types, or ranges resumed from an earlier run, which have no hash.  It
+// costs a second read of the file.
+func verifyFile(path string, expected string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newChecksum()
+	buf := bufPool32.Get().([]byte)
+	defer bufPool32.Put(buf)
+	if _, err := io.CopyBuffer(h, f, buf); err != nil {
+		return "", err
+	}
+	return encodeSum(h), compareChecksum(h, expected)
+}
@@ -2,24 +2,36 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 )
 
+// smallBufSize is the size of the buffers in bufPool32.
+const smallBufSize = 32 * 1024
+
 var (
 	// bufPool is a sync.Pool to reuse byte slices for copying data
 	bufPool32 = sync.Pool{
 		New: func() interface{} {
-			return make([]byte, 32*1024)
+			return make([]byte, smallBufSize)
 		},
 	} // bufPool is a sync.Pool to reuse byte slices for copying data
 	bufPoolLarge = sync.Pool{
 		New: func() interface{} {
-			return make([]byte, maxMemObject*1024)
+			return make([]byte, largeBufSize())
 		},
 	}
 )
 
+// largeBufSize is the size of the buffers in bufPoolLarge, which must hold
+// the largest object kept in memory.
+func largeBufSize() int64 {
+	return maxMemObject * 1024
+}
+
 func Env(env, def, usage string) string {
 	if e := os.Getenv(env); len(e) > 0 {
 		fmt.Printf("  %-30s # %s\n", fmt.Sprintf("%s=%q", env, e), usage)
@@ -46,25 +58,33 @@ func EnvInt(env string, def int, usage string) int {
 }
 
 // parseByteSize parses a human-readable byte size string (e.g., "1GB", "500MB", "100K") into int64 bytes.
+// The size must be a whole number, and 0 is allowed; callers that need more check for it.
 func parseByteSize(s string) (int64, error) {
-	var size int64
-	var unit string
-	n, err := fmt.Sscanf(s, "%d%s", &size, &unit)
-	if n < 1 || err != nil {
+	digits, unit := s, ""
+	if i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits, unit = s[:i], s[i:]
+	}
+	size, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
 		return 0, fmt.Errorf("invalid size format: %q", s)
 	}
+	var scale int64
 	switch unit {
 	case "", "B", "b":
-		return size, nil
+		scale = 1
 	case "K", "KB", "k", "kb":
-		return size * 1024, nil
+		scale = 1024
 	case "M", "MB", "m", "mb":
-		return size * 1024 * 1024, nil
+		scale = 1024 * 1024
 	case "G", "GB", "g", "gb":
-		return size * 1024 * 1024 * 1024, nil
+		scale = 1024 * 1024 * 1024
 	case "T", "TB", "t", "tb":
-		return size * 1024 * 1024 * 1024 * 1024, nil
+		scale = 1024 * 1024 * 1024 * 1024
 	default:
 		return 0, fmt.Errorf("unknown size unit: %q", unit)
 	}
+	if size > math.MaxInt64/scale {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return size * scale, nil
 }
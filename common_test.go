@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestGetMemory(t *testing.T) {
+	large, out := largeBufSize(), memoryOut.Load()
+	tests := []struct {
+		size int64
+		want int64
+	}{
+		{1, smallBufSize},
+		{smallBufSize, smallBufSize},
+		{smallBufSize + 1, large},
+		{maxMemObject * 1024, large},
+		{maxMemObject*1024 + 1, maxMemObject*1024 + 1},
+	}
+	for _, tt := range tests {
+		mem := getMemory(tt.size)
+		if int64(len(mem)) != tt.want {
+			t.Errorf("getMemory(%d) holds %d bytes, want %d", tt.size, len(mem), tt.want)
+		}
+		putMemory(mem)
+	}
+	if n := memoryOut.Load() - out; n != 0 {
+		t.Errorf("%d bytes still checked out", n)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"0M", 0},
+		{"100", 100},
+		{"100B", 100},
+		{"4K", 4 << 10},
+		{"500MB", 500 << 20},
+		{"2g", 2 << 30},
+		{"1T", 1 << 40},
+	} {
+		if got, err := parseByteSize(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "-5M", "M", "1.5G", "10X", "G10", "9999999999T", " 10"} {
+		if got, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestDiskMarginZero(t *testing.T) {
+	defer func(s string, n int64) { diskMarginStr, diskMargin = s, n }(diskMarginStr, diskMargin)
+	diskMarginStr = "0"
+	checkDiskMargin() // Fatal if 0 is refused
+	if diskMargin != 0 {
+		t.Errorf("DISK_SPACE_MARGIN=0 parsed as %d", diskMargin)
+	}
+}
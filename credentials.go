@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+var (
+	awsProfile         = Env("AWS_PROFILE", "", "Named profile in the AWS config and credentials files to take the keys from")
+	assumeRoleARN      = Env("ASSUME_ROLE_ARN", "", "Role to assume with STS for the S3 requests")
+	assumeRoleExtID    = Env("ASSUME_ROLE_EXTERNAL_ID", "", "External ID to give when assuming ASSUME_ROLE_ARN")
+	assumeRoleDuration = Env("ASSUME_ROLE_DURATION", "1h", "How long the assumed role credentials last before they are renewed")
+	stsEndpoint        = Env("STS_ENDPOINT", "", "Custom STS endpoint URL for assuming roles, default the regional AWS one")
+
+	// The credentials for each bucket, which default to the ones above
+	srcCredentials = credentialSettings{
+		bucket:     "SRC_BUCKET",
+		profile:    Env("SRC_AWS_PROFILE", awsProfile, "AWS_PROFILE for reading SRC_BUCKET"),
+		roleARN:    Env("SRC_ASSUME_ROLE_ARN", assumeRoleARN, "ASSUME_ROLE_ARN for reading SRC_BUCKET"),
+		externalID: Env("SRC_ASSUME_ROLE_EXTERNAL_ID", assumeRoleExtID, "ASSUME_ROLE_EXTERNAL_ID for reading SRC_BUCKET"),
+		duration:   Env("SRC_ASSUME_ROLE_DURATION", assumeRoleDuration, "ASSUME_ROLE_DURATION for reading SRC_BUCKET"),
+		anonymous:  Env("SRC_ANONYMOUS", "", "Read SRC_BUCKET without signing the requests, for public buckets") != "",
+	}
+	dstCredentials = credentialSettings{
+		bucket:     "DST_BUCKET",
+		profile:    Env("DST_AWS_PROFILE", awsProfile, "AWS_PROFILE for writing DST_BUCKET"),
+		roleARN:    Env("DST_ASSUME_ROLE_ARN", assumeRoleARN, "ASSUME_ROLE_ARN for writing DST_BUCKET"),
+		externalID: Env("DST_ASSUME_ROLE_EXTERNAL_ID", assumeRoleExtID, "ASSUME_ROLE_EXTERNAL_ID for writing DST_BUCKET"),
+		duration:   Env("DST_ASSUME_ROLE_DURATION", assumeRoleDuration, "ASSUME_ROLE_DURATION for writing DST_BUCKET"),
+	}
+)
+
+// credentialSettings is where the credentials for one of the buckets come
+// from.  Without a profile or role the instance role is used, or the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY with S3_ENDPOINT.
+type credentialSettings struct {
+	bucket     string // The setting the credentials are for, for messages
+	profile    string
+	roleARN    string
+	externalID string
+	duration   string
+	anonymous  bool // Requests aren't signed at all
+}
+
+// sameCredentials reports whether a and b get the same credentials, so the
+// buckets can share a client.
+func sameCredentials(a, b credentialSettings) bool {
+	a.bucket, b.bucket = "", ""
+	return a == b
+}
+
+// profileRegion returns the region set in the profile, if any.
+func (c credentialSettings) profileRegion() string {
+	if c.profile == "" {
+		return ""
+	}
+	p, _ := loadProfile(c.profile) // Checked by checkCredentialSettings
+	return p.Region
+}
+
+// provider returns the credentials provider for c, on top of base, the
+// provider used when there is no profile.  Roles are assumed through STS in
+// region.
+func (c credentialSettings) provider(base func() aws.CredentialsProvider, region string) (*aws.CredentialsCache, error) {
+	if c.anonymous {
+		// The S3 client sees through the cache and leaves the requests unsigned
+		return aws.NewCredentialsCache(aws.AnonymousCredentials{}), nil
+	}
+	var provider aws.CredentialsProvider
+	if c.profile != "" {
+		var err error
+		if provider, err = profileProvider(c.profile, region); err != nil {
+			return nil, fmt.Errorf("%s credentials: %w", c.bucket, err)
+		}
+	} else {
+		provider = base()
+	}
+	if c.roleARN != "" {
+		d, err := time.ParseDuration(c.duration)
+		if err != nil {
+			return nil, fmt.Errorf("%s credentials: invalid role duration: %w", c.bucket, err)
+		}
+		provider = stscreds.NewAssumeRoleProvider(stsClient(provider, region), c.roleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = fmt.Sprintf("bucket-archiver-%d", time.Now().Unix())
+			o.Duration = d
+			if c.externalID != "" {
+				o.ExternalID = aws.String(c.externalID)
+			}
+		})
+	}
+	return aws.NewCredentialsCache(provider), nil
+}
+
+// checkCredentialSettings validates the credential settings of both buckets
+// before any requests are made.
+func checkCredentialSettings() {
+	for _, c := range []credentialSettings{srcCredentials, dstCredentials} {
+		if c.anonymous && (c.profile != "" || c.roleARN != "") {
+			log.Fatalf("SRC_ANONYMOUS can't be used with a profile or role for %s", c.bucket)
+		}
+		if c.anonymous && s3RequesterPays {
+			log.Fatalf("SRC_ANONYMOUS can't be used with S3_REQUESTER_PAYS, as the charges need an account")
+		}
+		if c.profile != "" {
+			var notExist config.SharedConfigProfileNotExistError
+			if _, err := loadProfile(c.profile); errors.As(err, &notExist) {
+				log.Fatalf("%s profile %q isn't in the AWS config or credentials files", c.bucket, c.profile)
+			} else if err != nil {
+				log.Fatalf("failed to read the %s profile %q: %v", c.bucket, c.profile, err)
+			}
+		}
+		if c.roleARN == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(c.duration); err != nil {
+			log.Fatalf("failed to parse the %s ASSUME_ROLE_DURATION: %v", c.bucket, err)
+		} else if d < 15*time.Minute || d > 12*time.Hour {
+			log.Fatalf("%s ASSUME_ROLE_DURATION %s is invalid; must be between 15m and 12h", c.bucket, c.duration)
+		}
+	}
+}
+
+// envCredentials is the provider of the keys in the environment.
+func envCredentials() aws.CredentialsProvider {
+	return credentials.NewStaticCredentialsProvider(
+		os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"))
+}
+
+// loadProfile reads the named profile from the AWS config and credentials
+// files, from where AWS_CONFIG_FILE and AWS_SHARED_CREDENTIALS_FILE say or
+// else ~/.aws.
+func loadProfile(name string) (config.SharedConfig, error) {
+	return config.LoadSharedConfigProfile(context.TODO(), name, func(o *config.LoadSharedConfigOptions) {
+		if f := os.Getenv("AWS_CONFIG_FILE"); f != "" {
+			o.ConfigFiles = []string{f}
+		}
+		if f := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); f != "" {
+			o.CredentialsFiles = []string{f}
+		}
+	})
+}
+
+// profileProvider returns the provider of the credentials of the named
+// profile, as the SDK resolves them: its keys, or the role it assumes on top
+// of its source_profile or credential_source, among others.
+func profileProvider(name, region string) (aws.CredentialsProvider, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithSharedConfigProfile(name),
+		config.WithDefaultRegion("us-east-1"),
+		config.WithHTTPClient(s3Settings{}.httpClient().WithTimeout(time.Minute)),
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if stsEndpoint != "" {
+		opts = append(opts, config.WithBaseEndpoint(stsEndpoint))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, err)
+	}
+	return cfg.Credentials, nil
+}
+
+// stsClient returns an STS client in region, or us-east-1, at STS_ENDPOINT
+// if set, signing its requests with the credentials of base.
+func stsClient(base aws.CredentialsProvider, region string) *sts.Client {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return sts.New(sts.Options{
+		Region:      region,
+		Credentials: base,
+		HTTPClient:  s3Settings{}.httpClient().WithTimeout(time.Minute),
+	}, func(o *sts.Options) {
+		if stsEndpoint != "" {
+			o.BaseEndpoint = aws.String(stsEndpoint)
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfileCredentials(t *testing.T) {
+	dir := t.TempDir()
+	configFile, credentialsFile := filepath.Join(dir, "config"), filepath.Join(dir, "credentials")
+	if err := os.WriteFile(configFile, []byte("[profile archive]\nregion = eu-west-2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(credentialsFile, []byte("[archive]\naws_access_key_id = AKID\naws_secret_access_key = SECRET\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+
+	c := credentialSettings{bucket: "SRC_BUCKET", profile: "archive"}
+	if r := c.profileRegion(); r != "eu-west-2" {
+		t.Errorf("profile region %q, want eu-west-2", r)
+	}
+	cache, err := c.provider(envCredentials, c.profileRegion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := cache.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "AKID" || creds.SecretAccessKey != "SECRET" {
+		t.Errorf("got keys %q and %q", creds.AccessKeyID, creds.SecretAccessKey)
+	}
+	if _, err := loadProfile("missing"); err == nil {
+		t.Error("loaded a profile that isn't there")
+	}
+}
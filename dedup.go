@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var dedup = Env("DEDUP", "", "Write objects with the same contents as one already archived as links to the first copy") != ""
+
+// paxDedupArchive names the archive holding the contents of a link entry,
+// when it isn't the archive of the link itself.
+const paxDedupArchive = "S3ARCHIVER.dedup-archive"
+
+// maxCopySize is the largest object CopyObject copies in one request.
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// dedupCopy is the first copy of some contents written this run.
+type dedupCopy struct {
+	key     string
+	archive string
+}
+
+// dedupSeen holds the first copy of each SHA-256 written, with DEDUP.  The
+// archive writers share it under dedupMu.
+var (
+	dedupSeen = make(map[string]dedupCopy)
+	dedupMu   sync.Mutex
+)
+
+// dedupFirst returns the first copy of the contents with SHA-256 sum, if
+// there is one, or else records key in archive as that copy.
+func dedupFirst(sum, key, archive string) (dedupCopy, bool) {
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	if first, ok := dedupSeen[sum]; ok {
+		return first, true
+	}
+	dedupSeen[sum] = dedupCopy{key: key, archive: archive}
+	return dedupCopy{}, false
+}
+
+// taskSHA256 returns the hex SHA-256 of the contents of task, reading them
+// once ahead of writing them.
+func taskSHA256(task *WorkFile) (string, error) {
+	fh, err := task.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkHeader returns the tar header recording task as a hard link to first,
+// the earlier copy of the same contents, in an archive opened at opened.
+func linkHeader(task *WorkFile, first dedupCopy, archive string, opened time.Time) *tar.Header {
+	hdr := tarHeader(task, opened)
+	hdr.Typeflag = tar.TypeLink
+	hdr.Linkname = first.key
+	hdr.Size = 0
+	if first.archive != archive {
+		hdr.PAXRecords = maps.Clone(hdr.PAXRecords)
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string, 1)
+		}
+		hdr.PAXRecords[paxDedupArchive] = first.archive
+	}
+	return hdr
+}
+
+// linkSource describes where the contents of the link entry hdr are, for
+// errors when they can't be found.
+func linkSource(hdr *tar.Header) string {
+	if archive := hdr.PAXRecords[paxDedupArchive]; archive != "" {
+		return fmt.Sprintf("%s in %s", hdr.Linkname, archive)
+	}
+	return hdr.Linkname
+}
+
+// copySource returns the URL-encoded CopySource naming key in bucket.
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// copyObject copies srcKey to key within bucket through client, with the
+// metadata in meta.  Objects too large for CopyObject are copied in parts.
+func copyObject(ctx context.Context, client *s3.Client, bucket, srcKey, key string, meta *ObjectMeta) error {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(srcKey)})
+	if err != nil {
+		return err
+	}
+	size := aws.ToInt64(head.ContentLength)
+	source := copySource(bucket, srcKey)
+
+	if size <= maxCopySize {
+		return withRetry(ctx, uploadRetryMax, func() error {
+			_, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+				Bucket:               aws.String(bucket),
+				Key:                  aws.String(key),
+				CopySource:           aws.String(source),
+				MetadataDirective:    "REPLACE",
+				ContentType:          uploadContentType(meta),
+				Metadata:             uploadMetadata(meta),
+				StorageClass:         destStorageClass,
+				ServerSideEncryption: destSSE,
+				SSEKMSKeyId:          kmsKeyID(),
+			})
+			return err
+		})
+	}
+
+	upload, err := startMultipartUpload(ctx, client, bucket, key, meta, nil)
+	if err != nil {
+		return err
+	}
+	partSize := max(uploadPartSize, (size+maxPartCount-1)/maxPartCount)
+	for partNumber, off := int32(1), int64(0); off < size && err == nil; partNumber, off = partNumber+1, off+partSize {
+		err = upload.copyPart(ctx, partNumber, source, off, min(off+partSize, size)-1)
+	}
+	if err == nil {
+		err = upload.complete(ctx)
+	}
+	if err != nil {
+		upload.abort()
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	deleteSource        = Env("DELETE_SOURCE", "", "Delete each source object once the archive holding it is uploaded and verified") != ""
+	deleteSourceConfirm = Env("DELETE_SOURCE_CONFIRM", "", "The source bucket or SRC_DIR, repeated to confirm DELETE_SOURCE")
+)
+
+// maxDeleteBatch is the most keys DeleteObjects takes in one request.
+const maxDeleteBatch = 1000
+
+// SourceObject is an archived object, as needed to delete it from the source
+// or to checkpoint it.
+type SourceObject struct {
+	Key          string
+	Size         int64
+	ETag         string // From the listing, so a changed object isn't deleted; empty if unknown
+	LastModified time.Time
+}
+
+// deleteStore is implemented by stores that can delete the objects archived
+// from them.
+type deleteStore interface {
+	DeleteObjects(ctx context.Context, objs []SourceObject) error
+}
+
+// checkDeleteSource validates the DELETE_SOURCE settings before any work
+// starts.  Deleting needs the source named a second time, and the archives
+// checked after uploading, so nothing is lost to a typo or a bad upload.
+func checkDeleteSource() {
+	if !deleteSource {
+		return
+	}
+	source := srcBucket
+	if srcDir != "" {
+		source = srcDir
+	}
+	switch {
+	case deleteSourceConfirm != source:
+		log.Fatalf("DELETE_SOURCE needs DELETE_SOURCE_CONFIRM set to %q, the source to delete from", source)
+	case dstDir == "" && !verifyUploads:
+		log.Fatalf("DELETE_SOURCE needs VERIFY_UPLOAD, so objects are only deleted once their archive is known to be intact")
+	case dryRun:
+		log.Fatalf("DELETE_SOURCE can't be used with DRY_RUN")
+	}
+}
+
+// deleteArchived deletes the objects of an archive that was uploaded and
+// verified.  Failures are logged, as the objects are safe in the archive.
+func deleteArchived(ctx context.Context, archive string, objs []SourceObject) {
+	store, ok := sourceStore().(deleteStore)
+	if !ok || len(objs) == 0 {
+		return
+	}
+	if err := store.DeleteObjects(ctx, objs); err != nil {
+		Errorf("failed to delete source objects of %s: %v", archive, err)
+		return
+	}
+	Infof("Deleted %d source objects of %s", len(objs), archive)
+}
+
+// DeleteObjects deletes objs in batches.  Objects listed with an ETag are
+// only deleted if it still matches.
+func (s *S3Store) DeleteObjects(ctx context.Context, objs []SourceObject) error {
+	var errs []error
+	for len(objs) > 0 {
+		batch := objs[:min(len(objs), maxDeleteBatch)]
+		objs = objs[len(batch):]
+
+		ids := make([]types.ObjectIdentifier, len(batch))
+		for i, o := range batch {
+			ids[i].Key = aws.String(o.Key)
+			if o.ETag != "" {
+				ids[i].ETag = aws.String(`"` + o.ETag + `"`)
+			}
+		}
+		var out *s3.DeleteObjectsOutput
+		err := withRetry(ctx, uploadRetryMax, func() (err error) {
+			out, err = s.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket:       aws.String(s.Bucket),
+				Delete:       &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+				RequestPayer: requestPayer(s.RequesterPays),
+			})
+			return err
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, e := range out.Errors {
+			errs = append(errs, fmt.Errorf("%s: %s", aws.ToString(e.Key), aws.ToString(e.Message)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteObjects removes the files of objs.  As files have no ETag, a file is
+// only removed if its size and modification time are still those listed, so
+// one rewritten since is kept.
+func (s *FileStore) DeleteObjects(ctx context.Context, objs []SourceObject) error {
+	var errs []error
+	for _, o := range objs {
+		path, err := s.path(o.Key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fi, err := os.Lstat(path)
+		switch {
+		case err != nil:
+		case fi.Size() != o.Size || !fi.ModTime().Equal(o.LastModified):
+			err = fmt.Errorf("%s: changed since it was listed, so it was kept", o.Key)
+		default:
+			err = os.Remove(path)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
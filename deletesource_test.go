@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreDeleteKeepsChangedFiles(t *testing.T) {
+	root := t.TempDir()
+	listed := func(key, contents string) SourceObject {
+		path := filepath.Join(root, key)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return SourceObject{Key: key, Size: fi.Size(), LastModified: fi.ModTime().UTC()}
+	}
+	same := listed("same", "archived")
+	resized := listed("resized", "archived")
+	touched := listed("touched", "archived")
+
+	// Rewritten after the listing, with the archive holding the old contents
+	os.WriteFile(filepath.Join(root, "resized"), []byte("rewritten since"), 0644)
+	later := touched.LastModified.Add(time.Second)
+	os.WriteFile(filepath.Join(root, "touched"), []byte("ARCHIVED"), 0644)
+	os.Chtimes(filepath.Join(root, "touched"), later, later)
+
+	s := &FileStore{Root: root}
+	err := s.DeleteObjects(context.Background(), []SourceObject{same, resized, touched})
+	if err == nil || !strings.Contains(err.Error(), "resized: changed") || !strings.Contains(err.Error(), "touched: changed") {
+		t.Errorf("changed files weren't reported: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "same")); !os.IsNotExist(err) {
+		t.Error("unchanged file wasn't deleted")
+	}
+	for _, key := range []string{"resized", "touched"} {
+		if _, err := os.Stat(filepath.Join(root, key)); err != nil {
+			t.Errorf("changed file %s was deleted", key)
+		}
+	}
+}
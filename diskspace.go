@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// errNoSpace is returned when the temp directory can't hold a download.
+var errNoSpace = errors.New("insufficient disk space")
+
+var (
+	diskMarginStr = Env("DISK_SPACE_MARGIN", "100M", "Free space to leave in TMP_DIR after a large download")
+	diskMargin    int64
+)
+
+// checkDiskMargin parses DISK_SPACE_MARGIN.
+func checkDiskMargin() {
+	var err error
+	if diskMargin, err = parseByteSize(diskMarginStr); err != nil {
+		log.Fatalf("failed to parse DISK_SPACE_MARGIN: %v", err)
+	}
+}
+
+// checkDiskSpace makes sure there is room in dir for size more bytes plus the
+// margin.  Space already taken by a partial file at path is counted as
+// available, as resuming writes over it.  If the free space can't be found
+// out the check passes.
+func checkDiskSpace(dir, path string, size int64) error {
+	free, ok := freeSpace(dir)
+	if !ok {
+		return nil
+	}
+	if fi, err := os.Stat(path); err == nil {
+		free += allocatedSize(fi)
+	}
+	if need := size + diskMargin; free < need {
+		return fmt.Errorf("%w in %s: need %d bytes, %d available", errNoSpace, dir, need, free)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// freeSpace is not supported here, so the disk space check is skipped.
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
+
+// allocatedSize returns the size of the file.
+func allocatedSize(fi os.FileInfo) int64 {
+	return fi.Size()
+}
@@ -1,55 +1,391 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"sync/atomic"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/remeh/sizedwaitgroup"
 )
 
 // DownloadTask represents a file to download.
 type DownloadTask struct {
-	Size     int64
-	Filename string
+	Size      int64
+	Filename  string
+	VersionID string // Version of the object to fetch, empty for the latest
+
+	LastModified time.Time // From the listing, if known
+	ETag         string    // From the listing, if known
+}
+
+// source returns the object of the task as listed.
+func (t *DownloadTask) source() SourceObject {
+	return SourceObject{Key: t.Filename, Size: t.Size, ETag: t.ETag, LastModified: t.LastModified}
 }
 
-// WorkFile represents a file that has been downloaded.
+// WorkFile represents a file that has been downloaded.  Call Release when
+// done with it.
 type WorkFile struct {
 	Size     int64
 	Filename string
 
 	TempFile string // Temporary file path if the file is large.
 	Bytes    []byte // If the file is small, we can keep it in memory.
+
+	ContentType  string            // Content type of the object
+	Metadata     map[string]string // User metadata of the object
+	LastModified time.Time         // When the object was last modified, if known
+	ETag         string            // ETag of the object from the listing, for the manifest
+	Listed       SourceObject      // Key, size and time from the listing, for DELETE_SOURCE and checkpoints
+	Checksum     string            // CHECKSUM_ALGORITHM checksum computed during the download, for the manifest
+}
+
+// setMeta copies the object metadata into w.
+func (w *WorkFile) setMeta(meta ObjectMeta) {
+	w.ContentType, w.Metadata, w.LastModified = meta.ContentType, meta.Metadata, meta.LastModified
+	w.Checksum = meta.Checksum
+}
+
+// sha256 returns the hex SHA-256 of the contents if it was computed during
+// the download, with CHECKSUM_ALGORITHM SHA256, or else "".
+func (w *WorkFile) sha256() string {
+	if checksumAlgorithm != "SHA256" || w.Checksum == "" {
+		return ""
+	}
+	sum, err := base64.StdEncoding.DecodeString(w.Checksum)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
+
+// manifestChecksum returns the checksum for the manifest entry of w, as the
+// algorithm and the base64 value, or "" if none was computed.
+func (w *WorkFile) manifestChecksum() string {
+	if w.Checksum == "" {
+		return ""
+	}
+	return checksumAlgorithm + ":" + w.Checksum
+}
+
+// Reader returns a reader over the file contents, whether they are held in
+// memory or in the temporary file, mapped with TEMP_FILE_MMAP.  The caller
+// must close it when done, and before Release.
+func (w *WorkFile) Reader() (io.ReadCloser, error) {
+	if w.TempFile == "" {
+		return io.NopCloser(bytes.NewReader(w.Bytes)), nil
+	}
+	if tempFileMmap {
+		return openMapped(w.TempFile)
+	}
+	return os.Open(w.TempFile)
+}
+
+// Release returns the in-memory buffer to its pool and removes the temporary
+// file, or returns it to the pool with TEMP_FILE_POOL.  Whoever consumes a
+// WorkFile last must call Release once the contents are no longer needed, or
+// the buffer pools leak.
+func (w *WorkFile) Release() error {
+	if w.Bytes != nil {
+		memBudget.release(w.Size)
+		putMemory(w.Bytes)
+		w.Bytes = nil
+	}
+	if w.TempFile != "" {
+		err := releaseTempFile(w.TempFile)
+		w.TempFile = ""
+		return err
+	}
+	return nil
+}
+
+// memoryOut is the bytes of the buffers getMemory handed out that
+// putMemory hasn't taken back yet.
+var memoryOut atomic.Int64
+
+// getMemory returns a pooled buffer large enough to hold size bytes.
+func getMemory(size int64) []byte {
+	var mem []byte
+	switch {
+	case size <= smallBufSize:
+		mem = bufPool32.Get().([]byte)
+	case size <= largeBufSize():
+		mem = bufPoolLarge.Get().([]byte)
+	default:
+		// Bigger than the pools were sized for, so this one is left to the GC
+		mem = make([]byte, size)
+	}
+	memoryOut.Add(int64(cap(mem)))
+	return mem
 }
 
 func putMemory(mem []byte) {
 	// Function to return memory to the appropriate buffer pool based on size
 	mem = mem[:cap(mem)]
-	if len(mem) <= 32*1024 {
+	memoryOut.Add(-int64(len(mem)))
+	switch int64(len(mem)) {
+	case smallBufSize:
 		bufPool32.Put(mem)
-	} else {
+	case largeBufSize():
 		bufPoolLarge.Put(mem)
 	}
+	// Anything else didn't come from a pool and is left to the GC
 }
 
-var maxMemObject = int64(EnvInt("MAX_IN_MEM", 96, "Maximum in memory object in kb"))
+// checkMemoryPools makes sure MAX_IN_MEM can size the large pool.
+func checkMemoryPools() {
+	if maxMemObject < 0 {
+		log.Fatalf("MAX_IN_MEM value %d is invalid; must not be negative", maxMemObject)
+	}
+}
 
-// Downloader listens for DownloadTask on tasksCh, downloads them, and sends DownloadedFile to doneCh.
-func Downloader(ctx context.Context, tasksCh <-chan *DownloadTask, doneCh chan<- *WorkFile) {
-	log.Println("Starting downloader...")
-	swg := sizedwaitgroup.New(16) // Limit to 16 concurrent downloading parts
-	defer close(doneCh)           // Ensure doneCh is closed when the function exits
+// checkMemoryReleased warns if buffers handed out for in-memory objects were
+// never given back, once the run is over and all should have been.
+func checkMemoryReleased() {
+	if n := memoryOut.Load(); n != 0 {
+		Warnf("%s of in-memory object buffers were never released", humanizeBytes(n))
+	}
+}
+
+var (
+	maxMemObject = int64(EnvInt("MAX_IN_MEM", 96, "Maximum in memory object in kb"))
+
+	// downloadConcurrency limits the number of parts being fetched at once.
+	// Every part counts against the limit, so a file split into 8 parts
+	// occupies 8 slots while it downloads, or maxFileParts if fewer.
+	downloadConcurrency = EnvInt("DOWNLOAD_CONCURRENCY", 16, "Maximum concurrent download parts")
+	maxFileParts        = EnvInt("MAX_FILE_PARTS", 0, "Maximum concurrent download parts of a single file, 0 for up to DOWNLOAD_CONCURRENCY")
+
+	multipartThreshold = int64(EnvInt("MULTIPART_THRESHOLD", 8*1024*1024, "Size in bytes above which files are downloaded in parts"))
+	multipartPartSize  = int64(EnvInt("MULTIPART_PART_SIZE", 16*1024*1024, "Target size in bytes of each download part"))
+
+	// A file is given the timeout floor plus the time it takes to download
+	// at the minimum throughput before it is considered stalled.
+	minThroughput  = int64(EnvInt("MIN_THROUGHPUT_BYTES_PER_SEC", 64*1024, "Slowest download rate before a file is considered stalled, 0 to disable"))
+	minFileTimeout = Env("MIN_FILE_TIMEOUT", "2m", "Shortest time allowed to download a file")
+
+	spillToDisk = Env("SPILL_TO_DISK", "", "Download small files to disk instead of waiting for memory") != ""
+
+	dryRun = Env("DRY_RUN", "", "Only check that each object can be found, without downloading it") != ""
+)
+
+// maxPartCount is the most parts S3 allows for a single object.
+const maxPartCount = 10000
+
+// minDownloadPartSize is the smallest part a download is split into.  GETs
+// have no minimum, but smaller parts only add requests.
+const minDownloadPartSize = 5 * 1024 * 1024
+
+// computeParts returns how many parts are needed for each part to be roughly
+// targetPartSize bytes, clamped by clampParts.
+func computeParts(size, targetPartSize int64) int {
+	if size <= 0 || targetPartSize <= 0 {
+		return 1
+	}
+	return clampParts(size, (size+targetPartSize-1)/targetPartSize)
+}
+
+// clampParts limits parts to maxPartCount, and to as few as keep each part
+// of an object of size bytes at least minDownloadPartSize, but at least 1.
+// A 5 TB object comes to 10,000 parts of about 500 MB whatever the part
+// size asked for.
+func clampParts(size, parts int64) int {
+	return int(max(min(parts, maxPartCount, size/minDownloadPartSize), 1))
+}
 
-	for {
+// Downloader fetches objects from an ObjectStore.
+type Downloader struct {
+	Store ObjectStore
+
+	concurrency        int   // Parts downloaded at once
+	fileConcurrency    int   // Parts of one file downloaded at once, or 0 for concurrency
+	multipartThreshold int64 // Size above which files are downloaded in parts
+	partSize           int64 // Target size of each part
+	retries            int   // Attempts for a whole object
+	partRetries        int   // Attempts for each part
+	maxInMemory        int64 // Largest file held in memory
+	minThroughput      int64 // Slowest rate in bytes per second before a file times out
+	timeoutFloor       time.Duration
+	spillToDisk        bool // Use a temp file when the memory budget is used up
+	dryRun             bool // HEAD each object instead of downloading it
+	ordered            bool // Pass files on in the order their tasks arrived
+
+	stats downloadStats
+}
+
+// Option configures a Downloader.
+type Option func(*Downloader)
+
+// WithConcurrency sets how many parts may be downloaded at once.
+func WithConcurrency(n int) Option {
+	return func(d *Downloader) { d.concurrency = n }
+}
+
+// WithFileConcurrency sets how many parts of a single file may be downloaded
+// at once, leaving the other slots to other files.  0 lets a file take them
+// all.
+func WithFileConcurrency(n int) Option {
+	return func(d *Downloader) { d.fileConcurrency = n }
+}
+
+// WithMultipartThreshold sets the size in bytes above which files are
+// downloaded in parts to a temporary file.
+func WithMultipartThreshold(bytes int64) Option {
+	return func(d *Downloader) { d.multipartThreshold = bytes }
+}
+
+// WithPartSize sets the target size in bytes of each download part.
+func WithPartSize(bytes int64) Option {
+	return func(d *Downloader) { d.partSize = bytes }
+}
+
+// WithRetries sets the attempts made for each object and for each part.
+func WithRetries(n int) Option {
+	return func(d *Downloader) { d.retries, d.partRetries = n, n }
+}
+
+// WithMaxInMemory sets the largest file in bytes that is kept in memory.
+func WithMaxInMemory(bytes int64) Option {
+	return func(d *Downloader) { d.maxInMemory = bytes }
+}
+
+// WithTimeout sets the per-file timeout to floor plus the time the file takes
+// at minThroughput bytes per second.  A minThroughput of 0 disables it.
+func WithTimeout(floor time.Duration, minThroughput int64) Option {
+	return func(d *Downloader) { d.timeoutFloor, d.minThroughput = floor, minThroughput }
+}
+
+// WithSpillToDisk sets whether small files go to a temporary file, rather
+// than waiting, when MAX_INFLIGHT_MEM_BYTES is already in use.
+func WithSpillToDisk(spill bool) Option {
+	return func(d *Downloader) { d.spillToDisk = spill }
+}
+
+// WithDryRun sets whether objects are only checked with a HEAD request.
+// Nothing is sent on to the next stage in this mode.
+func WithDryRun(dry bool) Option {
+	return func(d *Downloader) { d.dryRun = dry }
+}
+
+// WithOrderedOutput sets whether downloaded files are passed on in the order
+// their tasks arrived, as REPRODUCIBLE needs, rather than as they finish.
+// Small files use a temporary file instead of waiting for memory in this
+// mode, as a file waiting for its turn can't give its memory up.
+func WithOrderedOutput(ordered bool) Option {
+	return func(d *Downloader) { d.ordered = ordered }
+}
+
+// NewDownloader returns a Downloader reading from store.  The settings start
+// from the environment and are overridden by opts.
+func NewDownloader(store ObjectStore, opts ...Option) (*Downloader, error) {
+	d := &Downloader{
+		Store:              store,
+		concurrency:        downloadConcurrency,
+		fileConcurrency:    maxFileParts,
+		multipartThreshold: multipartThreshold,
+		partSize:           multipartPartSize,
+		retries:            retryMax,
+		partRetries:        partRetryMax,
+		maxInMemory:        maxMemObject * 1024,
+		minThroughput:      minThroughput,
+		spillToDisk:        spillToDisk,
+		dryRun:             dryRun,
+		ordered:            reproducible,
+	}
+	var err error
+	if d.timeoutFloor, err = time.ParseDuration(minFileTimeout); err != nil {
+		return nil, fmt.Errorf("failed to parse MIN_FILE_TIMEOUT: %w", err)
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	switch {
+	case d.Store == nil:
+		return nil, fmt.Errorf("no object store given")
+	case d.concurrency < 1:
+		return nil, fmt.Errorf("concurrency %d is too small; must be at least 1", d.concurrency)
+	case d.fileConcurrency < 0:
+		return nil, fmt.Errorf("file concurrency %d is invalid; must not be negative", d.fileConcurrency)
+	case d.multipartThreshold <= 0:
+		return nil, fmt.Errorf("multipart threshold %d is invalid; must be greater than 0", d.multipartThreshold)
+	case d.partSize <= 0:
+		return nil, fmt.Errorf("part size %d is invalid; must be greater than 0", d.partSize)
+	case d.retries < 1 || d.partRetries < 1:
+		return nil, fmt.Errorf("retries must be at least 1")
+	case d.maxInMemory < 0:
+		return nil, fmt.Errorf("max in memory size %d is invalid; must not be negative", d.maxInMemory)
+	case d.maxInMemory > d.multipartThreshold:
+		return nil, fmt.Errorf("max in memory size %d is larger than the multipart threshold %d", d.maxInMemory, d.multipartThreshold)
+	case glacierRestoreTier != "" && glacierRestoreTier != string(types.TierStandard) &&
+		glacierRestoreTier != string(types.TierBulk) && glacierRestoreTier != string(types.TierExpedited):
+		return nil, fmt.Errorf("restore tier %q is unknown; must be Standard, Bulk or Expedited", glacierRestoreTier)
+	case d.minThroughput < 0:
+		return nil, fmt.Errorf("minimum throughput %d is invalid; must not be negative", d.minThroughput)
+	case d.timeoutFloor <= 0:
+		return nil, fmt.Errorf("file timeout %v is invalid; must be greater than 0", d.timeoutFloor)
+	case checksumAlgorithm != "" && newChecksum() == nil:
+		return nil, fmt.Errorf("checksum algorithm %q is unknown; must be CRC32, CRC32C, SHA1 or SHA256", checksumAlgorithm)
+	}
+	return d, nil
+}
+
+// fileSlots returns how many parts of a file split into parts are downloaded
+// at once, each taking a slot of the concurrency.  It is never more than the
+// slots there are, or the file could never start.
+func (d *Downloader) fileSlots(parts int) int {
+	slots := min(parts, d.concurrency)
+	if d.fileConcurrency > 0 {
+		slots = min(slots, d.fileConcurrency)
+	}
+	return slots
+}
+
+// fileTimeout returns a context that expires once a file of size bytes has
+// taken too long to download.
+func (d *Downloader) fileTimeout(ctx context.Context, size int64) (context.Context, context.CancelFunc) {
+	if d.minThroughput == 0 {
+		return context.WithCancel(ctx)
+	}
+	timeout := d.timeoutFloor + time.Duration(size/d.minThroughput)*time.Second
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError explains a download that ran out of time.
+func timeoutError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("download stalled and timed out: %w", err)
+	}
+	return err
+}
+
+// Run listens for DownloadTask on tasksCh, downloads them, and sends DownloadedFile to doneCh.
+func (d *Downloader) Run(ctx context.Context, tasksCh <-chan *DownloadTask, doneCh chan<- *WorkFile) {
+	Infof("Starting downloader...")
+	checkMemoryPools()
+	swg := sizedwaitgroup.New(d.concurrency) // Limit the concurrent downloading parts
+	defer close(doneCh)                      // Ensure doneCh is closed when the function exits
+	var order *turns
+	if d.ordered {
+		order = newTurns()
+	}
+
+	// Checked on every pass, as select picks at random when a task is
+	// waiting as well
+	for ctx.Err() == nil {
 		select {
 		case <-ctx.Done():
-			break
 		case task, ok := <-tasksCh:
-			if debug {
-				log.Printf("Download task: %#v %v\n", task, ok)
-			}
+			Debugf("Download task: %#v %v\n", task, ok)
 			if !ok {
 				swg.Wait()
 				Println("Closing downloader...")
@@ -57,78 +393,185 @@ func Downloader(ctx context.Context, tasksCh <-chan *DownloadTask, doneCh chan<-
 			}
 
 			parts := 1
-			if task.Size > 8*1024*1024 {
-				// If file is larger than 8MB, download in parts
-				parts = 8
+			if task.Size > d.multipartThreshold && !d.dryRun {
+				// If file is larger than the threshold, download in parts
+				parts = computeParts(task.Size, d.partSize)
 			}
-			for i := 0; i < parts; i++ {
+			// Reserve a slot for each part downloaded at once, which
+			// downloadObjectInParts keeps to
+			slots := d.fileSlots(parts)
+			for i := 0; i < slots; i++ {
 				swg.Add() // Add to the sized wait group for each part
 			}
 
+			var tu *turn
+			if order != nil {
+				tu = order.take()
+			}
+
 			go func(task *DownloadTask, parts int) {
+				start := time.Now()
+				d.stats.inFlight.Add(1)
+				d.stats.inFlightParts.Add(int64(slots))
 				defer func() {
-					for i := 0; i < parts; i++ {
+					tu.done()
+					d.stats.inFlight.Add(-1)
+					d.stats.inFlightParts.Add(-int64(slots))
+					for i := 0; i < slots; i++ {
 						swg.Done() // Mark the part as done
 					}
 				}()
 
+				if d.dryRun {
+					d.checkObject(ctx, task)
+					return
+				}
+
+				inMemory := task.Size > 0 && task.Size <= d.maxInMemory
+				if inMemory {
+					if d.spillToDisk || d.ordered {
+						if inMemory = memBudget.tryAcquire(task.Size); !inMemory {
+							d.stats.spilledFiles.Add(1)
+						}
+					} else if err := memBudget.acquire(ctx, task.Size); err != nil {
+						return // Cancelled while waiting for memory to free up
+					}
+				}
+
 				if task.Size == 0 {
-					// Empty files just head a header
-					doneCh <- &WorkFile{Size: task.Size, Filename: task.Filename}
-				} else if task.Size <= maxMemObject*1024 { // If file is less than 32KB, download it in memory.
+					// Empty files just head a header, and have nothing to GET
+					// the metadata with
+					wf := &WorkFile{Size: task.Size, Filename: task.Filename, LastModified: task.LastModified, ETag: task.ETag,
+						Listed: task.source()}
+					if preserveMetadata {
+						info, err := d.Store.HeadObject(ctx, task.Filename, task.VersionID)
+						if err != nil {
+							d.fail(task, fmt.Errorf("Error checking object %s: %w", task.Filename, err))
+							return
+						}
+						wf.setMeta(info.Meta)
+					}
+					tu.wait()
+					if !sendWorkFile(ctx, doneCh, wf) {
+						return
+					}
+				} else if inMemory { // If file is less than 32KB, download it in memory.
 					// Use a buffer pool to reuse memory for small files
 					// bufPool32 is for files <= 32KB, bufPoolLarge is for large files
 					// This avoids frequent memory allocations and deallocations.
-					var mem []byte
-					if task.Size <= 32*1024 {
-						mem = bufPool32.Get().([]byte)
-					} else {
-						mem = bufPoolLarge.Get().([]byte)
-					}
+					mem := getMemory(task.Size)
 
 					// If the file size is small enough, we can download it directly in memory
-					n, err := downloadObjectToBuffer(ctx, srcBucket, task.Filename, mem)
+					var (
+						n    int
+						meta ObjectMeta
+					)
+					sp := startSpan("download", task.Filename).set("object.size", task.Size)
+					err := d.withRestore(ctx, task, func() (err error) {
+						// The restore wait isn't counted against the timeout
+						fileCtx, cancel := d.fileTimeout(ctx, task.Size)
+						defer cancel()
+						n, err = d.downloadObjectToBuffer(fileCtx, task.Filename, task.VersionID, mem, &meta)
+						return timeoutError(fileCtx, err)
+					})
+					sp.set("bytes", int64(n)).finish(err)
 					if err != nil {
 						// Log the error and continue to the next file
-						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("Error downloading object %s to memory: %v", task.Filename, err),
-						}
+						d.fail(task, fmt.Errorf("Error downloading object %s to memory: %w", task.Filename, err))
+						memBudget.release(task.Size)
 						putMemory(mem)
 						return
 					}
 					// Check if the number of bytes written matches the expected size
 					if int64(n) != task.Size {
-						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("Short write for object %s: expected %d, got %d", task.Filename, task.Size, n),
-						}
+						d.fail(task, fmt.Errorf("Short write for object %s: expected %d, got %d", task.Filename, task.Size, n))
+						memBudget.release(task.Size)
 						putMemory(mem)
 						return
 					}
 					// Successfully downloaded the file to memory
 					// Send the downloaded file to doneCh
-					doneCh <- &WorkFile{Size: task.Size, Filename: task.Filename,
+					wf := &WorkFile{Size: task.Size, Filename: task.Filename, ETag: task.ETag, Listed: task.source(),
 						Bytes: mem[:n]} // Use the buffer directly as Filebytes
+					wf.setMeta(meta)
+					tu.wait()
+					if !sendWorkFile(ctx, doneCh, wf) {
+						wf.Release()
+						return
+					}
+					d.stats.memoryBytes.Add(task.Size)
 				} else {
-					tempFilePath, err := downloadObjectInParts(ctx, srcBucket, task.Filename, task.Size, parts)
+					var (
+						tempFilePath string
+						meta         ObjectMeta
+					)
+					sp := startSpan("download", task.Filename).set("object.size", task.Size).set("parts", int64(parts))
+					err := d.withRestore(ctx, task, func() (err error) {
+						fileCtx, cancel := d.fileTimeout(ctx, task.Size)
+						defer cancel()
+						tempFilePath, err = d.downloadObjectInParts(fileCtx, task.Filename, task.VersionID, task.Size, parts, &meta)
+						return timeoutError(fileCtx, err)
+					})
+					sp.finish(err)
 					if err != nil {
 						// Log the error and continue to the next file
-						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("Error downloading object %s to temporary file: %v", task.Filename, err),
-						}
+						d.fail(task, fmt.Errorf("Error downloading object %s to temporary file: %w", task.Filename, err))
 						return
 					}
 					// Successfully downloaded the file to a temporary file
 					// Send the downloaded file to doneCh
-					doneCh <- &WorkFile{Size: task.Size, Filename: task.Filename, TempFile: tempFilePath}
+					wf := &WorkFile{Size: task.Size, Filename: task.Filename, TempFile: tempFilePath, ETag: task.ETag,
+						Listed: task.source()}
+					wf.setMeta(meta)
+					tu.wait()
+					if !sendWorkFile(ctx, doneCh, wf) {
+						wf.Release()
+						return
+					}
+					d.stats.diskBytes.Add(task.Size)
 				}
 				atomic.AddInt64(&DownloadedFiles, 1)
+				d.stats.downloadedFiles.Add(1)
+				t := FileTiming{Key: task.Filename, Size: task.Size, Path: pathDisk, Parts: parts, Duration: time.Since(start)}
+				if inMemory || task.Size == 0 {
+					t.Path, t.Parts = pathMemory, 1
+				}
+				d.stats.timings.add(t)
+				Debugf("Downloaded %s (%s) in %s at %s/s, %s", task.Filename, humanizeBytes(task.Size),
+					t.Duration.Round(time.Millisecond), humanizeBytes(int64(t.Throughput())), t.Path)
 			}(task, parts)
 		}
 	}
+	// Stop pulling new tasks, but let the in-flight parts finish (or give up
+	// on their sends) before doneCh is closed.
+	swg.Wait()
+	Println("Downloader cancelled...")
+}
+
+// checkObject looks the task up with a HEAD request and counts it, for a dry
+// run.  The size is taken from the store, and a difference from the listing
+// is logged.
+func (d *Downloader) checkObject(ctx context.Context, task *DownloadTask) {
+	info, err := d.Store.HeadObject(ctx, task.Filename, task.VersionID)
+	if err != nil {
+		d.fail(task, fmt.Errorf("Error checking object %s: %w", task.Filename, err))
+		return
+	}
+	if info.Size != task.Size {
+		Println("Size of", task.Filename, "changed from", task.Size, "to", info.Size)
+		task.Size = info.Size
+	}
+	d.stats.checkedFiles.Add(1)
+	d.stats.checkedBytes.Add(task.Size)
+}
+
+// sendWorkFile delivers wf to doneCh unless the context is cancelled first,
+// in which case it reports false so the caller can clean up after itself.
+func sendWorkFile(ctx context.Context, doneCh chan<- *WorkFile, wf *WorkFile) bool {
+	select {
+	case doneCh <- wf:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
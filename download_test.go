@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"testing"
+)
+
+// httpStatus is an error from a response with the status code.
+type httpStatus int
+
+func (e httpStatus) Error() string       { return fmt.Sprintf("status %d", int(e)) }
+func (e httpStatus) HTTPStatusCode() int { return int(e) }
+
+// memStore is an ObjectStore serving objects from memory.
+type memStore struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	failures map[string]int // Transient failures before a GET of the key works
+	errs     map[string]error
+	gets     int
+}
+
+func newMemStore(objects map[string][]byte) *memStore {
+	return &memStore{objects: objects, failures: make(map[string]int), errs: make(map[string]error)}
+}
+
+func (s *memStore) lookup(key string) ([]byte, error) {
+	if err := s.errs[key]; err != nil {
+		return nil, err
+	}
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", key, fs.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (s *memStore) GetObjectRange(ctx context.Context, key, versionID string, start, end int64) (*ObjectBody, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	data, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.failures[key] > 0 {
+		s.failures[key]--
+		return nil, httpStatus(500)
+	}
+	if end < 0 || end >= int64(len(data)) {
+		end = int64(len(data)) - 1
+	}
+	return &ObjectBody{ReadCloser: io.NopCloser(bytes.NewReader(data[start : end+1]))}, nil
+}
+
+func (s *memStore) HeadObject(ctx context.Context, key, versionID string) (*ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: int64(len(data))}, nil
+}
+
+// runDownloader downloads the objects of store through a Downloader set up
+// with opts, and returns the contents of each file it passed on.
+func runDownloader(t *testing.T, store *memStore, opts ...Option) (*Downloader, map[string][]byte) {
+	t.Helper()
+	defer func(dir string, base int) { tempDir, retryBaseMs = dir, base }(tempDir, retryBaseMs)
+	tempDir, retryBaseMs = t.TempDir(), 1
+	d, err := NewDownloader(store, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasksCh := make(chan *DownloadTask, len(store.objects)+len(store.errs))
+	for key, data := range store.objects {
+		tasksCh <- &DownloadTask{Filename: key, Size: int64(len(data))}
+	}
+	for key := range store.errs {
+		tasksCh <- &DownloadTask{Filename: key, Size: 10}
+	}
+	close(tasksCh)
+	doneCh := make(chan *WorkFile)
+	go d.Run(context.Background(), tasksCh, doneCh)
+
+	got := make(map[string][]byte)
+	for wf := range doneCh {
+		r, err := wf.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[wf.Filename] = data
+		if err := wf.Release(); err != nil {
+			t.Error(err)
+		}
+	}
+	return d, got
+}
+
+func TestDownloader(t *testing.T) {
+	objects := map[string][]byte{
+		"empty": {},
+		"small": []byte("hello"),
+		"large": bytes.Repeat([]byte("0123456789"), 1<<20),
+	}
+	store := newMemStore(objects)
+	d, got := runDownloader(t, store, WithMultipartThreshold(1<<20), WithPartSize(1<<20), WithMaxInMemory(1<<10))
+	for key, want := range objects {
+		if !bytes.Equal(got[key], want) {
+			t.Errorf("%s: got %d bytes, want %d", key, len(got[key]), len(want))
+		}
+	}
+	// 10 MiB comes to 2 parts of at least minDownloadPartSize
+	if store.gets != 3 {
+		t.Errorf("made %d GETs, want 3", store.gets)
+	}
+	if st := d.Stats(); st.DownloadedFiles != 3 || st.FailedFiles != 0 {
+		t.Errorf("downloaded %d files and failed %d, want 3 and 0", st.DownloadedFiles, st.FailedFiles)
+	}
+}
+
+func TestDownloaderRetries(t *testing.T) {
+	objects := map[string][]byte{
+		"small": []byte("hello"),
+		"large": bytes.Repeat([]byte("x"), 6<<20),
+	}
+	store := newMemStore(objects)
+	store.failures["small"], store.failures["large"] = 2, 2
+	d, got := runDownloader(t, store, WithRetries(3), WithMultipartThreshold(1<<20), WithPartSize(1<<20))
+	for key, want := range objects {
+		if !bytes.Equal(got[key], want) {
+			t.Errorf("%s: got %d bytes, want %d", key, len(got[key]), len(want))
+		}
+	}
+	if store.gets != 6 {
+		t.Errorf("made %d GETs, want 6", store.gets)
+	}
+	if st := d.Stats(); st.FailedFiles != 0 {
+		t.Errorf("failed %d files, want 0", st.FailedFiles)
+	}
+
+	// Out of attempts
+	store = newMemStore(map[string][]byte{"small": []byte("hello")})
+	store.failures["small"] = 3
+	d, got = runDownloader(t, store, WithRetries(3))
+	if len(got) != 0 {
+		t.Errorf("got %d files, want none", len(got))
+	}
+	if st := d.Stats(); st.FailedFiles != 1 {
+		t.Errorf("failed %d files, want 1", st.FailedFiles)
+	}
+	<-fileErrCh
+}
+
+func TestDownloaderErrors(t *testing.T) {
+	store := newMemStore(nil)
+	store.errs["gone"] = fmt.Errorf("object gone: %w", fs.ErrNotExist)
+	store.errs["forbidden"] = httpStatus(403)
+	d, got := runDownloader(t, store)
+	if len(got) != 0 {
+		t.Errorf("got %d files, want none", len(got))
+	}
+	st := d.Stats()
+	if st.SkippedFiles != 1 || st.FailedFiles != 1 {
+		t.Errorf("skipped %d files and failed %d, want 1 each", st.SkippedFiles, st.FailedFiles)
+	}
+	if event := <-fileErrCh; event.Filename != "forbidden" {
+		t.Errorf("got an error for %s, want forbidden", event.Filename)
+	}
+	if store.gets != 2 {
+		t.Errorf("made %d GETs, want 2 as neither is retried", store.gets)
+	}
+}
+
+func TestDownloaderCancelled(t *testing.T) {
+	store := newMemStore(map[string][]byte{"small": []byte("hello")})
+	d, err := NewDownloader(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasksCh := make(chan *DownloadTask, 2)
+	tasksCh <- &DownloadTask{Filename: "small", Size: 5}
+	tasksCh <- &DownloadTask{Filename: "small", Size: 5}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	doneCh := make(chan *WorkFile)
+	go d.Run(ctx, tasksCh, doneCh)
+	for wf := range doneCh {
+		t.Errorf("got %s after the context was cancelled", wf.Filename)
+	}
+	if len(tasksCh) != 2 || store.gets != 0 {
+		t.Errorf("took %d tasks and made %d GETs after the context was cancelled", 2-len(tasksCh), store.gets)
+	}
+}
+
+func TestComputeParts(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		size, partSize int64
+		want           int
+	}{
+		{0, 16 * mb, 1},
+		{1, 16 * mb, 1},
+		{10 * mb, 16 * mb, 1},
+		{16 * mb, 16 * mb, 1},
+		{16*mb + 1, 16 * mb, 2},
+		{32 * mb, 16 * mb, 2},
+		{5 * 1024 * mb, 16 * mb, 320},
+		{100 * 1024 * mb, 1 * mb, maxPartCount},
+		// Parts are kept to at least minDownloadPartSize
+		{12 * mb, 1 * mb, 2},
+		{4 * mb, 1 * mb, 1},
+	}
+	for _, tt := range tests {
+		if got := computeParts(tt.size, tt.partSize); got != tt.want {
+			t.Errorf("computeParts(%d, %d) = %d, want %d", tt.size, tt.partSize, got, tt.want)
+		}
+	}
+}
+
+func TestComputePartsHugeObject(t *testing.T) {
+	const size = 5 << 40 // 5 TB, the largest object S3 holds
+	tests := []struct {
+		partSize int64
+		want     int
+	}{
+		{1, maxPartCount},
+		{5 << 20, maxPartCount},
+		{16 << 20, maxPartCount}, // Parts of about 550 MB instead
+		{1 << 30, 5120},
+	}
+	for _, tt := range tests {
+		parts := computeParts(size, tt.partSize)
+		if parts != tt.want {
+			t.Errorf("part size %d: got %d parts, want %d", tt.partSize, parts, tt.want)
+		}
+		// downloadObjectInParts gives the last part what is left over
+		each := int64(size / parts)
+		last := size - each*int64(parts-1)
+		if each < minDownloadPartSize || last < each || last-each >= int64(parts) {
+			t.Errorf("part size %d: %d parts of %d and the last of %d", tt.partSize, parts, each, last)
+		}
+	}
+}
+
+// partsStore is a memStore that also gives the checksums of the parts each
+// object was uploaded in, of partSize bytes.
+type partsStore struct {
+	*memStore
+	partSize int64
+	corrupt  int // Index of a part whose checksum is wrong, or -1
+}
+
+func (s *partsStore) ObjectChecksum(ctx context.Context, key, versionID string, size int64) (string, []partRange, error) {
+	data, err := s.lookup(key)
+	if err != nil {
+		return "", nil, err
+	}
+	var parts []partRange
+	for start := int64(0); start < size; start += s.partSize {
+		end := min(start+s.partSize, size) - 1
+		h := newChecksum()
+		h.Write(data[start : end+1])
+		if len(parts) == s.corrupt {
+			h.Write([]byte("x"))
+		}
+		parts = append(parts, partRange{start: start, end: end, checksum: encodeSum(h)})
+	}
+	return "", parts, nil
+}
+
+func TestMergeParts(t *testing.T) {
+	var parts []partRange
+	for i := range int64(25) {
+		parts = append(parts, partRange{start: i * 10, end: i*10 + 9, checksum: fmt.Sprint(i)})
+	}
+	if got := mergeParts(parts, 30); len(got) != 25 {
+		t.Errorf("got %d ranges for fewer parts than asked, want 25", len(got))
+	}
+	got := mergeParts(parts, 10)
+	if len(got) != 9 { // 3 parts in each
+		t.Fatalf("got %d ranges, want 9", len(got))
+	}
+	var next int64
+	for _, r := range got {
+		if r.start != next || r.parts[0].start != r.start || r.parts[len(r.parts)-1].end != r.end || r.checksum != "" {
+			t.Errorf("range %d-%d holds parts %v", r.start, r.end, r.parts)
+		}
+		next = r.end + 1
+	}
+	if next != 250 {
+		t.Errorf("ranges end at %d, want 250", next)
+	}
+}
+
+func TestDownloaderMergesStoredParts(t *testing.T) {
+	defer func(alg, dir string) { checksumAlgorithm, tempDir = alg, dir }(checksumAlgorithm, tempDir)
+	checksumAlgorithm, tempDir = "CRC32", t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 12<<16) // 12 MiB
+
+	// Stored in 1 MiB parts, fetched in 2 ranges of at least minDownloadPartSize
+	store := &partsStore{memStore: newMemStore(map[string][]byte{"large": data}), partSize: 1 << 20, corrupt: -1}
+	d, err := NewDownloader(store, WithMultipartThreshold(1<<20), WithPartSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta ObjectMeta
+	path, err := d.downloadObjectInParts(context.Background(), "large", "", int64(len(data)), 12, &meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseTempFile(path)
+	if store.gets != 2 {
+		t.Errorf("made %d GETs for 12 stored parts, want 2", store.gets)
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes, want %d: %v", len(got), len(data), err)
+	}
+	h := newChecksum()
+	h.Write(data)
+	if meta.Checksum != encodeSum(h) {
+		t.Errorf("got checksum %s, want %s", meta.Checksum, encodeSum(h))
+	}
+
+	// A stored part that doesn't match is still caught
+	store.corrupt = 7
+	if _, err := d.downloadObjectInParts(context.Background(), "large", "", int64(len(data)), 12, nil); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("got %v for a corrupt part, want a checksum mismatch", err)
+	}
+}
+
+func TestNewDownloaderDefaults(t *testing.T) {
+	d, err := NewDownloader(newMemStore(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.partSize != 16<<20 || d.multipartThreshold != 8<<20 {
+		t.Errorf("part size %d and threshold %d, want 16 MiB and 8 MiB", d.partSize, d.multipartThreshold)
+	}
+}
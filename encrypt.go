@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+var (
+	encryptionKeyFile  = Env("ENCRYPTION_KEY_FILE", "", "File holding the base64 AES-256 key to encrypt the archives with on this host")
+	encryptionKMSKeyID = Env("ENCRYPTION_KMS_KEY_ID", "", "KMS key to get a data key from for each archive, to encrypt it with on this host")
+	kmsEndpoint        = Env("KMS_ENDPOINT", "", "Custom KMS endpoint URL for ENCRYPTION_KMS_KEY_ID, default the regional AWS one")
+
+	// encryptionKey is the raw AES-256 key from ENCRYPTION_KEY or
+	// ENCRYPTION_KEY_FILE, which is never printed.
+	encryptionKey []byte
+)
+
+// Encrypted archives start with a header of the magic, the version, the
+// chunk size, the salt, the nonce prefix, and the KMS encrypted data key, if
+// any, after its length.  The chunks follow, each sealed on its own with
+// AES-256-GCM under a key derived from the salt, so the nonces of one archive
+// never meet those of another, and each chunk streams through in constant
+// memory and can be read without the rest.
+const (
+	encMagic      = "S3ARCAES"
+	encVersion    = 2
+	encChunkSize  = 64 * 1024
+	encSaltSize   = 32
+	encPrefixSize = 7 // The nonce is the prefix, the chunk number and a flag for the last chunk
+	encFixedSize  = len(encMagic) + 1 + 4 + encSaltSize + encPrefixSize + 2
+	encTagSize    = 16
+	encMaxHeader  = encFixedSize + 1<<16 - 1
+)
+
+// loadEncryptionKey reads the archive key from ENCRYPTION_KEY or
+// ENCRYPTION_KEY_FILE, like loadSSECustomerKey.
+func loadEncryptionKey() {
+	usage := "Base64 AES-256 key to encrypt the archives with on this host"
+	encoded := os.Getenv("ENCRYPTION_KEY")
+	if encoded != "" {
+		fmt.Printf("  %-30s # %s\n", `ENCRYPTION_KEY="<redacted>"`, usage)
+	} else {
+		fmt.Printf("  %-30s # %s\n", `ENCRYPTION_KEY="" (default)`, usage)
+	}
+
+	if encryptionKeyFile != "" {
+		if encoded != "" {
+			log.Fatalf("ENCRYPTION_KEY and ENCRYPTION_KEY_FILE are both set; use only one")
+		}
+		data, err := os.ReadFile(encryptionKeyFile)
+		if err != nil {
+			log.Fatalf("failed to read ENCRYPTION_KEY_FILE: %v", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	if encoded != "" && encryptionKMSKeyID != "" {
+		log.Fatalf("ENCRYPTION_KEY and ENCRYPTION_KMS_KEY_ID are both set; use only one")
+	}
+	if encoded == "" {
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Fatalf("encryption key is not valid base64")
+	} else if len(key) != 32 {
+		log.Fatalf("encryption key is %d bytes; must be 32 bytes for AES-256", len(key))
+	}
+	encryptionKey = key
+}
+
+// archiveEncryption reports whether archives are encrypted on this host,
+// and decrypted when restoring.
+func archiveEncryption() bool {
+	return encryptionKey != nil || encryptionKMSKeyID != ""
+}
+
+// encryptWriter seals what is written to it in chunks to w.  A full chunk
+// is held back until more comes, so Close can mark the last one, which
+// keeps a truncated archive from passing as a shorter one.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte // Authenticated with every chunk
+	prefix []byte
+	buf    []byte
+	seq    uint32
+	sealed []byte
+}
+
+// newEncryptWriter writes the header of an encrypted archive to w and
+// returns the writer to write the archive through.  With KMS each archive
+// gets a data key of its own.
+func newEncryptWriter(ctx context.Context, w io.Writer) (*encryptWriter, error) {
+	key, blob := encryptionKey, []byte(nil)
+	if encryptionKMSKeyID != "" {
+		var err error
+		if key, blob, err = kmsGenerateDataKey(ctx); err != nil {
+			return nil, err
+		}
+	}
+	salt := make([]byte, encSaltSize+encPrefixSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	salt, prefix := salt[:encSaltSize], salt[encSaltSize:]
+	aead, err := newArchiveAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encMagic), encVersion)
+	header = binary.BigEndian.AppendUint32(header, encChunkSize)
+	header = append(header, salt...)
+	header = append(header, prefix...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(blob)))
+	header = append(header, blob...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header, prefix: prefix, buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+// newArchiveAEAD returns the cipher of an archive, under the key derived from
+// key and its salt.
+func newArchiveAEAD(key, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, key, salt, encMagic+" archive key", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk seq.
+func chunkNonce(prefix []byte, seq uint32, last bool) []byte {
+	nonce := binary.BigEndian.AppendUint32(append([]byte(nil), prefix...), seq)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		c := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.prefix, e.seq, last), e.buf, e.header)
+	e.seq++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+// Close seals the last chunk, which may be empty.  It does not close the
+// underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// encryptedHeader is the header of an encrypted archive, as read back.
+type encryptedHeader struct {
+	raw    []byte
+	prefix []byte
+	aead   cipher.AEAD
+}
+
+// readEncryptedHeader reads the header at the start of r and gets the key
+// to decrypt the archive with, from KMS if it was encrypted with a data key.
+func readEncryptedHeader(ctx context.Context, r io.Reader) (*encryptedHeader, error) {
+	fixed := make([]byte, len(encMagic)+1, encFixedSize)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	if !bytes.HasPrefix(fixed, []byte(encMagic)) {
+		return nil, errors.New("archive is not encrypted, or not by this tool")
+	}
+	if v := fixed[len(encMagic)]; v != encVersion {
+		return nil, fmt.Errorf("encryption version %d is unknown", v)
+	}
+	fixed = fixed[:encFixedSize]
+	if _, err := io.ReadFull(r, fixed[len(encMagic)+1:]); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	if size := binary.BigEndian.Uint32(fixed[len(encMagic)+1:]); size != encChunkSize {
+		return nil, fmt.Errorf("encryption chunk size %d is unknown", size)
+	}
+	blob := make([]byte, binary.BigEndian.Uint16(fixed[len(fixed)-2:]))
+	if _, err := io.ReadFull(r, blob); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	key := encryptionKey
+	if len(blob) > 0 {
+		var err error
+		if key, err = kmsDecryptDataKey(ctx, blob); err != nil {
+			return nil, err
+		}
+	} else if key == nil {
+		return nil, errors.New("archive is encrypted with ENCRYPTION_KEY, which isn't set")
+	}
+	aead, err := newArchiveAEAD(key, fixed[len(encMagic)+5:len(encMagic)+5+encSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	prefix := fixed[len(encMagic)+5+encSaltSize : len(fixed)-2]
+	return &encryptedHeader{raw: append(fixed, blob...), prefix: prefix, aead: aead}, nil
+}
+
+// openEncryptedArchive opens the encrypted archive name, through open
+// reading it as stored, and returns it decrypted from start up to end, or to
+// the end if end is 0.  Only the chunks holding the range are read.
+func openEncryptedArchive(ctx context.Context, open func(start, end int64) (io.ReadCloser, error), start, end int64) (io.ReadCloser, error) {
+	first := start / encChunkSize
+	whole := first == 0 && end == 0
+	headerEnd := int64(encMaxHeader)
+	if whole {
+		headerEnd = 0 // Read on past the header
+	}
+	rc, err := open(0, headerEnd)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := readEncryptedHeader(ctx, rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if !whole {
+		// Start over at the first chunk wanted, as only the header was needed
+		rc.Close()
+		cstart := int64(len(hdr.raw)) + first*(encChunkSize+encTagSize)
+		cend := int64(0)
+		if end > 0 {
+			cend = int64(len(hdr.raw)) + (end+encChunkSize-1)/encChunkSize*(encChunkSize+encTagSize)
+		}
+		if rc, err = open(cstart, cend); err != nil {
+			return nil, err
+		}
+	}
+	d := &decryptReader{r: rc, hdr: hdr, seq: uint32(first), skip: int(start - first*encChunkSize), ranged: end > 0,
+		buf: make([]byte, encChunkSize+encTagSize)}
+	if end > 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(d, end-start), d}, nil
+	}
+	return d, nil
+}
+
+// decryptReader opens the chunks of an encrypted archive as they are read.
+type decryptReader struct {
+	r      io.ReadCloser
+	hdr    *encryptedHeader
+	seq    uint32
+	skip   int  // Of the first chunk, before the range wanted
+	ranged bool // A range ending before the last chunk, so it isn't expected
+	buf    []byte
+	plain  []byte // Left of the chunk opened last
+	done   bool   // The last chunk is read
+	err    error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.read(p)
+	if err != nil && err != io.EOF {
+		d.err = err // Reading on would take the next chunk as this one
+	}
+	return n, err
+}
+
+func (d *decryptReader) read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.buf)
+		if err == io.EOF && d.ranged {
+			return 0, io.EOF
+		} else if err == io.EOF {
+			return 0, fmt.Errorf("encrypted archive ends before its last chunk: %w", io.ErrUnexpectedEOF)
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		sealed := d.buf[:n]
+		// A short chunk can only be the last, and a full one may be
+		plain, oerr := d.hdr.aead.Open(d.plain[:0], chunkNonce(d.hdr.prefix, d.seq, true), sealed, d.hdr.raw)
+		if oerr == nil {
+			d.done = true
+		} else if n == len(d.buf) {
+			plain, oerr = d.hdr.aead.Open(d.plain[:0], chunkNonce(d.hdr.prefix, d.seq, false), sealed, d.hdr.raw)
+		}
+		if oerr != nil {
+			return 0, fmt.Errorf("encrypted chunk %d fails authentication, so the archive is damaged or the key is wrong", d.seq)
+		}
+		d.seq++
+		d.plain = plain[min(d.skip, len(plain)):]
+		d.skip = 0
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.r.Close()
+}
+
+// encryptedSize returns the size of the archive an encrypted one of size
+// bytes decrypts to, reading its header through open.
+func encryptedSize(ctx context.Context, open func(start, end int64) (io.ReadCloser, error), size int64) (int64, error) {
+	rc, err := open(0, min(size, int64(encMaxHeader)))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	hdr, err := readEncryptedHeader(ctx, rc)
+	if err != nil {
+		return 0, err
+	}
+	body := size - int64(len(hdr.raw))
+	chunks := (body + encChunkSize + encTagSize - 1) / (encChunkSize + encTagSize)
+	return body - chunks*encTagSize, nil
+}
+
+// kmsKeys caches the data keys KMS decrypted, by their encrypted form, as
+// every archive read again for a single entry asks for its key again.
+var kmsKeys sync.Map
+
+// kmsGenerateDataKey gets a new AES-256 data key from KMS under
+// ENCRYPTION_KMS_KEY_ID, and the key encrypted to store with the archive.
+func kmsGenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	var out struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+	}
+	in := map[string]string{"KeyId": encryptionKMSKeyID, "KeySpec": "AES_256"}
+	if err := kmsCall(ctx, "GenerateDataKey", in, &out); err != nil {
+		return nil, nil, err
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+// kmsDecryptDataKey decrypts the data key of an archive with KMS.
+func kmsDecryptDataKey(ctx context.Context, blob []byte) ([]byte, error) {
+	if key, ok := kmsKeys.Load(string(blob)); ok {
+		return key.([]byte), nil
+	}
+	var out struct {
+		Plaintext []byte
+	}
+	in := map[string]any{"CiphertextBlob": blob}
+	if encryptionKMSKeyID != "" {
+		in["KeyId"] = encryptionKMSKeyID // Refuses keys from another KMS key
+	}
+	if err := kmsCall(ctx, "Decrypt", in, &out); err != nil {
+		return nil, err
+	}
+	kmsKeys.Store(string(blob), out.Plaintext)
+	return out.Plaintext, nil
+}
+
+// kmsCall calls a KMS action with the credentials and region of the
+// DST_BUCKET client, signing the JSON request itself as the STS requests
+// are signed.
+func kmsCall(ctx context.Context, action string, in, out any) error {
+	client := dstClient()
+	if client == nil {
+		return errors.New("KMS needs AWS credentials, which SRC_DIR and DST_DIR leave out")
+	}
+	opts := client.Options()
+	creds, err := opts.Credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	region := opts.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := kmsEndpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+		if strings.HasPrefix(region, "cn-") {
+			endpoint += ".cn"
+		}
+	}
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	sum := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "kms", region, time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := s3Settings{}.httpClient().WithTimeout(time.Minute).Do(req)
+	if err != nil {
+		return fmt.Errorf("KMS %s failed: %w", action, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("KMS %s failed: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Type != "" {
+			return fmt.Errorf("KMS %s failed: %s: %s", action, e.Type[strings.LastIndex(e.Type, "#")+1:], e.Message)
+		}
+		return fmt.Errorf("KMS %s failed: %s", action, resp.Status)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("KMS %s answered badly: %w", action, err)
+	}
+	return nil
+}
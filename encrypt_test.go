@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+// encryptArchive encrypts data as an archive with the ENCRYPTION_KEY.
+func encryptArchive(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	e, err := newEncryptWriter(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decryptArchive reads start up to end of an encrypted archive.
+func decryptArchive(archive []byte, start, end int64) ([]byte, error) {
+	open := func(start, end int64) (io.ReadCloser, error) {
+		if end == 0 || end > int64(len(archive)) {
+			end = int64(len(archive))
+		}
+		return io.NopCloser(bytes.NewReader(archive[start:end])), nil
+	}
+	rc, err := openEncryptedArchive(context.Background(), open, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func setEncryptionKey(t *testing.T) {
+	key := encryptionKey
+	t.Cleanup(func() { encryptionKey = key })
+	encryptionKey = make([]byte, 32)
+	rand.Read(encryptionKey)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	setEncryptionKey(t)
+	data := make([]byte, 3*encChunkSize+100)
+	rand.Read(data)
+	for _, size := range []int{0, 1, encChunkSize, encChunkSize + 1, len(data)} {
+		archive := encryptArchive(t, data[:size])
+		got, err := decryptArchive(archive, 0, 0)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data[:size]) {
+			t.Errorf("%d bytes: read back %d", size, len(got))
+		}
+		if n, err := encryptedSize(context.Background(), func(start, end int64) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(archive[start:end])), nil
+		}, int64(len(archive))); err != nil || n != int64(size) {
+			t.Errorf("%d bytes: encryptedSize gives %d, %v", size, n, err)
+		}
+	}
+
+	// A range crossing chunks
+	archive := encryptArchive(t, data)
+	start, end := int64(encChunkSize-10), int64(2*encChunkSize+10)
+	got, err := decryptArchive(archive, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[start:end]) {
+		t.Errorf("range read back %d bytes, want %d", len(got), end-start)
+	}
+}
+
+func TestEncryptSaltPerArchive(t *testing.T) {
+	setEncryptionKey(t)
+	data := bytes.Repeat([]byte("same contents "), 1000)
+	a, b := encryptArchive(t, data), encryptArchive(t, data)
+	saltAt := len(encMagic) + 1 + 4
+	if bytes.Equal(a[saltAt:saltAt+encSaltSize], b[saltAt:saltAt+encSaltSize]) {
+		t.Fatal("two archives have the same salt")
+	}
+	// Sealed under different keys, the first chunks have nothing in common
+	if bytes.Equal(a[encFixedSize:encFixedSize+16], b[encFixedSize:encFixedSize+16]) {
+		t.Error("two archives start with the same ciphertext")
+	}
+
+	// Changing the salt changes the key, so nothing decrypts
+	a[saltAt] ^= 1
+	if _, err := decryptArchive(a, 0, 0); err == nil {
+		t.Error("archive with a changed salt decrypted")
+	}
+}
+
+func TestDecryptOtherVersion(t *testing.T) {
+	setEncryptionKey(t)
+	archive := encryptArchive(t, []byte("data"))
+	for _, v := range []byte{1, encVersion + 1} {
+		a := bytes.Clone(archive)
+		a[len(encMagic)] = v
+		if _, err := decryptArchive(a, 0, 0); err == nil || !strings.Contains(err.Error(), "version") {
+			t.Errorf("version %d archive: got %v, want an unknown version error", v, err)
+		}
+	}
+}
@@ -1,12 +1,304 @@
 package main
 
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
 var (
 	fileErrCh = make(chan *ErrorEvent, 100) // Channel to send error events
 )
 
+// Categories of ErrorEvent, which say what kind of follow up a failure needs.
+const (
+	ErrCategoryArchived  = "archived"   // The object needs a restore from an archive storage class
+	ErrCategoryDiskSpace = "disk_space" // TMP_DIR didn't have room for the download
+	ErrCategoryNotFound  = "not_found"  // The object is gone (404)
+	ErrCategoryForbidden = "forbidden"  // Access was denied (403)
+	ErrCategoryThrottled = "throttled"  // S3 asked us to slow down
+	ErrCategoryChecksum  = "checksum"   // The data didn't match its checksum or ETag
+	ErrCategoryTimeout   = "timeout"    // The download stalled
+	ErrCategoryVirus     = "virus"      // The scanner found malware
+	ErrCategoryScan      = "scan"       // The scanner couldn't check the file
+	ErrCategoryOther     = "other"
+)
+
+// Severity says whether a failed file is worth running again as it is.
+type Severity string
+
+const (
+	SeverityTransient Severity = "transient" // A later run may well succeed
+	SeverityPermanent Severity = "permanent" // Something has to change before a run can succeed
+)
+
+// errorSeverity works out the severity of an error of the given category.
+func errorSeverity(category string, err error) Severity {
+	switch category {
+	case ErrCategoryThrottled, ErrCategoryTimeout, ErrCategoryDiskSpace, ErrCategoryChecksum, ErrCategoryScan:
+		return SeverityTransient
+	case ErrCategoryOther:
+		if isRetryable(err) {
+			return SeverityTransient
+		}
+	}
+	return SeverityPermanent
+}
+
+// errChecksumMismatch is wrapped by the errors for data that doesn't match
+// its checksum or ETag.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// errorCategory works out the category of a download error.
+func errorCategory(err error) string {
+	switch {
+	case isArchived(err):
+		return ErrCategoryArchived
+	case errors.Is(err, errNoSpace):
+		return ErrCategoryDiskSpace
+	case errors.Is(err, errChecksumMismatch):
+		return ErrCategoryChecksum
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrCategoryTimeout
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrCategoryNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ErrCategoryForbidden
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return ErrCategoryThrottled
+		}
+	}
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		switch code := httpErr.HTTPStatusCode(); {
+		case code == 404:
+			return ErrCategoryNotFound
+		case code == 403:
+			return ErrCategoryForbidden
+		case code == 429 || code == 503:
+			return ErrCategoryThrottled
+		}
+	}
+	return ErrCategoryOther
+}
+
 type ErrorEvent struct {
-	Filename string // Name of the file that caused the error
-	Size     int64  // Size of the file that caused the error
-	Read     int64  // Number of bytes read before the error occurred
-	Err      error  // The error that occurred
+	Filename string   // Name of the file that caused the error
+	Size     int64    // Size of the file that caused the error
+	Read     int64    // Number of bytes read before the error occurred
+	Err      error    // The error that occurred
+	Category string   `json:",omitempty"` // Kind of failure, such as ErrCategoryArchived
+	Severity Severity `json:",omitempty"` // Whether running again may succeed
+
+	LastModified time.Time `json:"-"` // Of the object, if known, for CHECKPOINT_FILE
+}
+
+// MarshalJSON writes the error out as its message, as an error value would
+// otherwise be written as an empty object.
+func (e *ErrorEvent) MarshalJSON() ([]byte, error) {
+	type event ErrorEvent
+	var msg string
+	if e.Err != nil {
+		msg = e.Err.Error()
+	}
+	return json.Marshal(struct {
+		*event
+		Err string
+	}{(*event)(e), msg})
+}
+
+// errorCounts tallies the error events by category for the summary.
+var errorCounts = struct {
+	sync.Mutex
+	byCategory map[string]int64
+	permanent  int64
+}{byCategory: make(map[string]int64)}
+
+// failedKeysFile lists the keys that failed in this run, in a form KEY_LIST
+// can read back in to retry them.
+var failedKeysFile = Env("FAILED_KEYS_FILE", "failed-keys.txt", "File the keys that failed are written to, for use as a KEY_LIST")
+
+// notFoundFails counts objects deleted between listing and downloading as
+// failures, rather than skipping them.
+var notFoundFails = Env("NOT_FOUND_FAILS", "", "Count objects gone (404) by the time they are downloaded as failures instead of skipping them") != ""
+
+// skippedKeysFile lists the keys skipped as gone in this run.
+var skippedKeysFile = Env("SKIPPED_KEYS_FILE", "skipped-keys.txt", "File the keys skipped as gone (404) by the time they were downloaded are written to")
+
+// skipped holds the keys skipped as gone, for SKIPPED_KEYS_FILE.
+var skipped skippedKeys
+
+type skippedKeys struct {
+	sync.Mutex
+	keys []string
+}
+
+func (s *skippedKeys) add(key string) {
+	s.Lock()
+	s.keys = append(s.keys, key)
+	s.Unlock()
+}
+
+// reportSkipped logs how many objects were skipped as gone and writes their
+// keys to SKIPPED_KEYS_FILE.  The file is only written when there are any,
+// so one left from an earlier run isn't mistaken for this one's.
+func reportSkipped() {
+	skipped.Lock()
+	defer skipped.Unlock()
+	if len(skipped.keys) == 0 {
+		if skippedKeysFile != "" {
+			os.Remove(skippedKeysFile)
+		}
+		return
+	}
+	Warnf("%d objects were gone by the time they were downloaded and were skipped", len(skipped.keys))
+	if skippedKeysFile == "" {
+		return
+	}
+	sort.Strings(skipped.keys)
+	data := strings.Join(skipped.keys, "\n") + "\n"
+	if err := os.WriteFile(skippedKeysFile, []byte(data), 0644); err != nil {
+		Errorf("failed to write %s: %v", skippedKeysFile, err)
+	}
+}
+
+// maxFailures is how many files may fail before the run is stopped, with 0
+// for no limit.
+var maxFailures = EnvInt("MAX_FAILURES", 0, "Stop the run once more files than this have failed, 0 for no limit")
+
+// checkFailureSettings validates MAX_FAILURES before anything is started.
+func checkFailureSettings() {
+	if maxFailures < 0 {
+		log.Fatalf("MAX_FAILURES value %d is invalid; must be 0 or more", maxFailures)
+	}
+}
+
+// failureLimitHit is set once more than MAX_FAILURES files have failed.
+var failureLimitHit atomic.Bool
+
+// startErrorLog writes each event from fileErrCh to error.log and to the
+// failed keys file, and counts it.  Once more than MAX_FAILURES files have
+// failed it calls stop, so no new files are started.  The returned channel is
+// closed once fileErrCh is closed and drained.
+func startErrorLog(stop context.CancelFunc) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Infof("Watching for errors...")
+		f, err := os.OpenFile("error.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("failed to open err log file: %v", err)
+		}
+		defer f.Close()
+
+		// The list only covers this run, so it starts out empty
+		var keys *bufio.Writer
+		if failedKeysFile != "" {
+			kf, err := os.Create(failedKeysFile)
+			if err != nil {
+				log.Fatalf("failed to create FAILED_KEYS_FILE: %v", err)
+			}
+			defer kf.Close()
+			keys = bufio.NewWriter(kf)
+			defer func() {
+				if err := keys.Flush(); err != nil {
+					Errorf("failed to write %s: %v", failedKeysFile, err)
+				}
+			}()
+		}
+
+		var failed int
+		for errEvent := range fileErrCh {
+			category := errEvent.Category
+			if category == "" {
+				category = ErrCategoryOther
+			}
+			if errEvent.Severity == "" {
+				errEvent.Severity = errorSeverity(category, errEvent.Err)
+			}
+			errorCounts.Lock()
+			errorCounts.byCategory[category]++
+			if errEvent.Severity == SeverityPermanent {
+				errorCounts.permanent++
+			}
+			errorCounts.Unlock()
+			checkpointFailed(errEvent.LastModified)
+
+			logger.Warn("file failed", "key", errEvent.Filename, "size", errEvent.Size,
+				"category", category, "severity", errEvent.Severity, "error", errEvent.Err)
+
+			if failed++; maxFailures > 0 && failed > maxFailures && !failureLimitHit.Load() {
+				failureLimitHit.Store(true)
+				Println("More than", maxFailures, "files have failed (MAX_FAILURES) - finishing in-flight files and stopping")
+				stop()
+			}
+
+			data, err := json.Marshal(errEvent)
+			if err != nil {
+				Errorf("failed to marshal error event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(f, "%s\n", data); err != nil {
+				Errorf("failed to write error event to file: %v", err)
+			}
+			if keys != nil && errEvent.Filename != "" {
+				fmt.Fprintf(keys, "%s\t%d\t%s\n", errEvent.Filename, errEvent.Size, failedReason(errEvent.Severity, category, errEvent.Err))
+			}
+		}
+	}()
+	return done
+}
+
+// failedReason returns the reason column of the failed keys file, kept to
+// one line so the file stays readable as a KEY_LIST.
+func failedReason(severity Severity, category string, err error) string {
+	reason := string(severity) + " " + category
+	if err == nil {
+		return reason
+	}
+	return reason + ": " + strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// reportErrors logs the failures by category and returns how many there
+// were, and how many of them were permanent.
+func reportErrors() (total, permanent int64) {
+	errorCounts.Lock()
+	defer errorCounts.Unlock()
+	var parts []string
+	for category, n := range errorCounts.byCategory {
+		total += n
+		parts = append(parts, fmt.Sprintf("%s=%d", category, n))
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	sort.Strings(parts)
+	Warnf("%d files failed, %d of them permanently (%s); see error.log",
+		total, errorCounts.permanent, strings.Join(parts, ", "))
+	return total, errorCounts.permanent
+}
+
+// failureExitCode returns the exit status for a run with failed files: 1 if
+// any of them failed permanently, otherwise 3 as running again may succeed.
+func failureExitCode(permanent int64) int {
+	if permanent > 0 {
+		return 1
+	}
+	return 3
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	srcDir = Env("SRC_DIR", "", "Local directory to archive instead of SRC_BUCKET")
+	dstDir = Env("DST_DIR", "", "Local directory to move the archives to instead of uploading them to DST_BUCKET")
+)
+
+// localOnly reports whether both ends are local directories, so no S3
+// client is needed.
+func localOnly() bool {
+	return srcDir != "" && dstDir != ""
+}
+
+// checkLocalSettings validates SRC_DIR and DST_DIR before any work starts.
+func checkLocalSettings() {
+	if srcDir != "" {
+		if fi, err := os.Stat(srcDir); err != nil {
+			log.Fatalf("invalid SRC_DIR: %v", err)
+		} else if !fi.IsDir() {
+			log.Fatalf("SRC_DIR %q is not a directory", srcDir)
+		}
+	}
+	if dstDir != "" {
+		if streamUpload {
+			log.Fatalf("STREAM_UPLOAD can't be used with DST_DIR")
+		}
+		if verifyUploads {
+			log.Fatalf("VERIFY_UPLOAD can't be used with DST_DIR")
+		}
+		if err := os.MkdirAll(dstDir, 0755); err != nil {
+			log.Fatalf("failed to create DST_DIR: %v", err)
+		}
+	}
+}
+
+// sourceStore returns the store the objects are read from: SRC_DIR if set,
+// otherwise SRC_BUCKET.
+func sourceStore() ObjectStore {
+	if srcDir != "" {
+		return &FileStore{Root: srcDir}
+	}
+	return &S3Store{Bucket: srcBucket, Client: sharedS3Client{},
+		RequesterPays: s3RequesterPays, SSECustomerKey: sseCustomerKey}
+}
+
+// FileStore reads objects from a local directory, with each key being a
+// slash separated path under Root.
+type FileStore struct {
+	Root string // Directory the keys are relative to
+}
+
+// path returns the file for key, refusing keys that would lead outside Root.
+func (s *FileStore) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("key %q is outside %s: %w", key, s.Root, fs.ErrPermission)
+	}
+	return filepath.Join(s.Root, name), nil
+}
+
+func (s *FileStore) GetObjectRange(ctx context.Context, key, versionID string, start, end int64) (*ObjectBody, error) {
+	if versionID != "" {
+		return nil, fmt.Errorf("version %s of %s: local files have no versions", versionID, key)
+	}
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if start > 0 {
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	body := &ObjectBody{ReadCloser: f, Meta: ObjectMeta{LastModified: fi.ModTime().UTC()}}
+	if end >= 0 {
+		body.ReadCloser = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, end-start+1), f}
+	}
+	return body, nil
+}
+
+func (s *FileStore) HeadObject(ctx context.Context, key, versionID string) (*ObjectInfo, error) {
+	if versionID != "" {
+		return nil, fmt.Errorf("version %s of %s: local files have no versions", versionID, key)
+	}
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	return &ObjectInfo{Size: fi.Size(), LastModified: fi.ModTime().UTC(),
+		Meta: ObjectMeta{LastModified: fi.ModTime().UTC()}}, nil
+}
+
+// loadDirMetadata writes the metadata file by walking root, in the place of
+// listing a bucket.  Only regular files are included, and symlinks aren't
+// followed.
+func loadDirMetadata(ctx context.Context, root string) (totalSize, objectCount int64, err error) {
+	Infof("Loading metadata from directory: %s", root)
+
+	metadataFile, err := os.Create(metadataFileName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create %s: %w", metadataFileName, err)
+	}
+	defer metadataFile.Close()
+	metadataBuf := bufio.NewWriter(metadataFile)
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // Removed since the directory was read
+		} else if err != nil {
+			return err
+		}
+		modTime := fi.ModTime().UTC()
+		entry := MetaEntry{Key: filepath.ToSlash(rel), Size: fi.Size(), LastModified: &modTime}
+		if !entrySelected(&entry) {
+			return nil
+		}
+		objectCount++
+		totalSize += entry.Size
+		dat, _ := json.Marshal(entry)
+		metadataBuf.Write(dat)
+		metadataBuf.WriteByte('\n')
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+
+	fmt.Fprintf(metadataBuf, `{"total_objects":%d,"total_size":%d}`+"\n", objectCount, totalSize)
+	if err := metadataBuf.Flush(); err != nil {
+		return 0, 0, err
+	}
+	Infof("Metadata file %s created with %d objects and total size %d bytes.\n", metadataFileName, objectCount, totalSize)
+	return totalSize, objectCount, metadataFile.Close()
+}
+
+// moveToDstDir moves a finished archive into DST_DIR, copying it when the
+// directory is on another filesystem.
+func moveToDstDir(name string) error {
+	dst := filepath.Join(dstDir, name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(name, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy %s to %s: %w", name, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(name)
+}
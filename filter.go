@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	includeGlobs = Env("INCLUDE_GLOBS", "", "Comma separated globs of keys to archive, ** matches across slashes")
+	excludeGlobs = Env("EXCLUDE_GLOBS", "", "Comma separated globs of keys to leave out, overriding INCLUDE_GLOBS")
+
+	includeRes, excludeRes []*regexp.Regexp
+
+	modifiedAfterStr  = Env("MODIFIED_AFTER", "", "Only archive objects last modified at or after this UTC time or date")
+	modifiedBeforeStr = Env("MODIFIED_BEFORE", "", "Only archive objects last modified before this UTC time or date")
+
+	modifiedAfter, modifiedBefore time.Time
+
+	minSizeStr = Env("MIN_SIZE", "", "Only archive objects of at least this size, such as 1M")
+	maxSizeStr = Env("MAX_SIZE", "", "Only archive objects of at most this size, such as 5G")
+
+	minSize, maxSize int64 = 0, -1
+
+	directoryKeys = Env("DIRECTORY_KEYS", "dir", "Zero byte keys ending in /, as consoles create for folders: dir to archive them as directory entries, or skip")
+)
+
+// initFilters compiles the include and exclude globs.
+func initFilters() {
+	var err error
+	if includeRes, err = compileGlobs(includeGlobs); err != nil {
+		log.Fatalf("invalid INCLUDE_GLOBS: %v", err)
+	}
+	if excludeRes, err = compileGlobs(excludeGlobs); err != nil {
+		log.Fatalf("invalid EXCLUDE_GLOBS: %v", err)
+	}
+	if modifiedAfter, err = parseFilterTime(modifiedAfterStr); err != nil {
+		log.Fatalf("invalid MODIFIED_AFTER: %v", err)
+	}
+	if modifiedBefore, err = parseFilterTime(modifiedBeforeStr); err != nil {
+		log.Fatalf("invalid MODIFIED_BEFORE: %v", err)
+	}
+	if !modifiedAfter.IsZero() && !modifiedBefore.IsZero() && !modifiedAfter.Before(modifiedBefore) {
+		log.Fatalf("MODIFIED_AFTER %s must be before MODIFIED_BEFORE %s", modifiedAfterStr, modifiedBeforeStr)
+	}
+	if minSizeStr != "" {
+		if minSize, err = parseByteSize(minSizeStr); err != nil {
+			log.Fatalf("failed to parse MIN_SIZE: %v", err)
+		}
+	}
+	if maxSizeStr != "" {
+		if maxSize, err = parseByteSize(maxSizeStr); err != nil {
+			log.Fatalf("failed to parse MAX_SIZE: %v", err)
+		} else if maxSize <= 0 {
+			log.Fatalf("MAX_SIZE value %d is invalid; must be greater than 0", maxSize)
+		} else if maxSize < minSize {
+			log.Fatalf("MAX_SIZE %d is smaller than MIN_SIZE %d", maxSize, minSize)
+		}
+	}
+	if directoryKeys != "dir" && directoryKeys != "skip" {
+		log.Fatalf("DIRECTORY_KEYS %q is unknown; must be dir or skip", directoryKeys)
+	}
+}
+
+// isDirectoryKey reports whether an object is a folder placeholder: a zero
+// byte key ending in a slash.
+func isDirectoryKey(key string, size int64) bool {
+	return size == 0 && strings.HasSuffix(key, "/")
+}
+
+// parseFilterTime reads an RFC 3339 time, or a date taken as midnight UTC.
+func parseFilterTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date like 2024-01-31 or a time like 2024-01-31T15:04:05Z", s)
+	}
+	return t, nil
+}
+
+// entrySelected reports whether a listed object passes all the selection
+// settings.  Entries without a last modified time, such as those from
+// KEY_LIST with sizes given, aren't held to the date range or CHECKPOINT_FILE,
+// and a negative size means it isn't known yet.
+func entrySelected(e *MetaEntry) bool {
+	if !keySelected(e.Key) {
+		return false
+	}
+	if e.Size >= 0 && (e.Size < minSize || maxSize >= 0 && e.Size > maxSize) {
+		return false
+	}
+	if directoryKeys == "skip" && isDirectoryKey(e.Key, e.Size) {
+		return false
+	}
+	if e.LastModified != nil {
+		if !modifiedAfter.IsZero() && e.LastModified.Before(modifiedAfter) {
+			return false
+		}
+		if !modifiedBefore.IsZero() && !e.LastModified.Before(modifiedBefore) {
+			return false
+		}
+		if !checkpointSelected(e.Key, e.ETag, *e.LastModified) {
+			return false
+		}
+	}
+	return true
+}
+
+// keySelected reports whether the key passes the selection settings.  The
+// listing already asks S3 for PREFIX_FILTER, but a metadata file left from
+// an earlier run may hold keys from outside it.  Excludes win over includes,
+// and with no includes every key is included.
+func keySelected(key string) bool {
+	if !strings.HasPrefix(key, prefixFilter) {
+		return false
+	}
+	for _, re := range excludeRes {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+	if len(includeRes) == 0 {
+		return true
+	}
+	for _, re := range includeRes {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileGlobs compiles a comma separated list of globs.
+func compileGlobs(list string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, glob := range strings.Split(list, ",") {
+		if glob = strings.TrimSpace(glob); glob == "" {
+			continue
+		}
+		re, err := globRegexp(glob)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", glob, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// globRegexp turns a glob into an anchored regular expression.  A * or ?
+// stays within one path segment, ** matches any number of segments, and
+// "**/" also matches no segment at all, so **/*.json matches a.json too.
+// Character classes like [a-z] and [!a-z] are supported; any other
+// character, including regexp metacharacters, matches itself.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString(`^`)
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					b.WriteString(`(?:.*/)?`)
+				} else {
+					b.WriteString(`.*`)
+				}
+			} else {
+				b.WriteString(`[^/]*`)
+			}
+		case '?':
+			b.WriteString(`[^/]`)
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			} else if strings.HasPrefix(class, "^") {
+				class = `\^` + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			// A backslash escapes the next character
+			if i+1 < len(glob) {
+				i++
+			}
+			fallthrough
+		default:
+			// Whole runes, as a byte of one on its own isn't valid UTF-8
+			_, size := utf8.DecodeRuneInString(glob[i:])
+			b.WriteString(regexp.QuoteMeta(glob[i : i+size]))
+			i += size - 1
+		}
+	}
+	b.WriteString(`$`)
+	return regexp.Compile(b.String())
+}
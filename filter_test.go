@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob, key string
+		want      bool
+	}{
+		{"*.json", "a.json", true},
+		{"*.json", "dir/a.json", false},
+		{"logs/*", "logs/a", true},
+		{"logs/*", "logs/a/b", false},
+		{"logs/**", "logs/a/b", true},
+		{"**/*.json", "a.json", true},
+		{"**/*.json", "x/y/a.json", true},
+		{"**/*.json", "x/y/a.txt", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file12.txt", false},
+		{"a?b", "a/b", false},
+		{"[a-c]*", "banana", true},
+		{"[a-c]*", "date", false},
+		{"[!a-c]*", "date", true},
+		{"[!a-c]*", "banana", false},
+		{"[^]", "^", true},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{"données/*", "données/a", true},
+		{"données/*", "donnees/a", false},
+		{"日本/?.txt", "日本/語.txt", true},
+		{"**/résumé.pdf", "cv/résumé.pdf", true},
+		{`\é`, "é", true},
+		{"[é]", "é", true},
+	}
+	for _, tt := range tests {
+		re, err := globRegexp(tt.glob)
+		if err != nil {
+			t.Errorf("globRegexp(%q): %v", tt.glob, err)
+			continue
+		}
+		if got := re.MatchString(tt.key); got != tt.want {
+			t.Errorf("glob %q on %q = %v, want %v", tt.glob, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestGlobRegexpUnterminatedClass(t *testing.T) {
+	if _, err := globRegexp("[abc"); err == nil {
+		t.Error("unterminated character class was accepted")
+	}
+}
+
+func TestCompileGlobs(t *testing.T) {
+	res, err := compileGlobs(" *.json , ,logs/** ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("got %d globs, want 2", len(res))
+	}
+	if _, err := compileGlobs("ok,[bad"); err == nil {
+		t.Error("bad glob in the list was accepted")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+var (
+	glacierRestoreTier    = Env("GLACIER_RESTORE_TIER", "", "Restore archived objects with this tier: Standard, Bulk or Expedited")
+	glacierRestoreDays    = EnvInt("GLACIER_RESTORE_DAYS", 1, "Days to keep the restored copy of an archived object")
+	glacierRestoreTimeout = Env("GLACIER_RESTORE_TIMEOUT", "12h", "How long to wait for an archived object to be restored")
+	glacierRestorePoll    = Env("GLACIER_RESTORE_POLL", "5m", "How often to check on an object being restored")
+)
+
+// restoreStore is implemented by stores that can bring archived objects back.
+type restoreStore interface {
+	RestoreObject(ctx context.Context, key, versionID string, tier string, days int) error
+}
+
+// isArchived reports whether err says the object is in an archive storage
+// class and has to be restored before it can be read.
+func isArchived(err error) bool {
+	var ios *types.InvalidObjectState
+	if errors.As(err, &ios) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidObjectState"
+}
+
+// archivedError explains that an archived object needs a restore.
+func archivedError(err error) error {
+	class := "an archive storage class"
+	var ios *types.InvalidObjectState
+	if errors.As(err, &ios) && ios.StorageClass != "" {
+		class = string(ios.StorageClass)
+	}
+	return fmt.Errorf("object is archived in %s; restore required (set GLACIER_RESTORE_TIER): %w", class, err)
+}
+
+// withRestore runs fn, and if it fails because the object is archived,
+// restores the object and runs fn again.
+func (d *Downloader) withRestore(ctx context.Context, task *DownloadTask, fn func() error) error {
+	err := fn()
+	if err == nil || !isArchived(err) {
+		return err
+	}
+	if glacierRestoreTier == "" {
+		return archivedError(err)
+	}
+	if err := d.restoreObject(ctx, task); err != nil {
+		return fmt.Errorf("object %s is archived and could not be restored: %w", task.Filename, err)
+	}
+	return fn()
+}
+
+// restoreObject requests a restore of the object and polls until the
+// restored copy is available or GLACIER_RESTORE_TIMEOUT passes.
+func (d *Downloader) restoreObject(ctx context.Context, task *DownloadTask) error {
+	rs, ok := d.Store.(restoreStore)
+	if !ok {
+		return errors.New("store does not support restoring objects")
+	}
+	timeout, err := time.ParseDuration(glacierRestoreTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid GLACIER_RESTORE_TIMEOUT: %w", err)
+	}
+	poll, err := time.ParseDuration(glacierRestorePoll)
+	if err != nil || poll <= 0 {
+		return fmt.Errorf("invalid GLACIER_RESTORE_POLL: %q", glacierRestorePoll)
+	}
+
+	if err := rs.RestoreObject(ctx, task.Filename, task.VersionID, glacierRestoreTier, glacierRestoreDays); err != nil {
+		return err
+	}
+	Infof("Restoring archived object %s with the %s tier", task.Filename, glacierRestoreTier)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("restore not finished after %s", timeout)
+		case <-ticker.C:
+		}
+		info, err := d.Store.HeadObject(ctx, task.Filename, task.VersionID)
+		if err != nil {
+			return err
+		}
+		if info.Restored {
+			return nil
+		}
+	}
+}
+
+func (s *S3Store) RestoreObject(ctx context.Context, key, versionID string, tier string, days int) error {
+	_, err := s.Client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket:    aws.String(s.Bucket),
+		Key:       aws.String(key),
+		VersionId: versionIDParam(versionID),
+		RestoreRequest: &types.RestoreRequest{
+			Days: aws.Int32(int32(days)),
+			GlacierJobParameters: &types.GlacierJobParameters{
+				Tier: types.Tier(tier),
+			},
+		},
+		RequestPayer: requestPayer(s.RequesterPays),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress" {
+		return nil // Someone else asked first, just wait for it
+	}
+	return err
+}
+
+// restoreDone reports whether the x-amz-restore header says a restored copy
+// is ready to read.
+func restoreDone(restore string) bool {
+	return strings.Contains(restore, `ongoing-request="false"`)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	jobStateFile     = Env("STATE_FILE", "", "File the keys uploaded so far are saved to, so a run started again resumes where it left off")
+	jobStateInterval = Env("STATE_INTERVAL", "1m", "How often the keys added to STATE_FILE are synced to disk")
+)
+
+// JobState is what a run has finished: the keys in archives that were
+// uploaded, and the archive numbers used, so a resumed run skips the one and
+// numbers on from the other instead of overwriting archives.  STATE_FILE
+// holds one JobState per line, and the lines add up to the whole state.
+type JobState struct {
+	Archives int               `json:"archives,omitempty"`
+	Done     map[string]string `json:"done,omitempty"` // ETag by key, empty if unknown
+}
+
+// jobState is the state of this run, including what was read from
+// STATE_FILE at the start.
+var jobState = struct {
+	sync.Mutex
+	JobState
+	file  *os.File // STATE_FILE, open for appending
+	dirty bool     // Lines were appended since the file was last synced
+}{JobState: JobState{Done: make(map[string]string)}}
+
+// initJobState reads STATE_FILE, if there is one yet, to resume the run it
+// was saved by.  The lines are then compacted into one, and the file is kept
+// open to append to as the run goes.
+func initJobState() {
+	if jobStateFile == "" {
+		return
+	}
+	if _, err := time.ParseDuration(jobStateInterval); err != nil {
+		log.Fatalf("failed to parse STATE_INTERVAL: %v", err)
+	}
+	f, err := os.Open(jobStateFile)
+	if err == nil {
+		err = readJobState(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("STATE_FILE %s is invalid: %v", jobStateFile, err)
+		}
+		archiveCount = max(archiveCount, jobState.Archives)
+		Infof("Resuming from %s: %d keys already uploaded in %d archives", jobStateFile, len(jobState.Done), jobState.Archives)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.Fatalf("failed to read STATE_FILE: %v", err)
+	}
+	if err := compactJobState(); err != nil {
+		log.Fatalf("failed to write STATE_FILE: %v", err)
+	}
+	if jobState.file, err = os.OpenFile(jobStateFile, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		log.Fatalf("failed to open STATE_FILE: %v", err)
+	}
+}
+
+// readJobState adds up the lines of a STATE_FILE into jobState.  A last line
+// cut short by a crash is dropped.
+func readJobState(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var st JobState
+		err := dec.Decode(&st)
+		if err == io.EOF {
+			return nil
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			Warnf("dropping the partly written last line of %s", jobStateFile)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		jobState.Archives = max(jobState.Archives, st.Archives)
+		maps.Copy(jobState.Done, st.Done)
+	}
+}
+
+// compactJobState replaces STATE_FILE with the whole state on one line, by
+// way of a temp file so a crash leaves the old state whole.
+func compactJobState() error {
+	data, err := json.Marshal(jobState.JobState)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(jobStateFile, append(data, '\n')); err != nil {
+		return err
+	}
+	Debugf("Saved job state of %d keys to %s", len(jobState.Done), jobStateFile)
+	return nil
+}
+
+// jobStateSkip reports whether the object was uploaded before the run was
+// resumed.  It is the same object if the ETags match, or either is unknown.
+func jobStateSkip(key, etag string) bool {
+	if jobStateFile == "" {
+		return false
+	}
+	jobState.Lock()
+	defer jobState.Unlock()
+	prior, ok := jobState.Done[key]
+	return ok && (prior == "" || etag == "" || prior == etag)
+}
+
+// jobStateOpened records that archive number seq is in use, syncing it to
+// disk before the archive can reach the bucket so a resumed run never reuses
+// it.  Numbers of archives that are never uploaded are skipped when
+// resuming, as a part of them may be in the bucket.
+func jobStateOpened(seq int) {
+	if jobStateFile == "" {
+		return
+	}
+	jobState.Lock()
+	defer jobState.Unlock()
+	if seq > jobState.Archives {
+		jobState.Archives = seq
+		appendJobStateLocked(JobState{Archives: seq}, true)
+	}
+}
+
+// jobStateUploaded records the objects of an archive that was uploaded.
+func jobStateUploaded(objs []SourceObject) {
+	if jobStateFile == "" {
+		return
+	}
+	jobState.Lock()
+	defer jobState.Unlock()
+	done := make(map[string]string, len(objs))
+	for _, o := range objs {
+		jobState.Done[o.Key] = o.ETag
+		done[o.Key] = o.ETag
+	}
+	appendJobStateLocked(JobState{Done: done}, false)
+}
+
+// appendJobStateLocked appends a line to STATE_FILE, with jobState already
+// locked.  Unless sync is set, the line reaches the disk at the next
+// STATE_INTERVAL.
+func appendJobStateLocked(st JobState, sync bool) {
+	if jobState.file == nil {
+		return
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		Errorf("failed to encode job state: %v", err)
+		return
+	}
+	if _, err := jobState.file.Write(append(data, '\n')); err != nil {
+		Errorf("failed to write %s: %v", jobStateFile, err)
+		return
+	}
+	jobState.dirty = true
+	if sync {
+		syncJobStateLocked()
+	}
+}
+
+// StartJobState syncs STATE_FILE every STATE_INTERVAL until ctx is done.
+func StartJobState(ctx context.Context) {
+	if jobStateFile == "" {
+		return
+	}
+	interval, _ := time.ParseDuration(jobStateInterval) // Checked by initJobState
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				jobState.Lock()
+				syncJobStateLocked()
+				jobState.Unlock()
+			}
+		}
+	}()
+}
+
+// syncJobStateLocked syncs the lines appended to STATE_FILE to disk, with
+// jobState already locked.
+func syncJobStateLocked() {
+	if jobState.file == nil || !jobState.dirty {
+		return
+	}
+	if err := jobState.file.Sync(); err != nil {
+		Errorf("failed to sync %s: %v", jobStateFile, err)
+		return
+	}
+	jobState.dirty = false
+}
+
+// finishJobState compacts STATE_FILE at the end of a run, unless the job is
+// complete, when it is removed so the next run starts afresh.
+func finishJobState(complete bool) {
+	if jobStateFile == "" {
+		return
+	}
+	jobState.Lock()
+	defer jobState.Unlock()
+	if jobState.file != nil {
+		jobState.file.Close()
+		jobState.file = nil
+	}
+	if !complete {
+		if err := compactJobState(); err != nil {
+			Errorf("failed to write %s: %v", jobStateFile, err)
+		}
+		return
+	}
+	if err := os.Remove(jobStateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		Errorf("failed to remove %s: %v", jobStateFile, err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJobStateLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	defer func(file string, count int) { jobStateFile, archiveCount = file, count }(jobStateFile, archiveCount)
+	jobStateFile = path
+	reset := func() {
+		jobState.JobState = JobState{Done: make(map[string]string)}
+		jobState.file, jobState.dirty = nil, false
+	}
+	reset()
+
+	initJobState()
+	jobStateOpened(1)
+	jobStateUploaded([]SourceObject{{Key: "a", ETag: "1"}, {Key: "b", ETag: "2"}})
+	jobStateOpened(2)
+	jobStateUploaded([]SourceObject{{Key: "a", ETag: "3"}})
+	jobState.file.WriteString(`{"done":{"c":`) // A crash part way through a line
+	jobState.file.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 5 {
+		t.Errorf("got %d lines, want 5:\n%s", n, data)
+	}
+
+	reset()
+	initJobState()
+	if jobState.Archives != 2 || len(jobState.Done) != 2 || jobState.Done["a"] != "3" || jobState.Done["b"] != "2" {
+		t.Errorf("read back %+v", jobState.JobState)
+	}
+	if !jobStateSkip("a", "3") || jobStateSkip("a", "1") || jobStateSkip("c", "") {
+		t.Error("wrong keys skipped")
+	}
+
+	finishJobState(false)
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"archives":2,"done":{"a":"3","b":"2"}}` + "\n"; string(data) != want {
+		t.Errorf("compacted to %q, want %q", data, want)
+	}
+	finishJobState(true)
+	if _, err := os.Stat(path); err == nil {
+		t.Error("STATE_FILE was left after a complete run")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// keyList names a file, or - for stdin, with the keys to archive, which is
+// used instead of listing the source bucket.
+var keyList = Env("KEY_LIST", "", "File of keys to archive instead of listing the bucket, - for stdin")
+
+// keyListBatch is how many keys are looked up at once when sizes are missing.
+const keyListBatch = 1000
+
+// loadKeyList writes the metadata file from KEY_LIST.  Each line holds a key,
+// optionally followed by a tab and its size, and anything after a further tab
+// is ignored, such as the reason in FAILED_KEYS_FILE.  Keys without a size get
+// a HEAD request to find it, and keys that can't be found are logged and left
+// out.
+func loadKeyList(ctx context.Context, store ObjectStore) (totalSize, objectCount int64, err error) {
+	var in io.Reader = os.Stdin
+	if keyList != "-" {
+		f, err := os.Open(keyList)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to open KEY_LIST: %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	Infof("Loading metadata from key list: %s", keyList)
+
+	metadataFile, err := os.Create(metadataFileName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create %s: %w", metadataFileName, err)
+	}
+	defer metadataFile.Close()
+	metadataBuf := bufio.NewWriter(metadataFile)
+
+	// Sizes are looked up a batch at a time so the lines keep their order
+	writeBatch := func(batch []MetaEntry) {
+		swg := sizedwaitgroup.New(downloadConcurrency)
+		found := make([]bool, len(batch))
+		for i := range batch {
+			if batch[i].Size >= 0 {
+				found[i] = true
+				continue
+			}
+			swg.Add()
+			go func(i int) {
+				defer swg.Done()
+				info, err := store.HeadObject(ctx, batch[i].Key, "")
+				if err != nil {
+					Warnf("skipping %s from KEY_LIST: %v", batch[i].Key, err)
+					return
+				}
+				batch[i].Size = info.Size
+				if !info.LastModified.IsZero() {
+					batch[i].LastModified = &info.LastModified
+				}
+				batch[i].ETag = strings.Trim(info.ETag, `"`)
+				found[i] = entrySelected(&batch[i])
+			}(i)
+		}
+		swg.Wait()
+		for i, entry := range batch {
+			if !found[i] {
+				continue
+			}
+			objectCount++
+			totalSize += entry.Size
+			dat, _ := json.Marshal(entry)
+			metadataBuf.Write(dat)
+			metadataBuf.WriteByte('\n')
+		}
+	}
+
+	var batch []MetaEntry
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		entry := MetaEntry{Key: line, Size: -1}
+		if key, size, ok := strings.Cut(line, "\t"); ok {
+			size, _, _ = strings.Cut(size, "\t")
+			n, err := strconv.ParseInt(size, 10, 64)
+			if err != nil || n < 0 {
+				return 0, 0, fmt.Errorf("KEY_LIST line %d: invalid size %q", lineNumber, size)
+			}
+			entry.Key, entry.Size = key, n
+		}
+		if !entrySelected(&entry) {
+			continue
+		}
+		if batch = append(batch, entry); len(batch) == keyListBatch {
+			writeBatch(batch)
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to read KEY_LIST: %w", err)
+	}
+	writeBatch(batch)
+
+	fmt.Fprintf(metadataBuf, `{"total_objects":%d,"total_size":%d}`+"\n", objectCount, totalSize)
+	if err := metadataBuf.Flush(); err != nil {
+		return 0, 0, err
+	}
+	Infof("Metadata file %s created with %d objects and total size %d bytes.\n", metadataFileName, objectCount, totalSize)
+	return totalSize, objectCount, metadataFile.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// runList prints the size and name of every entry in the named archives,
+// reading them as a stream, or zip archives by their central directory,
+// without extracting anything.
+func runList(ctx context.Context, archives []string) {
+	if len(archives) == 0 {
+		log.Fatalf("usage: %s list ARCHIVE...", os.Args[0])
+	}
+	failed := false
+	for _, name := range archives {
+		var files, bytes int64
+		tr, closer, err := openArchiveStream(ctx, name)
+		if errors.Is(err, errZipArchive) {
+			// Only the central directory is read
+			err = forEachZipEntry(ctx, name, func(_ io.Reader, hdr *tar.Header) error {
+				printEntry(hdr)
+				files++
+				bytes += hdr.Size
+				return nil
+			})
+			if err != nil {
+				Errorf("failed to read archive %s: %v", name, err)
+				failed = true
+			}
+			Infof("%s: %d entries, %s", name, files, humanizeBytes(bytes))
+			continue
+		}
+		if err != nil {
+			Errorf("failed to open archive %s: %v", name, err)
+			failed = true
+			continue
+		}
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				Errorf("failed to read archive %s: %v", name, err)
+				failed = true
+				break
+			}
+			printEntry(hdr)
+			files++
+			bytes += hdr.Size
+		}
+		closer.Close()
+		Infof("%s: %d entries, %s", name, files, humanizeBytes(bytes))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// printEntry prints an entry of an archive with its size, or what it is for
+// links and directories.
+func printEntry(hdr *tar.Header) {
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		fmt.Printf("%12s  %s -> %s\n", "link", hdr.Name, hdr.Linkname)
+	case tar.TypeDir:
+		fmt.Printf("%12s  %s\n", "dir", hdr.Name)
+	default:
+		fmt.Printf("%12d  %s\n", hdr.Size, hdr.Name)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	logFormat = Env("LOG_FORMAT", "text", "Log output format, text or json")
+	logLevel  = Env("LOG_LEVEL", "", "Least severe messages logged: error, warn, info or debug (default info, or debug with DEBUG)")
+)
+
+// logger writes the log records, some of which carry fields such as the key,
+// size and duration.  initLogging points it at LOG_FORMAT and LOG_LEVEL.
+var logger = slog.New(newTextHandler(new(slog.LevelVar)))
+
+// jsonLogs is set when LOG_FORMAT is json.
+var jsonLogs bool
+
+// initLogging sets up the log output for LOG_FORMAT and LOG_LEVEL.  The log
+// package is sent through the same handler at the error level, as it is only
+// left for the Fatal calls.
+func initLogging() {
+	level := new(slog.LevelVar)
+	switch strings.ToLower(logLevel) {
+	case "":
+		if debug {
+			level.Set(slog.LevelDebug)
+		}
+	case "error":
+		level.Set(slog.LevelError)
+	case "warn", "warning":
+		level.Set(slog.LevelWarn)
+	case "info":
+		level.Set(slog.LevelInfo)
+	case "debug":
+		level.Set(slog.LevelDebug)
+	default:
+		log.Fatalf("LOG_LEVEL %q is unknown; must be error, warn, info or debug", logLevel)
+	}
+	debug = level.Level() <= slog.LevelDebug
+
+	var h slog.Handler
+	switch logFormat {
+	case "text":
+		h = newTextHandler(level)
+	case "json":
+		jsonLogs = true
+		h = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level, ReplaceAttr: durationString})
+	default:
+		log.Fatalf("LOG_FORMAT %q is unknown; must be text or json", logFormat)
+	}
+	logger = slog.New(h)
+	slog.SetDefault(logger)
+	slog.SetLogLoggerLevel(slog.LevelError)
+	awscliLog = componentLogger{logger.With("component", "awscli")}
+	clamLog = componentLogger{logger.With("component", "clamav")}
+}
+
+// Debugf, Infof, Warnf and Errorf log a printf style message at their level.
+func Debugf(format string, v ...any) { logf(slog.LevelDebug, format, v...) }
+func Infof(format string, v ...any)  { logf(slog.LevelInfo, format, v...) }
+func Warnf(format string, v ...any)  { logf(slog.LevelWarn, format, v...) }
+func Errorf(format string, v ...any) { logf(slog.LevelError, format, v...) }
+
+// logf only formats the message if the level is logged.
+func logf(level slog.Level, format string, v ...any) {
+	ctx := context.Background()
+	if logger.Enabled(ctx, level) {
+		logger.Log(ctx, level, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+	}
+}
+
+// componentLogger logs the messages of one part of the program, such as
+// awscli, with Print calls at the info level and Fatal calls at the error
+// level.
+type componentLogger struct {
+	l *slog.Logger
+}
+
+func (c componentLogger) Println(v ...any)               { c.l.Info(logLine(v...)) }
+func (c componentLogger) Printf(format string, v ...any) { c.l.Info(fmt.Sprintf(format, v...)) }
+func (c componentLogger) Fatal(v ...any)                 { c.l.Error(fmt.Sprint(v...)); os.Exit(1) }
+func (c componentLogger) Fatalln(v ...any)               { c.l.Error(logLine(v...)); os.Exit(1) }
+func (c componentLogger) Fatalf(format string, v ...any) {
+	c.l.Error(fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// logLine returns the message of a Println style call.
+func logLine(v ...any) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
+
+// durationString writes durations like 1.5s rather than as nanoseconds.
+func durationString(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		a.Value = slog.StringValue(a.Value.Duration().String())
+	}
+	return a
+}
+
+// textHandler writes records in the format of the log package, as the tool
+// always has, with the level in front of messages other than info ones, the
+// component as a prefix and any fields after the message.
+type textHandler struct {
+	level     slog.Leveler
+	mu        *sync.Mutex
+	component string
+	attrs     string
+}
+
+func newTextHandler(level slog.Leveler) *textHandler {
+	return &textHandler{level: level, mu: new(sync.Mutex)}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if h.component != "" {
+		b.WriteString(h.component + ": ")
+	}
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	b.WriteString(t.Format("2006/01/02 15:04:05 "))
+	if r.Level != slog.LevelInfo {
+		b.WriteString(r.Level.String() + " ")
+	}
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		b.WriteString(textAttr(a))
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := os.Stderr.WriteString(b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	for _, a := range attrs {
+		if a.Key == "component" {
+			h2.component = a.Value.String()
+		} else {
+			h2.attrs += textAttr(a)
+		}
+	}
+	return &h2
+}
+
+func (h *textHandler) WithGroup(string) slog.Handler { return h }
+
+// textAttr formats a field as key=value, quoting values with spaces.
+func textAttr(a slog.Attr) string {
+	v := a.Value.Resolve().String()
+	if strings.ContainsAny(v, " \t\n\"") || v == "" {
+		v = strconv.Quote(v)
+	}
+	return " " + a.Key + "=" + v
+}
@@ -5,7 +5,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -16,15 +15,45 @@ var (
 	metadataFileName = "metadata.jsonl"
 	sizeCapLimit     int64
 	debug            = Env("DEBUG", "", "Enable debugging") != ""
-	ArchiveName      = Env("ARCHIVE_NAME", "archive_%07d.tgz", "Output template")
+	ArchiveName      = Env("ARCHIVE_NAME", defaultArchiveName(), "Output template")
 	version          = "1.0.0"
 	scanningEnabled  = Env("DISABLE_SCANNER", "", "Disable the scanner") == ""
 )
 
 func main() {
 	fmt.Printf("Starting bucket-archiver v%s: downloading, archiving, and uploading S3 objects.\n", version)
+	initLogging()
+	startPprof()
 	initS3()
+	loadEncryptionKey()
+	checkThrottleSettings()
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		checkUploadSettings()
+		runRestore(context.Background(), os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		runList(context.Background(), os.Args[2:])
+		return
+	}
 	initScan()
+	initTracing()
+	checkTempDir()
+	loadSSECustomerKey()
+	initManifest()
+	initFilters()
+	initCheckpoint()
+	initJobState()
+	checkArchiveSettings()
+	checkStreamSettings()
+	checkUploadSettings()
+	checkTagSettings()
+	checkObjectLock(context.Background())
+	checkLocalSettings()
+	checkReproducible()
+	checkPartitionSettings()
+	checkDeleteSource()
+	checkFailureSettings()
 
 	// Parse SIZECAP environment variable if set, otherwise use default
 	sizeCapStr := Env("SIZECAP", "2G", "Limit the size of the uncompressed archive payload")
@@ -37,12 +66,12 @@ func main() {
 		log.Fatalf("SIZECAP value %d is too small; must be at least 100 bytes", sizeCapLimit)
 	}
 
-	log.Println("Making pipeline channels.")
+	Infof("Making pipeline channels.")
 	var (
-		toDownload      = make(chan *DownloadTask, EnvInt("CHAN_TODO_DOWNLOAD", 10, "Buffer size for toDownload channel"))
-		downloadedFiles = make(chan *WorkFile, EnvInt("CHAN_DOWNLOADED_FILES", 20, "Buffer size for downloadedFiles channel"))
-		scannedFiles    = make(chan *WorkFile, EnvInt("CHAN_SCANNED_FILES", 10, "Buffer size for scannedFiles channel"))
-		ArchiveFiles    = make(chan *ArchiveFile, EnvInt("CHAN_ARCHIVE_FILES", 2, "Buffer size for ArchiveFiles channel"))
+		toDownload      = make(chan *DownloadTask, chanSize("CHAN_TODO_DOWNLOAD", 10, "Buffer size for toDownload channel"))
+		downloadedFiles = make(chan *WorkFile, chanSize("CHAN_DOWNLOADED_FILES", 20, "Buffer size for downloadedFiles channel, the files downloaded waiting to be scanned or archived"))
+		scannedFiles    = make(chan *WorkFile, chanSize("CHAN_SCANNED_FILES", 10, "Buffer size for scannedFiles channel"))
+		ArchiveFiles    = make(chan *ArchiveFile, chanSize("CHAN_ARCHIVE_FILES", 2, "Buffer size for ArchiveFiles channel"))
 		Done            = make(chan struct{})
 	)
 
@@ -51,63 +80,91 @@ func main() {
 	// Default context for processing
 	ctx := context.Background()
 
+	// A stop signal ends the reading of new tasks, and the rest of the
+	// pipeline drains what is left before exiting.
+	timeout, err := time.ParseDuration(shutdownTimeout)
+	if err != nil {
+		log.Fatalf("failed to parse SHUTDOWN_TIMEOUT: %v", err)
+	}
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading()
+	watchSignals(stopReading, timeout)
+
 	// Check if metadata file exists locally, if not, load metadata from S3
 	//
 	// If the metadata file exists, read it to get total size and object count
 	// If it doesn't exist, create it by listing objects in the source bucket
 	if _, err := os.Stat(metadataFileName); err == nil {
-		log.Printf("metadata file %s already exists in the local filesystem", metadataFileName)
+		Infof("metadata file %s already exists in the local filesystem", metadataFileName)
 
 		// Read metadata from local file
 		fileStats, err := ReadLastLineJSONStats(metadataFileName)
 		if err != nil {
-			log.Printf("failed to read metadata file: %v", err)
+			Warnf("failed to read metadata file: %v", err)
 		} else {
 			TotalBytes = fileStats.Size
 			TotalFiles = fileStats.Count
 		}
 	} else if os.IsNotExist(err) {
-		log.Printf("creating metadata file %q", metadataFileName)
+		Infof("creating metadata file %q", metadataFileName)
 		// Create metadata file if it doesn't exist
-		TotalBytes, TotalFiles, err = loadMetadata(ctx, srcBucket)
+		if keyList != "" {
+			TotalBytes, TotalFiles, err = loadKeyList(ctx, sourceStore())
+		} else if srcDir != "" {
+			TotalBytes, TotalFiles, err = loadDirMetadata(ctx, srcDir)
+		} else {
+			TotalBytes, TotalFiles, err = loadMetadata(ctx, srcBucket)
+		}
 		if err != nil {
 			log.Fatalf("failed to load metadata: %v", err)
 		}
 	} else {
 		log.Fatalf("error generating metadata file: %v", err)
 	}
-	log.Printf("Total objects: %d, Total size: %s", TotalFiles, humanizeBytes(TotalBytes))
+	Infof("Total objects: %d, Total size: %s", TotalFiles, humanizeBytes(TotalBytes))
 
 	scanReady.Wait() // Wait for the ClamAV instance to be ready
 
 	// Create a channel for error events to be handled by the error logger goroutine
-	go func() {
-		log.Println("Watching for errors...")
-		f, err := os.OpenFile("error.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatalf("failed to open err log file: %v", err)
-		}
-		defer f.Close()
-
-		for errEvent := range fileErrCh {
-			data, err := json.Marshal(errEvent)
-			if err != nil {
-				log.Printf("failed to marshal error event: %v", err)
-				continue
-			}
-			if _, err := fmt.Fprintf(f, "%s\n", data); err != nil {
-				log.Printf("failed to write error event to file: %v", err)
-			}
-		}
-	}()
+	errLogDone := startErrorLog(stopReading)
 
 	// Read the metadata and send it to the toDownload pipline
-	go ReadMetadata(ctx, toDownload)
+	go ReadMetadata(readCtx, toDownload)
 
 	StartMetrics(ctx)
+	StartJobState(ctx)
 
 	// Consume the toDownload, download the file, and send to the downloaded pipeline
-	go Downloader(ctx, toDownload, downloadedFiles)
+	downloader, err := NewDownloader(sourceStore())
+	if err != nil {
+		log.Fatalf("invalid downloader settings: %v", err)
+	}
+	StartMetricsServer(ctx, downloader.Stats)
+	go downloader.Run(ctx, toDownload, downloadedFiles)
+
+	// Log a progress line now and then
+	interval, err := progressEvery()
+	if err != nil {
+		log.Fatalf("failed to parse PROGRESS_INTERVAL: %v", err)
+	}
+	StartProgressReporter(ctx, interval, downloader.Stats)
+
+	if dryRun {
+		// Nothing is downloaded, so there is nothing to archive
+		for range downloadedFiles {
+		}
+		close(fileErrCh)
+		<-errLogDone
+		stats := downloader.Stats()
+		Infof("Dry run found %d objects, %s in total", stats.CheckedFiles, humanizeBytes(stats.CheckedBytes))
+		reportSkipped()
+		StopMetrics()
+		finishTracing()
+		if failed, permanent := reportErrors(); failed > 0 {
+			os.Exit(failureExitCode(permanent))
+		}
+		return
+	}
 
 	if scanningEnabled {
 		// Consume the downloaded, scan, and then send to the scannedFiles pipeline
@@ -120,14 +177,55 @@ func main() {
 		go Archiver(ctx, downloadedFiles, ArchiveFiles)
 	}
 
-	go Uploader(ctx, ArchiveFiles, Done)
+	go Uploader(ctx, dstClient(), ArchiveFiles, Done)
 
 	<-Done // Wait for all uploads to finish
 
 	close(fileErrCh) // Close error channel to ensure the logs are written to disk
+	<-errLogDone
 
 	// Stop the metrics collection and clean up any resources
 	StopMetrics()
-	log.Println("All uploads completed successfully.")
-	time.Sleep(time.Second)
+	finishTracing()
+	if n := removeTempFiles(); n > 0 {
+		Infof("Removed %d leftover temp files", n)
+	}
+	checkMemoryReleased()
+	reportThroughput(downloader.Stats().DownloadedFiles)
+	reportTimings(downloader.Stats())
+	reportSkipped()
+	if n := downloader.Stats().UnverifiedFiles; n > 0 {
+		Warnf("%d resumed downloads couldn't be checked against their ETag", n)
+	}
+	if n := throttledRequests.Load(); n > 0 {
+		Warnf("S3 throttled %d requests, which were retried after backing off", n)
+	}
+	failed, permanent := reportErrors()
+	finishJobState(failed == 0 && !stopRequested.Load() && !failureLimitHit.Load())
+	if !stopRequested.Load() && !failureLimitHit.Load() {
+		// Files never reached aren't known to be before the checkpoint
+		writeCheckpoint()
+	}
+	if stopRequested.Load() {
+		Warnf("Stopped early; uploads of the files started were completed.")
+		os.Exit(1)
+	}
+	if failureLimitHit.Load() {
+		Warnf("Stopped after more than %d files failed; uploads of the files started were completed.", maxFailures)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		Warnf("All uploads completed, but some files were left out.")
+		os.Exit(failureExitCode(permanent))
+	}
+	Infof("All uploads completed successfully.")
+}
+
+// chanSize reads the buffer size of a pipeline channel from the setting name.
+func chanSize(name string, def int, desc string) int {
+	n := EnvInt(name, def, desc)
+	if n < 0 {
+		log.Fatalf("%s value %d is invalid; must be 0 or more", name, n)
+	}
+	return n
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	manifestFile   = Env("MANIFEST_FILE", "", "File to record where each object was archived, empty to disable")
+	manifestFormat = Env("MANIFEST_FORMAT", "csv", "Format of the manifest, csv or json")
+	priorManifest  = Env("PRIOR_MANIFEST", "", "Manifest of an earlier run, whose keys are skipped unless their ETag changed")
+
+	// archiveManifest collects the entries while archiving, and is nil when
+	// no manifest is wanted.
+	archiveManifest *manifest
+
+	// priorEntries are the entries of PRIOR_MANIFEST by key.
+	priorEntries map[string]ManifestEntry
+)
+
+// ManifestEntry records one object written to an archive.
+type ManifestEntry struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Archive     string `json:"archive"`
+	Compression string `json:"compression"`        // Codec of the archive, gzip or zstd, or zip for zip archives
+	Offset      int64  `json:"offset"`             // Start of the contents in the uncompressed tar stream, or of the local header in a zip
+	Files       int    `json:"archive_files"`      // Entries in the archive, filled in by write
+	ETag        string `json:"etag"`               // ETag of the object from the listing, if known
+	DuplicateOf string `json:"duplicate_of"`       // Key holding the same contents, with DEDUP
+	Checksum    string `json:"checksum,omitempty"` // CHECKSUM_ALGORITHM and the base64 checksum, such as CRC32C:yZRlqg==, if computed
+
+	// With COMPRESS_EACH_FILE, the codec of the entry's own gzip member or
+	// zstd frame and where it starts in the archive file
+	EntryCompression string `json:"entry_compression,omitempty"`
+	EntryOffset      int64  `json:"entry_offset,omitempty"`
+}
+
+type manifest struct {
+	mu      sync.Mutex // The archive writers add entries at once
+	entries []ManifestEntry
+}
+
+// initManifest checks the manifest settings and loads PRIOR_MANIFEST.
+func initManifest() {
+	if priorManifest != "" {
+		entries, err := readManifest(priorManifest)
+		if err != nil {
+			log.Fatalf("failed to read PRIOR_MANIFEST %s: %v", priorManifest, err)
+		}
+		priorEntries = make(map[string]ManifestEntry, len(entries))
+		for _, e := range entries {
+			priorEntries[e.Key] = e
+		}
+		Infof("Loaded %d entries from %s", len(priorEntries), priorManifest)
+	}
+	if manifestFile == "" {
+		return
+	}
+	if manifestFormat != "csv" && manifestFormat != "json" {
+		log.Fatalf("MANIFEST_FORMAT %q is unknown; must be csv or json", manifestFormat)
+	}
+	archiveManifest = &manifest{}
+}
+
+// priorArchived returns the PRIOR_MANIFEST entry of the listed object e, if
+// it was archived before and hasn't changed since.  The ETags are compared
+// when both are known, otherwise the sizes.
+func priorArchived(e *MetaEntry) (ManifestEntry, bool) {
+	prior, ok := priorEntries[e.Key]
+	if !ok {
+		return prior, false
+	}
+	if prior.ETag != "" && e.ETag != "" {
+		return prior, prior.ETag == e.ETag
+	}
+	return prior, prior.Size == e.Size
+}
+
+// readManifest reads the entries of a manifest written by write, in either
+// format.  Columns are found by name, so manifests from older versions
+// without some of them can be read too.
+func readManifest(path string) ([]ManifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if first, _ := br.Peek(1); len(first) == 1 && first[0] == '{' {
+		var entries []ManifestEntry
+		dec := json.NewDecoder(br)
+		for {
+			var e ManifestEntry
+			if err := dec.Decode(&e); err == io.EOF {
+				return entries, nil
+			} else if err != nil {
+				return nil, err
+			}
+			if e.Key != "" { // Not the manifest_sha256 line
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1 // The manifest_sha256 line is shorter
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := make(map[string]int, len(header))
+	for i, name := range header {
+		col[name] = i
+	}
+	if _, ok := col["key"]; !ok {
+		return nil, fmt.Errorf("no key column")
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+	var entries []ManifestEntry
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(rec) < len(header) {
+			continue // The manifest_sha256 line
+		}
+		e := ManifestEntry{Key: field(rec, "key"), SHA256: field(rec, "sha256"), Archive: field(rec, "archive"),
+			Compression: field(rec, "compression"), ETag: field(rec, "etag"), DuplicateOf: field(rec, "duplicate_of"),
+			EntryCompression: field(rec, "entry_compression"), Checksum: field(rec, "checksum")}
+		e.Size, _ = strconv.ParseInt(field(rec, "size"), 10, 64)
+		e.Offset, _ = strconv.ParseInt(field(rec, "offset"), 10, 64)
+		e.Files, _ = strconv.Atoi(field(rec, "archive_files"))
+		e.EntryOffset, _ = strconv.ParseInt(field(rec, "entry_offset"), 10, 64)
+		entries = append(entries, e)
+	}
+}
+
+// add records an entry.  The archive writers and ReadMetadata, copying the
+// PRIOR_MANIFEST entries it skips, add at once.
+func (m *manifest) add(e ManifestEntry) {
+	if m != nil {
+		m.mu.Lock()
+		m.entries = append(m.entries, e)
+		m.mu.Unlock()
+	}
+}
+
+// write saves the manifest to path.  The entries are sorted so the order
+// downloads happened to finish in doesn't matter, and the last line holds
+// the SHA-256 of all the lines before it.
+func (m *manifest) write(path string) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sort.SliceStable(m.entries, func(i, j int) bool {
+		if m.entries[i].Key != m.entries[j].Key {
+			return m.entries[i].Key < m.entries[j].Key
+		}
+		return m.entries[i].Archive < m.entries[j].Archive
+	})
+	files := make(map[string]int)
+	for _, e := range m.entries {
+		files[e.Archive]++
+	}
+	for i := range m.entries {
+		if m.entries[i].Files == 0 { // Entries from PRIOR_MANIFEST keep theirs
+			m.entries[i].Files = files[m.entries[i].Archive]
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+	h := sha256.New()
+	w := io.MultiWriter(bw, h)
+
+	switch manifestFormat {
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, e := range m.entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		err = json.NewEncoder(bw).Encode(struct {
+			SHA256 string `json:"manifest_sha256"`
+		}{hex.EncodeToString(h.Sum(nil))})
+	default:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"key", "size", "sha256", "archive", "compression", "offset", "archive_files", "etag", "duplicate_of", "entry_compression", "entry_offset", "checksum"})
+		for _, e := range m.entries {
+			cw.Write([]string{e.Key, strconv.FormatInt(e.Size, 10), e.SHA256, e.Archive, e.Compression, strconv.FormatInt(e.Offset, 10),
+				strconv.Itoa(e.Files), e.ETag, e.DuplicateOf, e.EntryCompression, strconv.FormatInt(e.EntryOffset, 10), e.Checksum})
+		}
+		if cw.Flush(); cw.Error() != nil {
+			return cw.Error()
+		}
+		_, err = fmt.Fprintf(bw, "manifest_sha256,%s\n", hex.EncodeToString(h.Sum(nil)))
+	}
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
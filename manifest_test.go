@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestManifestConcurrentAdd(t *testing.T) {
+	// As the archive writers and ReadMetadata do, checked with -race
+	m := &manifest{}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.add(ManifestEntry{Key: fmt.Sprintf("w%d/%03d", w, i), Archive: "a"})
+			}
+		}(w)
+	}
+	wg.Wait()
+	if len(m.entries) != 400 {
+		t.Fatalf("got %d entries, want 400", len(m.entries))
+	}
+
+	path := filepath.Join(t.TempDir(), "manifest.csv")
+	if err := m.write(path); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 400 || entries[0].Key != "w0/000" || entries[0].Files != 400 {
+		t.Errorf("read back %d entries, first %+v", len(entries), entries[0])
+	}
+}
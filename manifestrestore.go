@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// entryRead is an entry restored alone, by reading just the gzip member or
+// zstd frame COMPRESS_EACH_FILE wrote it in.
+type entryRead struct {
+	entry ManifestEntry // The entry to restore
+	src   ManifestEntry // The entry holding its contents, its first copy for DEDUP links
+	name  string        // The archive to open, as named on the command line if it was
+	end   int64         // Where the next member starts, or 0 to read to the end
+}
+
+// planManifestRestore picks the entries of RESTORE_MANIFEST to restore: those
+// matching RESTORE_GLOB in the archives named, or in all of them if none
+// are.  The entries written with COMPRESS_EACH_FILE are returned to be read
+// alone.  The rest are returned as the archives to read whole and the keys
+// wanted from them.
+func planManifestRestore(archives []string) ([]entryRead, []string, map[string]bool) {
+	entries, err := readManifest(restoreManifest)
+	if err != nil {
+		log.Fatalf("failed to read RESTORE_MANIFEST %q: %v", restoreManifest, err)
+	}
+
+	// The archives may be named by path, while the manifest has their names
+	named := make(map[string]string, len(archives))
+	for _, name := range archives {
+		named[filepath.Base(name)] = name
+	}
+	firsts := make(map[string]ManifestEntry)
+	starts := make(map[string][]int64) // Member offsets in each archive, for where each one ends
+	for _, e := range entries {
+		if e.DuplicateOf == "" {
+			firsts[e.Key] = e
+		}
+		if e.EntryCompression != "" {
+			starts[e.Archive] = append(starts[e.Archive], e.EntryOffset)
+		}
+	}
+	for _, s := range starts {
+		sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	}
+	open := func(archive string) string {
+		if name, ok := named[filepath.Base(archive)]; ok {
+			return name
+		}
+		return archive
+	}
+
+	var (
+		alone []entryRead
+		whole []string
+		want  = make(map[string]bool)
+		seen  = make(map[string]bool)
+	)
+	for _, e := range entries {
+		if _, ok := named[filepath.Base(e.Archive)]; len(named) > 0 && !ok {
+			continue
+		}
+		if !restoreSelected(e.Key) {
+			continue
+		}
+		src := e
+		if e.DuplicateOf != "" {
+			// The first copy may be in another archive, and is read from there
+			if first, ok := firsts[e.DuplicateOf]; ok && first.SHA256 == e.SHA256 {
+				src = first
+			}
+		}
+		if src.EntryCompression != "" && src.DuplicateOf == "" {
+			r := entryRead{entry: e, src: src, name: open(src.Archive)}
+			s := starts[src.Archive]
+			if i := sort.Search(len(s), func(i int) bool { return s[i] > src.EntryOffset }); i < len(s) {
+				r.end = s[i]
+			}
+			alone = append(alone, r)
+			continue
+		}
+		want[e.Key] = true
+		if !seen[e.Archive] {
+			seen[e.Archive] = true
+			whole = append(whole, open(e.Archive))
+		}
+	}
+	if len(named) > 0 && len(alone) == 0 && len(whole) == 0 {
+		Warnf("no entries of RESTORE_MANIFEST are in the archives named")
+	}
+	return alone, whole, want
+}
+
+// restore reads the entry's member and passes it to extract.  A DEDUP link
+// is restored from the member of its first copy as a file of its own.
+func (r entryRead) restore(ctx context.Context, extract func(io.Reader, *tar.Header) error) error {
+	rc, err := openArchiveFile(ctx, r.name, r.src.EntryOffset, r.end)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var zr io.Reader
+	switch br := bufio.NewReader(rc); r.src.EntryCompression {
+	case "gzip":
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		gr.Multistream(false) // Only this member is the entry's
+		zr = gr
+	case "zstd":
+		dr, err := zstd.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		zr = dr
+	default:
+		return fmt.Errorf("unknown entry compression %q", r.src.EntryCompression)
+	}
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("reading entry at offset %d: %w", r.src.EntryOffset, err)
+	}
+	if hdr.Name != r.src.Key {
+		return fmt.Errorf("found %s at offset %d instead, as the manifest doesn't match the archive", hdr.Name, r.src.EntryOffset)
+	}
+	if r.entry.DuplicateOf != "" {
+		link := *hdr
+		link.Name = r.entry.Key
+		hdr = &link
+	}
+	return extract(tr, hdr)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// memBudget limits the bytes held in memory by WorkFiles that have been
+// downloaded but not yet released, so a slow consumer can't run us out of
+// memory.  Large files downloaded to disk aren't counted.
+var memBudget = newByteBudget(int64(EnvInt("MAX_INFLIGHT_MEM_BYTES", 256*1024*1024, "Maximum bytes of downloaded files held in memory, 0 for no limit")))
+
+// byteBudget is a counting semaphore measured in bytes.
+type byteBudget struct {
+	mu    sync.Mutex
+	max   int64
+	used  int64
+	freed chan struct{} // Closed and replaced whenever bytes are released
+}
+
+// newByteBudget returns a budget of max bytes, or nil for no limit.
+func newByteBudget(max int64) *byteBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &byteBudget{max: max, freed: make(chan struct{})}
+}
+
+// tryAcquire takes n bytes if they are available right now.  A request
+// larger than the whole budget is let through once nothing else is held.
+func (b *byteBudget) tryAcquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used > 0 && b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// acquire takes n bytes, waiting for them to be released if need be.
+func (b *byteBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		freed := b.freed
+		b.mu.Unlock()
+		if b.tryAcquire(n) {
+			return nil
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// inUse returns the bytes held, or 0 if there is no limit.
+func (b *byteBudget) inUse() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// release hands back n bytes taken by acquire.
+func (b *byteBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
@@ -8,16 +8,21 @@ import (
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 type MetaEntry struct {
-	Key  string `json:"key"`
-	Size int64  `json:"size"`
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	VersionID    string     `json:"version_id,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
 }
 
 var (
@@ -25,11 +30,13 @@ var (
 	skipFiles   = make(map[string]struct{})
 )
 
+// prefixFilter limits the listing to keys under a prefix.
+var prefixFilter = Env("PREFIX_FILTER", "", "Bucket prefix selector")
+
 func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount int64, err error) {
 	s3Ready.Wait() // Wait for the S3 client to be ready
-	log.Println("Loading metadata from S3 bucket:", srcBucket)
+	Infof("Loading metadata from S3 bucket: %s", srcBucket)
 
-	prefixFilter := Env("PREFIX_FILTER", "", "Bucket prefix selector")
 	var prefix, slash *string
 	if prefixFilter != "" {
 		prefix = aws.String(prefixFilter)
@@ -39,10 +46,11 @@ func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount
 	}
 
 	// List objects in source bucket
-	paginator := s3.NewListObjectsV2Paginator(s3client, &s3.ListObjectsV2Input{
-		Bucket:    aws.String(srcBucket),
-		Prefix:    prefix,
-		Delimiter: slash,
+	paginator := s3.NewListObjectsV2Paginator(srcS3client, &s3.ListObjectsV2Input{
+		Bucket:       aws.String(srcBucket),
+		Prefix:       prefix,
+		Delimiter:    slash,
+		RequestPayer: requestPayer(s3RequesterPays),
 	})
 
 	// Open metadata.json for writing
@@ -56,7 +64,7 @@ func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount
 
 	// Ensure the metadata file is closed and flushed properly
 	defer func() {
-		log.Println("Writing out metadata file")
+		Infof("Writing out metadata file")
 		if err := metadataBuf.Flush(); err != nil {
 			log.Fatalln("Error writing metadata,", err)
 		}
@@ -78,6 +86,11 @@ func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount
 			if obj.Key == nil || obj.Size == nil {
 				continue
 			}
+			entry := MetaEntry{Key: *obj.Key, Size: *obj.Size, LastModified: obj.LastModified,
+				ETag: strings.Trim(aws.ToString(obj.ETag), `"`)}
+			if !entrySelected(&entry) {
+				continue
+			}
 
 			// Count objects and accumulate total size
 			objectCount++
@@ -85,7 +98,7 @@ func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount
 
 			// Write metadata line
 			// Format: {"name":"object_key","size":object_size}
-			dat, _ := json.Marshal(MetaEntry{Key: *obj.Key, Size: *obj.Size})
+			dat, _ := json.Marshal(entry)
 			metadataBuf.Write(dat)
 			metadataBuf.WriteByte('\n')
 		}
@@ -94,15 +107,15 @@ func loadMetadata(ctx context.Context, srcBucket string) (totalSize, objectCount
 	// Write summary metadata
 	summaryLine := fmt.Sprintf(`{"total_objects":%d,"total_size":%d}`+"\n", objectCount, totalSize)
 	metadataBuf.WriteString(summaryLine)
-	log.Printf("Metadata written: %d objects, total size %d bytes\n", objectCount, totalSize)
+	Infof("Metadata written: %d objects, total size %d bytes\n", objectCount, totalSize)
 
-	log.Println("Metadata file created successfully:", metadataFileName)
+	Infof("Metadata file created successfully: %s", metadataFileName)
 	// Print summary
-	log.Printf("Total objects: %d, Total size: %d bytes\n", objectCount, totalSize)
+	Infof("Total objects: %d, Total size: %d bytes\n", objectCount, totalSize)
 	if objectCount == 0 {
-		log.Println("No objects found in the source bucket.")
+		Infof("No objects found in the source bucket.")
 	} else {
-		log.Printf("Metadata file %s created with %d objects and total size %d bytes.\n", metadataFileName, objectCount, totalSize)
+		Infof("Metadata file %s created with %d objects and total size %d bytes.\n", metadataFileName, objectCount, totalSize)
 	}
 
 	return
@@ -119,7 +132,7 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 		f.Close()
 	}
 
-	log.Println("Reading in", metadataFileName, "for processing...")
+	Infof("Reading in %s for processing...", metadataFileName)
 	defer close(doFiles)
 
 	// Open metadata file and parse each line for file size and name
@@ -149,9 +162,7 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 		lineNumber := 0
 		strider := 0
 		for scanner.Scan() {
-			if debug {
-				log.Println("scanned:", scanner.Text())
-			}
+			Debugf("scanned: %s", scanner.Text())
 			lineNumber++
 			if start > 0 {
 				start--
@@ -172,7 +183,7 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 			var entry MetaEntry
 			line := scanner.Bytes()
 			if err := json.Unmarshal(line, &entry); err != nil {
-				log.Printf("failed to unmarshal line %q: %v", line, err)
+				Warnf("failed to unmarshal line %q: %v", line, err)
 				break // likely EOF or malformed line
 			}
 			if entry.Key == "" {
@@ -186,16 +197,13 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 	metadataFile.Seek(io.SeekStart, 0) // Back the the start
 
 	scanner := bufio.NewScanner(metadataFile)
-	if debug {
-		log.Println("start:", start, "stride:", stride, "end:", end)
-	}
+	Debugf("start: %d stride: %d end: %d", start, stride, end)
 
+	var sorted []*DownloadTask // With REPRODUCIBLE
 	lineNumber := 0
 	strider := 0
 	for scanner.Scan() {
-		if debug {
-			log.Println("scanned:", scanner.Text())
-		}
+		Debugf("scanned: %s", scanner.Text())
 		lineNumber++
 		if start > 0 {
 			start--
@@ -216,32 +224,80 @@ func ReadMetadata(ctx context.Context, doFiles chan<- *DownloadTask) {
 		var entry MetaEntry
 		line := scanner.Bytes()
 		if err := json.Unmarshal(line, &entry); err != nil {
-			log.Printf("failed to unmarshal line %q: %v", line, err)
+			Warnf("failed to unmarshal line %q: %v", line, err)
 			break // likely EOF or malformed line
 		}
 		if entry.Key == "" {
 			break
 		}
+		if !entrySelected(&entry) {
+			Debugf("skipping unselected: %#v\n", entry)
+			atomic.AddInt64(&TotalBytes, -entry.Size)
+			atomic.AddInt64(&TotalFiles, -1)
+			continue
+		}
 		if _, ok := skipFiles[entry.Key]; ok {
-			if debug {
-				log.Printf("skipping dup: %#v\n", entry)
-			}
+			Debugf("skipping dup: %#v\n", entry)
 			atomic.AddInt64(&TotalBytes, -entry.Size)
 			atomic.AddInt64(&TotalFiles, -1)
 			continue
 		}
-
-		if debug {
-			log.Println("sending:", scanner.Text())
+		if jobStateSkip(entry.Key, entry.ETag) {
+			Debugf("skipping uploaded before resuming: %#v\n", entry)
+			atomic.AddInt64(&TotalBytes, -entry.Size)
+			atomic.AddInt64(&TotalFiles, -1)
+			continue
 		}
+		if prior, ok := priorArchived(&entry); ok {
+			Debugf("skipping archived in %s: %#v\n", prior.Archive, entry)
+			atomic.AddInt64(&TotalBytes, -entry.Size)
+			atomic.AddInt64(&TotalFiles, -1)
+			archiveManifest.add(prior) // Kept so the new manifest covers everything
+			continue
+		}
+
+		Debugf("sending: %s", scanner.Text())
 
-		if debug {
-			log.Printf("sent task: %#v\n", entry)
+		task := &DownloadTask{Filename: entry.Key, Size: entry.Size, VersionID: entry.VersionID, ETag: entry.ETag}
+		if entry.LastModified != nil {
+			task.LastModified = *entry.LastModified
+		}
+		if reproducible {
+			// Every task is needed before the first can be sent
+			sorted = append(sorted, task)
+			continue
+		}
+		Debugf("sent task: %#v\n", entry)
+		if !sendTask(ctx, doFiles, task) {
+			return
 		}
-		doFiles <- &DownloadTask{Filename: entry.Key, Size: entry.Size}
 	}
 
 	if err := scanner.Err(); err != nil {
 		log.Fatalf("error reading metadata file: %v", err)
 	}
+
+	// Archives come out the same for the same keys when they are in key order
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Filename != sorted[j].Filename {
+			return sorted[i].Filename < sorted[j].Filename
+		}
+		return sorted[i].VersionID < sorted[j].VersionID
+	})
+	for _, task := range sorted {
+		if !sendTask(ctx, doFiles, task) {
+			return
+		}
+	}
+}
+
+// sendTask delivers task to doFiles unless the context is cancelled first.
+func sendTask(ctx context.Context, doFiles chan<- *DownloadTask, task *DownloadTask) bool {
+	select {
+	case doFiles <- task:
+		return true
+	case <-ctx.Done():
+		Infof("Stopped reading %s", metadataFileName)
+		return false
+	}
 }
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
@@ -35,13 +35,13 @@ func StartMetrics(ctx context.Context) {
 	var (
 		lastBytes, lastUpBytes int64
 		lastTime               = time.Now()
-		startTime              = time.Now()
 	)
+	downloadRate = newRateWindow(downloadRateSpan, lastTime, atomic.LoadInt64(&DownloadedBytes))
 
 	metricsTicker = time.NewTicker(100 * time.Millisecond)
 	go func() {
 		//defer metricsTicker.Stop()
-		log.Println("Starting metrics...")
+		Infof("Starting metrics...")
 		for {
 			select {
 			case <-ctx.Done():
@@ -52,32 +52,25 @@ func StartMetrics(ctx context.Context) {
 				curUpBytes := atomic.LoadInt64(&UploadedBytes)
 				now := time.Now()
 				elapsed := now.Sub(lastTime)
+				downloadRate.add(now, curBytes)
 
 				statsMutex.Lock()
 				lastlen := len(statsLine)
 
-				var remaining string
-				if DownloadedBytes > 0 && TotalBytes > 0 && DownloadedBytes < TotalBytes {
-					elapsedTime := now.Sub(startTime)
-					rate := float64(DownloadedBytes) / elapsedTime.Seconds()
-					if rate > 0 {
-						remainingBytes := TotalBytes - DownloadedBytes
-						remainingSeconds := float64(remainingBytes) / rate
-						remainingDuration := time.Duration(remainingSeconds * float64(time.Second))
-						remaining = fmt.Sprintf("ETA: ~%s", remainingDuration.Round(time.Minute))
+				remaining := "ETA: N/A"
+				if d, ok := downloadRate.eta(TotalBytes - curBytes); ok && TotalBytes > 0 {
+					if d < time.Minute {
+						remaining = fmt.Sprintf("ETA: ~%s", d.Round(time.Second))
 					} else {
-						remaining = "ETA: N/A"
+						remaining = strings.TrimSuffix(fmt.Sprintf("ETA: ~%s", d.Round(time.Minute)), "0s")
 					}
-				} else {
-					remaining = "ETA: N/A"
 				}
-				remaining = strings.TrimSuffix(remaining, "0s")
 
 				statsLine = fmt.Sprintf("Download: %d/%d %s/%s (%s)  Scanned: %d  Upload: %d with %d %s (%s) %s",
 					// #/#
 					DownloadedFiles, TotalFiles,
 					// #/#
-					humanizeBytes(DownloadedBytes), humanizeBytes(TotalBytes),
+					humanizeBytes(curBytes), humanizeBytes(TotalBytes),
 					// ( )
 					humanizeRate(curBytes-lastBytes, elapsed),
 					// Scanned:
@@ -91,9 +84,12 @@ func StartMetrics(ctx context.Context) {
 					//
 					remaining)
 
-				fmt.Fprintf(os.Stderr, "\r%s", statsLine)
-				for i := len(statsLine); i < lastlen; i++ {
-					fmt.Fprintf(os.Stderr, " ")
+				if !jsonLogs {
+					// The status line would break up the JSON records
+					fmt.Fprintf(os.Stderr, "\r%s", statsLine)
+					for i := len(statsLine); i < lastlen; i++ {
+						fmt.Fprintf(os.Stderr, " ")
+					}
 				}
 
 				statsMutex.Unlock()
@@ -106,7 +102,15 @@ func StartMetrics(ctx context.Context) {
 	}()
 }
 
+// Println logs an info message, clearing the status line first in text mode.
 func Println(v ...any) {
+	if !logger.Enabled(context.Background(), slog.LevelInfo) {
+		return
+	}
+	if jsonLogs {
+		logger.Info(logLine(v...))
+		return
+	}
 	statsMutex.Lock()
 
 	fmt.Fprintf(os.Stderr, "\r%s\r", spaces(len(statsLine)))
@@ -125,7 +129,7 @@ func spaces(i int) (s string) {
 
 func StopMetrics() {
 	if metricsTicker != nil {
-		log.Println("Metrics stopped...")
+		Infof("Metrics stopped...")
 		metricsTicker.Stop()
 	}
 }
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// mmapSupported reports whether TEMP_FILE_MMAP can map files here.
+const mmapSupported = false
+
+// openMapped is not supported here, so the file is read as usual.
+func openMapped(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
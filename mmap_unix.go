@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+)
+
+// mmapSupported reports whether TEMP_FILE_MMAP can map files here.
+const mmapSupported = true
+
+// mappedFile reads a file through a read-only memory map of it.
+type mappedFile struct {
+	*bytes.Reader
+	data []byte
+}
+
+// Close unmaps the file, after which its contents can't be read.
+func (m *mappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
+
+// openMapped opens the file at path to be read through a memory map.  A file
+// that can't be mapped, such as an empty one, is read as usual instead.
+func openMapped(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 || int64(int(size)) != size {
+		return f, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		Debugf("Reading %s without a memory map: %v", path, err)
+		return f, nil
+	}
+	f.Close() // The map keeps the contents
+	return &mappedFile{Reader: bytes.NewReader(data), data: data}, nil
+}
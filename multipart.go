@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var (
+	uploadPartSize    = int64(EnvInt("UPLOAD_PART_SIZE", 10*1024*1024, "Size in bytes of each part of an archive upload"))
+	uploadConcurrency = EnvInt("UPLOAD_CONCURRENCY", 8, "Parts of an archive uploaded at once")
+	uploadRetryMax    = EnvInt("UPLOAD_RETRY_MAX", 3, "Maximum attempts for each request of an archive upload")
+
+	destStorageClass = types.StorageClass(Env("DEST_STORAGE_CLASS", "STANDARD", "Storage class of the uploaded archives"))
+	destSSE          = types.ServerSideEncryption(Env("DEST_SSE", "", "Server-side encryption of the uploaded archives, AES256 or aws:kms"))
+	destSSEKMSKeyID  = Env("DEST_SSE_KMS_KEY_ID", "", "KMS key for aws:kms encryption of the uploaded archives")
+)
+
+// checkUploadSettings validates the archive upload settings.
+func checkUploadSettings() {
+	switch {
+	case uploadPartSize < minUploadPartSize:
+		log.Fatalf("UPLOAD_PART_SIZE value %d is too small; must be at least %d bytes", uploadPartSize, minUploadPartSize)
+	case uploadConcurrency < 1:
+		log.Fatalf("UPLOAD_CONCURRENCY value %d is too small; must be at least 1", uploadConcurrency)
+	case uploadRetryMax < 1:
+		log.Fatalf("UPLOAD_RETRY_MAX value %d is too small; must be at least 1", uploadRetryMax)
+	case !slices.Contains(destStorageClass.Values(), destStorageClass):
+		log.Fatalf("DEST_STORAGE_CLASS %q is unknown; must be one of %v", destStorageClass, destStorageClass.Values())
+	case destSSE != "" && !slices.Contains(destSSE.Values(), destSSE):
+		log.Fatalf("DEST_SSE %q is unknown; must be one of %v", destSSE, destSSE.Values())
+	case destSSEKMSKeyID != "" && destSSE != types.ServerSideEncryptionAwsKms && destSSE != types.ServerSideEncryptionAwsKmsDsse:
+		log.Fatalf("DEST_SSE_KMS_KEY_ID needs DEST_SSE set to aws:kms or aws:kms:dsse")
+	}
+}
+
+// kmsKeyID returns DEST_SSE_KMS_KEY_ID to send with an upload, or nil for
+// the bucket's default key.
+func kmsKeyID() *string {
+	if destSSEKMSKeyID == "" {
+		return nil
+	}
+	return aws.String(destSSEKMSKeyID)
+}
+
+// multipartUpload is an S3 multipart upload in progress.  Parts may be sent
+// from several goroutines at once.
+type multipartUpload struct {
+	client   *s3.Client
+	bucket   string
+	key      string
+	uploadID *string
+
+	mu    sync.Mutex
+	parts []types.CompletedPart
+}
+
+// startMultipartUpload creates a multipart upload of key to bucket through
+// client, with the metadata in meta if set, and the tags and retention of
+// archive if it is one.
+func startMultipartUpload(ctx context.Context, client *s3.Client, bucket, key string, meta *ObjectMeta, archive *archiveUpload) (*multipartUpload, error) {
+	var out *s3.CreateMultipartUploadOutput
+	err := withRetry(ctx, uploadRetryMax, func() (err error) {
+		out, err = client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:                    aws.String(bucket),
+			Key:                       aws.String(key),
+			ContentType:               uploadContentType(meta),
+			Metadata:                  uploadMetadata(meta),
+			StorageClass:              destStorageClass,
+			ServerSideEncryption:      destSSE,
+			SSEKMSKeyId:               kmsKeyID(),
+			Tagging:                   archive.tagging(),
+			ObjectLockMode:            archive.lockMode(),
+			ObjectLockRetainUntilDate: archive.retainUntil(),
+			ChecksumAlgorithm:         uploadChecksumAlgorithm(),
+			ChecksumType:              uploadChecksumType(),
+		})
+		return err
+	})
+	if isObjectLockMissing(err) {
+		return nil, fmt.Errorf("failed to start upload of %s: %s doesn't have Object Lock enabled, which OBJECT_LOCK_MODE needs: %w", key, bucket, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+	u := &multipartUpload{client: client, bucket: bucket, key: key, uploadID: out.UploadId}
+	openUploads.Lock()
+	openUploads.uploads[u] = struct{}{}
+	openUploads.Unlock()
+	return u, nil
+}
+
+// openUploads holds the multipart uploads started and not yet completed or
+// aborted, for abortOpenUploads.
+var openUploads = struct {
+	sync.Mutex
+	uploads map[*multipartUpload]struct{}
+}{uploads: make(map[*multipartUpload]struct{})}
+
+// closeUpload forgets u as open, and reports whether it was, so an upload is
+// only ever aborted once.
+func closeUpload(u *multipartUpload) bool {
+	openUploads.Lock()
+	defer openUploads.Unlock()
+	_, ok := openUploads.uploads[u]
+	delete(openUploads.uploads, u)
+	return ok
+}
+
+// abortOpenUploads aborts every multipart upload still open, so a fatal
+// error doesn't leave their parts in the bucket to be billed.
+func abortOpenUploads() {
+	openUploads.Lock()
+	uploads := slices.Collect(maps.Keys(openUploads.uploads))
+	openUploads.Unlock()
+	for _, u := range uploads {
+		u.abort()
+	}
+}
+
+// fatalf aborts the open multipart uploads and stops like log.Fatalf.  It is
+// used where an upload may be under way, such as writing a streamed archive.
+func fatalf(format string, v ...any) {
+	abortOpenUploads()
+	log.Fatalf(format, v...)
+}
+
+// uploadPart sends body as part number partNumber, rewinding it for each
+// retry.
+func (u *multipartUpload) uploadPart(ctx context.Context, partNumber int32, body io.ReadSeeker, size int64) error {
+	var out *s3.UploadPartOutput
+	err := withRetry(ctx, uploadRetryMax, func() (err error) {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		out, err = u.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            aws.String(u.bucket),
+			Key:               aws.String(u.key),
+			UploadId:          u.uploadID,
+			PartNumber:        aws.Int32(partNumber),
+			Body:              body,
+			ContentLength:     aws.Int64(size),
+			ChecksumAlgorithm: uploadChecksumAlgorithm(),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d of %s: %w", partNumber, u.key, err)
+	}
+	atomic.AddInt64(&UploadedBytes, size)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.parts = append(u.parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(partNumber),
+		ChecksumCRC32C: out.ChecksumCRC32C})
+	return nil
+}
+
+// copyPart copies the inclusive byte range start to end of source, a
+// CopySource, as part number partNumber.
+func (u *multipartUpload) copyPart(ctx context.Context, partNumber int32, source string, start, end int64) error {
+	var out *s3.UploadPartCopyOutput
+	err := withRetry(ctx, uploadRetryMax, func() (err error) {
+		out, err = u.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(u.bucket),
+			Key:             aws.String(u.key),
+			UploadId:        u.uploadID,
+			PartNumber:      aws.Int32(partNumber),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy part %d of %s: %w", partNumber, u.key, err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.parts = append(u.parts, types.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int32(partNumber),
+		ChecksumCRC32C: out.CopyPartResult.ChecksumCRC32C})
+	return nil
+}
+
+// complete finishes the upload from the parts sent.
+func (u *multipartUpload) complete(ctx context.Context) error {
+	u.mu.Lock()
+	parts := append([]types.CompletedPart(nil), u.parts...)
+	u.mu.Unlock()
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+
+	err := withRetry(ctx, uploadRetryMax, func() error {
+		_, err := u.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(u.bucket),
+			Key:             aws.String(u.key),
+			UploadId:        u.uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+			ChecksumType:    uploadChecksumType(),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", u.key, err)
+	}
+	closeUpload(u)
+	return nil
+}
+
+// abort cancels the upload so the parts sent so far aren't kept, and billed,
+// by S3.  It runs even if ctx was cancelled, and only once.
+func (u *multipartUpload) abort() {
+	if !closeUpload(u) {
+		return
+	}
+	err := withRetry(context.Background(), uploadRetryMax, func() error {
+		_, err := u.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(u.bucket),
+			Key:      aws.String(u.key),
+			UploadId: u.uploadID,
+		})
+		return err
+	})
+	if err != nil {
+		Warnf("failed to abort upload of %s: %v", u.key, err)
+	}
+}
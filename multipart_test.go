@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestUploadAbortedOnce(t *testing.T) {
+	// The client is nil, so aborting an upload that isn't open would panic
+	closed := &multipartUpload{key: "closed"}
+	closed.abort()
+
+	u := &multipartUpload{key: "open"}
+	openUploads.Lock()
+	openUploads.uploads[u] = struct{}{}
+	openUploads.Unlock()
+	if !closeUpload(u) {
+		t.Fatal("open upload wasn't found")
+	}
+	if closeUpload(u) {
+		t.Fatal("upload was closed twice")
+	}
+	u.abort()
+	abortOpenUploads()
+}
+
+// fakeUploadServer answers the requests of an archive upload, and records
+// the headers of the ones that create an object.
+type fakeUploadServer struct {
+	mu      sync.Mutex
+	created []http.Header // Of each PutObject and CreateMultipartUpload
+	parts   int
+}
+
+func (s *fakeUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	q := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		s.parts++
+		w.Header().Set("ETag", `"part"`)
+	case r.Method == http.MethodPut:
+		s.created = append(s.created, r.Header.Clone())
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		s.created = append(s.created, r.Header.Clone())
+		io.WriteString(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>up1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPost:
+		io.WriteString(w, `<CompleteMultipartUploadResult><ETag>"object-2"</ETag></CompleteMultipartUploadResult>`)
+	}
+}
+
+// newFakeUploadClient returns a client sending its requests to s.
+func newFakeUploadClient(t *testing.T, s http.Handler) *s3.Client {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "us-east-1",
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+func TestUploadSSE(t *testing.T) {
+	defer func(sse types.ServerSideEncryption, key string, size int64) {
+		destSSE, destSSEKMSKeyID, uploadPartSize = sse, key, size
+	}(destSSE, destSSEKMSKeyID, uploadPartSize)
+	destSSE, destSSEKMSKeyID, uploadPartSize = types.ServerSideEncryptionAwsKms, "alias/archives", minUploadPartSize
+
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name  string
+		size  int64
+		parts int
+	}{
+		{"single part", 1024, 0},
+		{"multipart", minUploadPartSize + 1024, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, make([]byte, tt.size), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s := &fakeUploadServer{}
+			if err := uploadFileInParts(context.Background(), newFakeUploadClient(t, s), "bucket", "key", path, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if len(s.created) != 1 || s.parts != tt.parts {
+				t.Fatalf("created %d objects in %d parts, want 1 in %d", len(s.created), s.parts, tt.parts)
+			}
+			h := s.created[0]
+			if got := h.Get("X-Amz-Server-Side-Encryption"); got != "aws:kms" {
+				t.Errorf("got server-side encryption %q, want aws:kms", got)
+			}
+			if got := h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"); got != "alias/archives" {
+				t.Errorf("got KMS key %q, want alias/archives", got)
+			}
+		})
+	}
+}
+
+func TestStreamPartSizeGrowth(t *testing.T) {
+	defer func(size int) { streamPartSize = size }(streamPartSize)
+	streamPartSize = minUploadPartSize
+	if got := streamPartSizeFor(streamPartGrowth); got != minUploadPartSize {
+		t.Errorf("part %d is %d bytes, want STREAM_PART_SIZE", streamPartGrowth, got)
+	}
+	var total int64
+	for n := int32(1); n <= maxPartCount; n++ {
+		size := streamPartSizeFor(n)
+		if size < minUploadPartSize || size > maxUploadPartSize {
+			t.Fatalf("part %d is %d bytes", n, size)
+		}
+		total += int64(size)
+	}
+	if total < 5<<40 {
+		t.Errorf("%d parts hold %d bytes, less than 5 TiB", maxPartCount, total)
+	}
+}
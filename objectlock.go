@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+var (
+	objectLockMode        = types.ObjectLockMode(Env("OBJECT_LOCK_MODE", "", "Object Lock mode of the uploaded archives, GOVERNANCE or COMPLIANCE, off if empty"))
+	objectLockRetainUntil = Env("OBJECT_LOCK_RETAIN_UNTIL", "", "Date the uploaded archives are locked until, with OBJECT_LOCK_MODE")
+	objectLockDays        = EnvInt("OBJECT_LOCK_DAYS", 0, "Days each uploaded archive is locked for from its upload, with OBJECT_LOCK_MODE")
+
+	// objectLockUntil is OBJECT_LOCK_RETAIN_UNTIL parsed.
+	objectLockUntil time.Time
+)
+
+// archiveUpload is what an archive is uploaded with besides its contents:
+// its tags and, with OBJECT_LOCK_MODE, its retention.  Other uploads, such as
+// restored objects, pass nil.
+type archiveUpload struct {
+	Tagging string // With ARCHIVE_TAGS
+}
+
+// tagging returns the tags to send with the upload, or nil for none.
+func (u *archiveUpload) tagging() *string {
+	if u == nil || u.Tagging == "" {
+		return nil
+	}
+	return aws.String(u.Tagging)
+}
+
+// lockMode returns the Object Lock mode to send with the upload.
+func (u *archiveUpload) lockMode() types.ObjectLockMode {
+	if u == nil {
+		return ""
+	}
+	return objectLockMode
+}
+
+// retainUntil returns the date to lock the upload until, counted from now
+// with OBJECT_LOCK_DAYS, or nil without OBJECT_LOCK_MODE.
+func (u *archiveUpload) retainUntil() *time.Time {
+	switch {
+	case u == nil || objectLockMode == "":
+		return nil
+	case objectLockDays > 0:
+		return aws.Time(time.Now().AddDate(0, 0, objectLockDays).UTC())
+	}
+	return aws.Time(objectLockUntil)
+}
+
+// checkObjectLock validates the Object Lock settings, and that DST_BUCKET
+// has Object Lock enabled, which S3 only allows when the bucket is created.
+func checkObjectLock(ctx context.Context) {
+	if objectLockMode == "" {
+		if objectLockRetainUntil != "" || objectLockDays != 0 {
+			log.Fatalf("OBJECT_LOCK_RETAIN_UNTIL and OBJECT_LOCK_DAYS need OBJECT_LOCK_MODE")
+		}
+		return
+	}
+	var err error
+	switch {
+	case !slices.Contains(objectLockMode.Values(), objectLockMode):
+		log.Fatalf("OBJECT_LOCK_MODE %q is unknown; must be one of %v", objectLockMode, objectLockMode.Values())
+	case dstDir != "":
+		log.Fatalf("OBJECT_LOCK_MODE can't be used with DST_DIR, as the archives aren't uploaded")
+	case objectLockRetainUntil != "" && objectLockDays != 0:
+		log.Fatalf("OBJECT_LOCK_RETAIN_UNTIL and OBJECT_LOCK_DAYS are both set; use only one")
+	case objectLockDays < 0:
+		log.Fatalf("OBJECT_LOCK_DAYS value %d is invalid; must be 1 or more", objectLockDays)
+	case objectLockRetainUntil == "" && objectLockDays == 0:
+		log.Fatalf("OBJECT_LOCK_MODE needs OBJECT_LOCK_RETAIN_UNTIL or OBJECT_LOCK_DAYS")
+	case objectLockRetainUntil != "":
+		if objectLockUntil, err = parseFilterTime(objectLockRetainUntil); err != nil {
+			log.Fatalf("failed to parse OBJECT_LOCK_RETAIN_UNTIL: %v", err)
+		} else if !objectLockUntil.After(time.Now()) {
+			log.Fatalf("OBJECT_LOCK_RETAIN_UNTIL %s has passed", objectLockRetainUntil)
+		}
+	}
+
+	_, err = dstClient().GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{Bucket: aws.String(dstBucket)})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ObjectLockConfigurationNotFoundError" {
+		log.Fatalf("DST_BUCKET %s doesn't have Object Lock enabled, which OBJECT_LOCK_MODE needs; it can only be enabled when the bucket is created", dstBucket)
+	} else if err != nil {
+		// Such as without s3:GetBucketObjectLockConfiguration; the uploads tell
+		Warnf("Couldn't check that DST_BUCKET %s has Object Lock enabled: %v", dstBucket, err)
+	}
+}
+
+// isObjectLockMissing reports whether err is S3 refusing a locked upload to a
+// bucket without Object Lock.
+func isObjectLockMissing(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRequest" &&
+		strings.Contains(apiErr.ErrorMessage(), "Object Lock")
+}
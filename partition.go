@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+var (
+	partitionDepth   = EnvInt("PARTITION_DEPTH", 0, "Write the keys under each prefix of this many path components to their own archives, 0 to disable")
+	partitionMaxOpen = EnvInt("PARTITION_MAX_OPEN", 16, "Partition archives open at once before the least recently written is finished")
+)
+
+// checkPartitionSettings validates the partitioning settings before any work
+// starts.
+func checkPartitionSettings() {
+	switch {
+	case partitionDepth < 0:
+		log.Fatalf("PARTITION_DEPTH value %d is invalid; must be 0 or more", partitionDepth)
+	case partitionMaxOpen < 1:
+		log.Fatalf("PARTITION_MAX_OPEN value %d is too small; must be at least 1", partitionMaxOpen)
+	}
+}
+
+// partitionKey returns the partition of key: its first PARTITION_DEPTH
+// directories, so with a depth of 2 "2023/01/a.log" is in "2023/01".  Keys
+// with fewer directories are in the partition of the ones they have, and
+// everything is in "" without PARTITION_DEPTH.
+func partitionKey(key string) string {
+	if partitionDepth == 0 {
+		return ""
+	}
+	dirs := strings.Split(key, "/")
+	dirs = dirs[:len(dirs)-1] // The last component is the file name
+	if len(dirs) > partitionDepth {
+		dirs = dirs[:partitionDepth]
+	}
+	return strings.Join(dirs, "/")
+}
+
+// openArchives holds the archive being written for each partition, least
+// recently written first.  Listings come sorted by key, so the partition
+// written longest ago has most likely seen all of its keys.
+type openArchives struct {
+	list []*tarArchive
+}
+
+func newOpenArchives() *openArchives {
+	return &openArchives{}
+}
+
+// get returns the open archive of partition, or nil if there is none, and
+// marks it as the most recently written.
+func (o *openArchives) get(partition string) *tarArchive {
+	for i, a := range o.list {
+		if a.partition == partition {
+			o.list = append(append(o.list[:i:i], o.list[i+1:]...), a)
+			return a
+		}
+	}
+	return nil
+}
+
+// put makes a the open archive of its partition, in place of any before it.
+func (o *openArchives) put(a *tarArchive) {
+	for i, old := range o.list {
+		if old.partition == a.partition {
+			o.list = append(o.list[:i], o.list[i+1:]...)
+			break
+		}
+	}
+	o.list = append(o.list, a)
+}
+
+// evict removes and returns the least recently written archive when
+// PARTITION_MAX_OPEN are open, to make room for another, or nil if there is
+// room already.
+func (o *openArchives) evict() *tarArchive {
+	if len(o.list) < partitionMaxOpen {
+		return nil
+	}
+	a := o.list[0]
+	o.list = o.list[1:]
+	return a
+}
+
+// takeAll removes and returns every open archive, least recently written
+// first.
+func (o *openArchives) takeAll() []*tarArchive {
+	list := o.list
+	o.list = nil
+	return list
+}
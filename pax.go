@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var preserveMetadata = Env("PRESERVE_METADATA", "", "Keep the content type and user metadata of each object in the archive") != ""
+
+// ObjectMeta is the content type, user metadata and modification time of an
+// object.
+type ObjectMeta struct {
+	ContentType  string
+	Metadata     map[string]string // User metadata, without the x-amz-meta- prefix
+	LastModified time.Time
+	Checksum     string // CHECKSUM_ALGORITHM checksum of the contents in base64, computed as they were downloaded
+}
+
+// The PAX records holding the object metadata, under a vendor prefix so
+// other tar tools leave them alone.
+const (
+	paxContentType = "S3ARCHIVER.content-type"
+	paxMetaPrefix  = "S3ARCHIVER.meta."
+)
+
+// paxRecords returns the PAX records for the entry of w, or nil if there is
+// nothing to keep.
+func paxRecords(w *WorkFile) map[string]string {
+	if !preserveMetadata || w.ContentType == "" && len(w.Metadata) == 0 {
+		return nil
+	}
+	records := make(map[string]string, len(w.Metadata)+1)
+	if w.ContentType != "" {
+		records[paxContentType] = w.ContentType
+	}
+	for k, v := range w.Metadata {
+		records[paxMetaPrefix+k] = v
+	}
+	return records
+}
+
+// metaFromPAX returns the object metadata kept in the PAX records of an
+// entry, or nil if there is none.
+func metaFromPAX(records map[string]string) *ObjectMeta {
+	var meta *ObjectMeta
+	for k, v := range records {
+		switch {
+		case k == paxContentType:
+			if meta == nil {
+				meta = &ObjectMeta{}
+			}
+			meta.ContentType = v
+		case strings.HasPrefix(k, paxMetaPrefix):
+			if meta == nil {
+				meta = &ObjectMeta{}
+			}
+			if meta.Metadata == nil {
+				meta.Metadata = make(map[string]string)
+			}
+			meta.Metadata[strings.TrimPrefix(k, paxMetaPrefix)] = v
+		}
+	}
+	return meta
+}
+
+// lastModifiedKey is the user metadata restored objects keep their original
+// modification time in, as S3 sets LastModified itself.
+const lastModifiedKey = "original-last-modified"
+
+// restoreMeta returns the metadata to restore the entry hdr to a bucket with:
+// the object metadata in its PAX records, if any, and its modification time.
+func restoreMeta(hdr *tar.Header) *ObjectMeta {
+	meta := metaFromPAX(hdr.PAXRecords)
+	if hdr.ModTime.Unix() <= 0 {
+		return meta // Written with REPRODUCIBLE, so not the object's time
+	}
+	if meta == nil {
+		meta = &ObjectMeta{}
+	}
+	metadata := maps.Clone(meta.Metadata)
+	if metadata == nil {
+		metadata = maps.Clone(virusScanMap)
+	}
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[lastModifiedKey] = hdr.ModTime.UTC().Format(time.RFC3339)
+	meta.Metadata = metadata
+	return meta
+}
+
+// uploadMetadata returns the user metadata to upload an object with: that of
+// the original object when restoring one, otherwise the scan results.
+func uploadMetadata(meta *ObjectMeta) map[string]string {
+	if meta == nil {
+		return virusScanMap
+	}
+	return meta.Metadata
+}
+
+// uploadContentType returns the content type to upload an object with, if
+// one is known.
+func uploadContentType(meta *ObjectMeta) *string {
+	if meta == nil || meta.ContentType == "" {
+		return nil
+	}
+	return aws.String(meta.ContentType)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	defer func(preserve bool) { preserveMetadata = preserve }(preserveMetadata)
+	preserveMetadata = true
+
+	modified := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	wf := &WorkFile{Filename: "docs/report.json", Size: 2, Bytes: []byte("{}"), LastModified: modified,
+		ContentType: "application/json",
+		Metadata:    map[string]string{"owner": "finance", "project": "q2 report", "review-state": "approved"}}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(tarHeader(wf, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(wf.Bytes)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := tar.NewReader(&buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := restoreMeta(hdr)
+	if meta == nil || meta.ContentType != wf.ContentType {
+		t.Fatalf("got metadata %+v, want content type %s", meta, wf.ContentType)
+	}
+	want := maps.Clone(wf.Metadata)
+	want[lastModifiedKey] = modified.Format(time.RFC3339)
+	if !maps.Equal(meta.Metadata, want) {
+		t.Errorf("got user metadata %v, want %v", meta.Metadata, want)
+	}
+
+	// Set on the object uploaded again
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := os.WriteFile(path, wf.Bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeUploadServer{}
+	if err := uploadFileInParts(context.Background(), newFakeUploadClient(t, s), "bucket", wf.Filename, path, meta, nil); err != nil {
+		t.Fatal(err)
+	}
+	h := s.created[0]
+	if got := h.Get("Content-Type"); got != wf.ContentType {
+		t.Errorf("uploaded with content type %q, want %s", got, wf.ContentType)
+	}
+	for k, v := range want {
+		if got := h.Get("X-Amz-Meta-" + k); got != v {
+			t.Errorf("uploaded with %s %q, want %q", k, got, v)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+var (
+	gzipWorkers      = EnvInt("GZIP_WORKERS", 1, "Goroutines compressing each gzip archive, more than 1 for parallel blocks")
+	gzipBlockSizeStr = Env("GZIP_BLOCK_SIZE", "1M", "Uncompressed size of the blocks compressed in parallel with GZIP_WORKERS")
+	gzipBlockSize    int64
+)
+
+// gzipWindow is how much of the block before each one is used as its
+// dictionary, the most deflate can refer back to.
+const gzipWindow = 32 * 1024
+
+// checkGzipSettings validates the parallel gzip settings.
+func checkGzipSettings() {
+	var err error
+	if gzipBlockSize, err = parseByteSize(gzipBlockSizeStr); err != nil {
+		log.Fatalf("failed to parse GZIP_BLOCK_SIZE: %v", err)
+	}
+	switch {
+	case gzipWorkers < 1:
+		log.Fatalf("GZIP_WORKERS value %d is too small; must be at least 1", gzipWorkers)
+	case gzipBlockSize < 2*gzipWindow:
+		log.Fatalf("GZIP_BLOCK_SIZE value %d is too small; must be at least %d bytes", gzipBlockSize, 2*gzipWindow)
+	}
+}
+
+// parallelGzipWriter writes a gzip stream compressed by several goroutines.
+// The input is cut into blocks that are deflated on their own, each with the
+// end of the block before as its dictionary and ending on a sync flush, so
+// joined in order they are one ordinary deflate stream in a single gzip
+// member that any gzip reader can read.
+type parallelGzipWriter struct {
+	w     io.Writer
+	level int
+	block []byte // Being filled
+	dict  []byte // The end of the block before
+	crc   uint32
+	size  uint32 // Modulo 2^32, as gzip records it
+
+	queue chan chan []byte // Compressed blocks, in order, at most GZIP_WORKERS ahead
+	done  chan struct{}    // Closed once every block is written to w
+
+	mu  sync.Mutex
+	err error // The first error writing to w
+}
+
+// newParallelGzipWriter returns a writer compressing to w at level with
+// blockSize blocks, workers at a time.  The gzip header carries no name or
+// time, like that of gzip.Writer.
+func newParallelGzipWriter(w io.Writer, level, workers int, blockSize int64) (*parallelGzipWriter, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	z := &parallelGzipWriter{
+		w:     w,
+		level: level,
+		block: make([]byte, 0, blockSize),
+		queue: make(chan chan []byte, workers),
+		done:  make(chan struct{}),
+	}
+	header := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255} // Deflate, no flags, no time, unknown OS
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	go z.writeBlocks(z.queue)
+	return z, nil
+}
+
+// Write buffers p, sending each block to be compressed as it fills.
+func (z *parallelGzipWriter) Write(p []byte) (int, error) {
+	if err := z.failed(); err != nil {
+		return 0, err
+	}
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	z.size += uint32(len(p))
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(z.block[len(z.block):cap(z.block)], p)
+		z.block = z.block[:len(z.block)+c]
+		p = p[c:]
+		if len(z.block) == cap(z.block) {
+			z.send(false)
+		}
+	}
+	return n, nil
+}
+
+// send starts compressing the block filled so far, waiting while
+// GZIP_WORKERS blocks are ahead of it.
+func (z *parallelGzipWriter) send(last bool) {
+	out := make(chan []byte, 1)
+	z.queue <- out
+	go func(block, dict []byte) {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriterDict(&buf, z.level, dict) // The level was checked
+		fw.Write(block)
+		if last {
+			fw.Close()
+		} else {
+			fw.Flush() // Ends on a byte boundary for the next block
+		}
+		out <- buf.Bytes()
+	}(z.block, z.dict)
+	// The block isn't written to again, so its end can be the next dictionary
+	z.dict = z.block[max(0, len(z.block)-gzipWindow):]
+	z.block = make([]byte, 0, cap(z.block))
+}
+
+// writeBlocks writes the compressed blocks from queue to w in the order
+// they were sent.
+func (z *parallelGzipWriter) writeBlocks(queue <-chan chan []byte) {
+	defer close(z.done)
+	for out := range queue {
+		data := <-out
+		if z.failed() != nil {
+			continue // Drain the rest so send never blocks
+		}
+		if _, err := z.w.Write(data); err != nil {
+			z.mu.Lock()
+			z.err = err
+			z.mu.Unlock()
+		}
+	}
+}
+
+func (z *parallelGzipWriter) failed() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
+
+// Close compresses the last block and writes the gzip trailer.  It does not
+// close the underlying writer.
+func (z *parallelGzipWriter) Close() error {
+	if z.queue == nil {
+		return errors.New("gzip: writer already closed")
+	}
+	z.send(true)
+	close(z.queue)
+	z.queue = nil
+	<-z.done
+	if err := z.failed(); err != nil {
+		return err
+	}
+	trailer := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, z.crc), z.size)
+	_, err := z.w.Write(trailer)
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	stdgzip "compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestParallelGzip(t *testing.T) {
+	const blockSize = 2 * gzipWindow
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 5*blockSize+123)
+	rnd.Read(random)
+	inputs := map[string][]byte{
+		"empty":       {},
+		"short":       []byte("hello, world"),
+		"whole block": bytes.Repeat([]byte("a"), blockSize),
+		"repetitive":  bytes.Repeat([]byte("the same line over and over\n"), 20000),
+		"random":      random,
+	}
+	gzipPath, _ := exec.LookPath("gzip")
+	for name, input := range inputs {
+		for _, level := range []int{0, 1, 6, 9} {
+			t.Run(fmt.Sprintf("%s level %d", name, level), func(t *testing.T) {
+				var buf bytes.Buffer
+				z, err := newParallelGzipWriter(&buf, level, 4, blockSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Written in odd sizes, so blocks fill across writes
+				for p := input; len(p) > 0; {
+					n := min(len(p), 1000+rnd.Intn(blockSize))
+					if _, err := z.Write(p[:n]); err != nil {
+						t.Fatal(err)
+					}
+					p = p[n:]
+				}
+				if err := z.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				zr, err := stdgzip.NewReader(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, input) {
+					t.Fatalf("read back %d bytes, want %d", len(got), len(input))
+				}
+
+				if gzipPath == "" {
+					return
+				}
+				cmd := exec.Command(gzipPath, "-dc")
+				cmd.Stdin = bytes.NewReader(buf.Bytes())
+				out, err := cmd.Output()
+				if err != nil {
+					t.Fatalf("gzip -d: %v", err)
+				}
+				if !bytes.Equal(out, input) {
+					t.Fatalf("gzip -d read back %d bytes, want %d", len(out), len(input))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+var pprofAddr = Env("PPROF_ADDR", "", "Address to serve the Go profiler on at /debug/pprof/, such as localhost:6060, off if empty")
+
+// startPprof serves the net/http/pprof handlers on PPROF_ADDR, if set, for
+// taking heap and goroutine profiles of a running job.  It runs until the
+// process exits.
+func startPprof() {
+	if pprofAddr == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", pprofAddr)
+	if err != nil {
+		log.Fatalf("failed to listen on PPROF_ADDR: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index) // Also serves heap, goroutine, allocs and the like
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// No write timeout, as CPU profiles and traces take as long as asked
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			Errorf("pprof server stopped: %v", err)
+		}
+	}()
+	Infof("Serving pprof on http://%s/debug/pprof/", ln.Addr())
+}
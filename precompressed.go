@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+var (
+	storeCompressed      = Env("STORE_COMPRESSED", "", "Store files that are compressed already, such as JPEG or zip, without compressing them again") != ""
+	compressedExtensions = Env("COMPRESSED_EXTENSIONS", ".7z,.apk,.avif,.br,.bz2,.docx,.flac,.gif,.gz,.heic,.jar,.jpeg,.jpg,.lz4,.m4a,.m4v,.mkv,.mov,.mp3,.mp4,.ogg,.png,.pptx,.rar,.tgz,.webm,.webp,.xlsx,.xz,.zip,.zst",
+		"Extensions of the files STORE_COMPRESSED stores as they are")
+	compressedContentTypes = Env("COMPRESSED_CONTENT_TYPES", "application/gzip,application/x-gzip,application/zip,application/zstd,application/x-7z-compressed,application/x-bzip2,application/x-xz,application/vnd.rar,image/jpeg,image/png,image/gif,image/webp,image/avif,image/heic,audio/*,video/*",
+		"Content types of the files STORE_COMPRESSED stores as they are, with type/* for all of a type")
+)
+
+// isCompressed reports whether task looks compressed already, by its
+// extension or content type, so compressing it again would gain nothing.
+func isCompressed(task *WorkFile) bool {
+	if !storeCompressed {
+		return false
+	}
+	if ext := strings.ToLower(path.Ext(task.Filename)); ext != "" {
+		for _, e := range strings.Split(compressedExtensions, ",") {
+			if strings.EqualFold(strings.TrimSpace(e), ext) {
+				return true
+			}
+		}
+	}
+	ct, _, err := mime.ParseMediaType(task.ContentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range strings.Split(compressedContentTypes, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == ct || strings.HasSuffix(t, "/*") && strings.HasPrefix(ct, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// zstdMaxBlock is the largest block a zstd frame may hold.
+const zstdMaxBlock = 128 * 1024
+
+// zstdStoreWriter writes a zstd frame of raw blocks, which readers copy out
+// as they are, for files STORE_COMPRESSED leaves uncompressed.
+type zstdStoreWriter struct {
+	w       io.Writer
+	buf     []byte
+	started bool
+}
+
+func newZstdStoreWriter(w io.Writer) *zstdStoreWriter {
+	return &zstdStoreWriter{w: w, buf: make([]byte, 0, zstdMaxBlock)}
+}
+
+// Write writes p in raw blocks, holding back the last one for Close to mark.
+func (z *zstdStoreWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(z.buf) == zstdMaxBlock {
+			if err := z.writeBlock(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		c := copy(z.buf[len(z.buf):zstdMaxBlock], p)
+		z.buf = z.buf[:len(z.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// writeBlock writes the buffer as a raw block, after the frame header if it
+// is the first.
+func (z *zstdStoreWriter) writeBlock(last bool) error {
+	var hdr []byte
+	if !z.started {
+		// Magic number, no flags, and a window of 128 KiB to allow the
+		// largest blocks
+		hdr = append(hdr, 0x28, 0xb5, 0x2f, 0xfd, 0, 7<<3)
+		z.started = true
+	}
+	bh := uint32(len(z.buf)) << 3 // Block type 0 is raw
+	if last {
+		bh |= 1
+	}
+	hdr = append(hdr, byte(bh), byte(bh>>8), byte(bh>>16))
+	if _, err := z.w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := z.w.Write(z.buf)
+	z.buf = z.buf[:0]
+	return err
+}
+
+// Close writes the last block, ending the frame.  It does not close the
+// underlying writer.
+func (z *zstdStoreWriter) Close() error {
+	return z.writeBlock(true)
+}
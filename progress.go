@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+var progressInterval = Env("PROGRESS_INTERVAL", "", "How often to log a progress line, 0 to disable; 1m if stderr is a terminal")
+
+// progressEvery returns how often to log a progress line.  Unless
+// PROGRESS_INTERVAL says otherwise, that is every minute when stderr is a
+// terminal and never when it isn't.
+func progressEvery() (time.Duration, error) {
+	if progressInterval != "" {
+		return time.ParseDuration(progressInterval)
+	}
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return time.Minute, nil
+	}
+	return 0, nil
+}
+
+// progressWindow is how many intervals the throughput is averaged over.
+const progressWindow = 5
+
+// StartProgressReporter logs the download progress every interval until the
+// context is done.  The rate is taken over the last few intervals so it
+// follows the current speed rather than the average since the start.
+func StartProgressReporter(ctx context.Context, interval time.Duration, stats func() Stats) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		window := newRateWindow(progressWindow*interval, time.Now(), stats().DownloadedBytes)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				st := stats()
+				rate := window.add(now, st.DownloadedBytes)
+
+				done := st.DownloadedFiles + st.FailedFiles + st.SkippedFiles
+				remaining := TotalFiles - done
+				if remaining < 0 {
+					remaining = 0
+				}
+				eta := "N/A"
+				if d, ok := window.eta(TotalBytes - st.DownloadedBytes); ok {
+					eta = d.Round(time.Second).String()
+				}
+				Infof("Progress: %d done (%d failed, %d skipped), %d remaining, %s/s, ETA %s",
+					done, st.FailedFiles, st.SkippedFiles, remaining, humanizeBytes(int64(rate)), eta)
+			}
+		}
+	}()
+}
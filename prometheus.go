@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var metricsAddr = Env("METRICS_ADDR", "", "Address to serve Prometheus metrics on at /metrics, such as :9090, off if empty")
+
+// downloadDuration is how long each file took to download, from being picked
+// up to being handed on, and downloadThroughput the rate that came to, by
+// the path the file took: into memory or a temp file on disk.
+var (
+	downloadDuration = map[string]*histogram{
+		pathMemory: newHistogram(durationBounds),
+		pathDisk:   newHistogram(durationBounds),
+	}
+	downloadThroughput = map[string]*histogram{
+		pathMemory: newHistogram(throughputBounds),
+		pathDisk:   newHistogram(throughputBounds),
+	}
+
+	durationBounds   = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+	throughputBounds = []float64{64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+)
+
+// histogram counts observations into buckets with the upper bounds given,
+// as a Prometheus histogram.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // In each bucket, with the last one for +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe adds v to the histogram.
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+}
+
+// write writes the histogram in the Prometheus text format, with the bucket
+// counts made cumulative and path as a label.
+func (h *histogram) write(w io.Writer, name, path string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var total uint64
+	for i, n := range h.counts {
+		total += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{path=%q,le=%q} %d\n", name, path, le, total)
+	}
+	fmt.Fprintf(w, "%s_sum{path=%q} %s\n%s_count{path=%q} %d\n", name, path, formatFloat(h.sum), name, path, total)
+}
+
+// writeHistograms writes a histogram for each download path under one name.
+func writeHistograms(w io.Writer, name, help string, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, path := range []string{pathMemory, pathDisk} {
+		hs[path].write(w, name, path)
+	}
+}
+
+// StartMetricsServer serves the counters of the run and the Downloader's
+// stats on METRICS_ADDR, if set, until ctx is done.  An address that can't
+// be listened on stops the run.
+func StartMetricsServer(ctx context.Context, stats func() Stats) {
+	if metricsAddr == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", metricsAddr)
+	if err != nil {
+		log.Fatalf("failed to listen on METRICS_ADDR: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, stats())
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			Errorf("metrics server stopped: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	Infof("Serving metrics on http://%s/metrics", ln.Addr())
+}
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func writeMetrics(w io.Writer, st Stats) {
+	metric := func(name, kind, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, v)
+	}
+	metric("s3archiver_source_files", "gauge", "Files to download in all.", atomic.LoadInt64(&TotalFiles))
+	metric("s3archiver_source_bytes", "gauge", "Bytes to download in all.", atomic.LoadInt64(&TotalBytes))
+	metric("s3archiver_downloaded_files_total", "counter", "Files downloaded and handed on to be archived.", st.DownloadedFiles)
+	metric("s3archiver_downloaded_bytes_total", "counter", "Bytes read from the source, including retried reads.", st.DownloadedBytes)
+	metric("s3archiver_failed_files_total", "counter", "Files that failed and were sent to the error log.", st.FailedFiles)
+	metric("s3archiver_failed_bytes_total", "counter", "Size of the files that failed.", st.FailedBytes)
+	metric("s3archiver_skipped_files_total", "counter", "Files skipped as gone by the time they were downloaded.", st.SkippedFiles)
+	metric("s3archiver_unverified_files_total", "counter", "Resumed downloads that couldn't be checked against their ETag.", st.UnverifiedFiles)
+	metric("s3archiver_scanned_files_total", "counter", "Files scanned for viruses.", atomic.LoadInt64(&ScannedFiles))
+	metric("s3archiver_uploaded_archives_total", "counter", "Archives uploaded.", atomic.LoadInt64(&UploadedFiles))
+	metric("s3archiver_uploaded_archived_files_total", "counter", "Files in the archives uploaded.", atomic.LoadInt64(&UploadedArchivedFiles))
+	metric("s3archiver_uploaded_bytes_total", "counter", "Bytes uploaded to the destination.", atomic.LoadInt64(&UploadedBytes))
+	metric("s3archiver_inflight_files", "gauge", "Files being downloaded right now.", st.InFlight)
+	metric("s3archiver_inflight_parts", "gauge", "Download parts being fetched right now.", st.InFlightParts)
+	metric("s3archiver_memory_held_bytes", "gauge", "Bytes of downloaded files held in memory, counted when MAX_INFLIGHT_MEM_BYTES is set.", memBudget.inUse())
+	writeHistograms(w, "s3archiver_download_duration_seconds", "Time taken to download each file.", downloadDuration)
+	writeHistograms(w, "s3archiver_download_throughput_bytes_per_second", "Rate each file was downloaded at, over the time it took.", downloadThroughput)
+}
+
+// formatFloat formats v as Prometheus expects it.
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
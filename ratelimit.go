@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// downloadLimiter is shared by every download so the limit holds across all
+// of the concurrent parts.  It is nil when downloads are unlimited.
+var downloadLimiter = newRateLimiter(int64(EnvInt("DOWNLOAD_BYTES_PER_SEC", 0, "Limit the total download rate in bytes per second, 0 for unlimited")))
+
+// rateLimiter is a token bucket refilled at rate bytes per second holding up
+// to one second's worth of tokens.  Callers take the tokens for what they
+// have already read and sleep off any debt, so reads of any size work.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait takes n tokens from the bucket and blocks until the bucket is no
+// longer in debt or the context is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var regionDetect = Env("DISABLE_REGION_DETECT", "", "Disable looking up the region of each bucket, using the configured region") == ""
+
+// bucketRegion asks S3 for the region of bucket.  HeadBucket answers with
+// it, and a region other than the client's gets a 301 redirect that still
+// carries it in a header.  An empty region means it couldn't be found.
+func bucketRegion(ctx context.Context, client *s3.Client, bucket string) (string, error) {
+	out, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		return aws.ToString(out.BucketRegion), nil
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.Response != nil {
+		if r := respErr.Response.Header.Get("X-Amz-Bucket-Region"); r != "" {
+			return r, nil
+		}
+	}
+	return "", err
+}
+
+// detectRegion returns the region of bucket, reached with s through client,
+// or empty if it is unknown.  Buckets with their region set, and custom
+// endpoints, which usually have just the one region, aren't looked up.
+func detectRegion(ctx context.Context, s s3Settings, client *s3.Client, bucket string) string {
+	if !regionDetect || s.region != "" || s.endpoint != "" {
+		return ""
+	}
+	r, err := bucketRegion(ctx, client, bucket)
+	if r == "" {
+		awscliLog.Printf("Could not find the region of %s %s, using %s: %v", s.bucket, bucket, client.Options().Region, err)
+	} else if r != client.Options().Region {
+		awscliLog.Printf("%s %s is in %s", s.bucket, bucket, r)
+	}
+	return r
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+var (
+	reproducible    = Env("REPRODUCIBLE", "", "Write byte-identical archives for the same keys and contents") != ""
+	sourceDateEpoch = Env("SOURCE_DATE_EPOCH", "", "Unix time given to the archive entries with REPRODUCIBLE, 0 if unset")
+)
+
+// reproducibleTime is the modification time of the entries with REPRODUCIBLE.
+var reproducibleTime = time.Unix(0, 0)
+
+// checkReproducible validates the REPRODUCIBLE settings before any work
+// starts.
+func checkReproducible() {
+	if sourceDateEpoch == "" {
+		return
+	}
+	secs, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+	if err != nil || secs < 0 {
+		log.Fatalf("SOURCE_DATE_EPOCH %q is invalid; must be a Unix time in seconds", sourceDateEpoch)
+	}
+	reproducibleTime = time.Unix(secs, 0)
+}
+
+// turns hands out a turn to each of a series of goroutines, so they can pass
+// on their results in the order they were started however long each takes.
+type turns struct {
+	last chan struct{}
+}
+
+func newTurns() *turns {
+	t := &turns{last: make(chan struct{})}
+	close(t.last) // The first turn needn't wait
+	return t
+}
+
+// take returns the turn after the ones handed out so far.
+func (t *turns) take() *turn {
+	tu := &turn{prev: t.last, next: make(chan struct{})}
+	t.last = tu.next
+	return tu
+}
+
+// turn is one goroutine's place in line.  A nil turn never waits, for when
+// the order doesn't matter.
+type turn struct {
+	prev <-chan struct{}
+	next chan struct{}
+}
+
+// wait blocks until the turns before this one are done.
+func (tu *turn) wait() {
+	if tu != nil {
+		<-tu.prev
+	}
+}
+
+// done passes the turn on, once the turns before it are done.  It must be
+// called exactly once, whether or not there was a result to pass on.
+func (tu *turn) done() {
+	if tu != nil {
+		<-tu.prev
+		close(tu.next)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/remeh/sizedwaitgroup"
+)
+
+var (
+	restoreDir         = Env("RESTORE_DIR", "", "Directory to extract archives to in restore mode")
+	restoreBucket      = Env("RESTORE_BUCKET", "", "Bucket to extract archives to in restore mode")
+	restoreGlob        = Env("RESTORE_GLOB", "", "Comma separated globs of the keys to restore, ** matches across slashes, as in INCLUDE_GLOBS")
+	restoreConcurrency = EnvInt("RESTORE_CONCURRENCY", 8, "Uploads run at once in restore mode")
+	restoreManifest    = Env("RESTORE_MANIFEST", "", "Manifest of the archives, to restore the entries written with COMPRESS_EACH_FILE without reading the whole archive")
+
+	restoreRes []*regexp.Regexp // RESTORE_GLOB compiled
+)
+
+// restoreSelected reports whether key matches RESTORE_GLOB, or there is none.
+func restoreSelected(key string) bool {
+	if len(restoreRes) == 0 {
+		return true
+	}
+	for _, re := range restoreRes {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// runRestore extracts the entries of the named archives to RESTORE_DIR or
+// RESTORE_BUCKET.  Archives are read from local files, or from DST_BUCKET
+// when there is no local file of that name.  With RESTORE_MANIFEST the
+// archives may be left out, to restore from all of them.
+func runRestore(ctx context.Context, archives []string) {
+	switch {
+	case len(archives) == 0 && restoreManifest == "":
+		log.Fatalf("usage: %s restore ARCHIVE...", os.Args[0])
+	case (restoreDir == "") == (restoreBucket == ""):
+		log.Fatalf("restore needs exactly one of RESTORE_DIR or RESTORE_BUCKET")
+	case restoreBucket != "" && localOnly():
+		log.Fatalf("RESTORE_BUCKET can't be used with SRC_DIR and DST_DIR, as they leave out S3")
+	case restoreConcurrency < 1:
+		log.Fatalf("RESTORE_CONCURRENCY value %d is too small; must be at least 1", restoreConcurrency)
+	}
+	var err error
+	if restoreRes, err = compileGlobs(restoreGlob); err != nil {
+		log.Fatalf("invalid RESTORE_GLOB: %v", err)
+	}
+	if restoreBucket != "" {
+		checkTempDir() // Entries are staged there before uploading
+	}
+	var root *os.Root
+	if restoreDir != "" {
+		if err := os.MkdirAll(restoreDir, 0755); err != nil {
+			log.Fatalf("RESTORE_DIR %q can't be created: %v", restoreDir, err)
+		}
+		var err error
+		if root, err = os.OpenRoot(restoreDir); err != nil {
+			log.Fatalf("RESTORE_DIR %q can't be opened: %v", restoreDir, err)
+		}
+		defer root.Close()
+	}
+
+	var (
+		swg      = sizedwaitgroup.New(restoreConcurrency)
+		uploads  = newRestoreUploads()
+		restored int64
+		failed   int64
+		want     map[string]bool         // With RESTORE_MANIFEST, the keys to restore from the archives read whole
+		written  = make(map[string]bool) // Files extracted to RESTORE_DIR, which links may copy
+	)
+	extract := func(r io.Reader, hdr *tar.Header) error {
+		if restoreDir != "" {
+			if err := extractToDir(root, r, hdr, written); err != nil {
+				return err
+			}
+			atomic.AddInt64(&restored, 1)
+			return nil
+		}
+		return extractToBucket(ctx, &swg, uploads, r, hdr, &restored, &failed)
+	}
+	restoreEntry := func(name string, r io.Reader, hdr *tar.Header) {
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeLink && hdr.Typeflag != tar.TypeDir {
+			return
+		}
+		if !restoreSelected(hdr.Name) {
+			return
+		}
+		if want != nil && !want[hdr.Name] {
+			return
+		}
+		if err := extract(r, hdr); err != nil {
+			Errorf("failed to restore %s from %s: %v", hdr.Name, name, err)
+			atomic.AddInt64(&failed, 1)
+		}
+	}
+
+	if restoreManifest != "" {
+		var alone []entryRead
+		alone, archives, want = planManifestRestore(archives)
+		for _, r := range alone {
+			if err := r.restore(ctx, extract); err != nil {
+				Errorf("failed to restore %s from %s: %v", r.entry.Key, r.src.Archive, err)
+				atomic.AddInt64(&failed, 1)
+			}
+		}
+	}
+	for _, name := range archives {
+		tr, closer, err := openArchiveStream(ctx, name)
+		if errors.Is(err, errZipArchive) {
+			err = forEachZipEntry(ctx, name, func(r io.Reader, hdr *tar.Header) error {
+				restoreEntry(name, r, hdr)
+				return nil
+			})
+			if err != nil {
+				Errorf("failed to read archive %s: %v", name, err)
+				atomic.AddInt64(&failed, 1)
+			}
+			continue
+		}
+		if err != nil {
+			Errorf("failed to open archive %s: %v", name, err)
+			atomic.AddInt64(&failed, 1)
+			continue
+		}
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				Errorf("failed to read archive %s: %v", name, err)
+				atomic.AddInt64(&failed, 1)
+				break
+			}
+			restoreEntry(name, tr, hdr)
+		}
+		closer.Close()
+	}
+	swg.Wait()
+
+	Infof("Restored %d files, %d failed", restored, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// errUnsafePath is returned for entries whose names would land outside
+// RESTORE_DIR.
+var errUnsafePath = errors.New("unsafe path in archive")
+
+// extractPath returns the path below RESTORE_DIR to write the entry name to.
+// Keys are archived as they are, so absolute names, ".." sequences leaving
+// the directory and NUL bytes are refused here rather than when packing.
+func extractPath(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", errUnsafePath
+	}
+	rel := filepath.FromSlash(name)
+	if !filepath.IsLocal(rel) || filepath.VolumeName(rel) != "" {
+		return "", errUnsafePath
+	}
+	return filepath.Clean(rel), nil
+}
+
+// extractToDir writes the entry below root, refusing names that would land
+// outside it.  Opening through root also refuses symlinks already in
+// RESTORE_DIR that point outside it.  Links written by DEDUP are copied from
+// their first copy, which must be in written, the files this restore
+// extracted, rather than whatever is on disk under that name.  Folder
+// placeholders are made directories.
+func extractToDir(root *os.Root, tr io.Reader, hdr *tar.Header, written map[string]bool) error {
+	rel, err := extractPath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		if err := root.MkdirAll(rel, 0755); err != nil {
+			return err
+		}
+		return root.Chtimes(rel, hdr.ModTime, hdr.ModTime)
+	}
+	var r io.Reader = tr
+	if hdr.Typeflag == tar.TypeLink {
+		src, err := extractPath(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if !written[src] {
+			return fmt.Errorf("duplicate of %s, which must be restored first", linkSource(hdr))
+		}
+		in, err := root.Open(src)
+		if err != nil {
+			return fmt.Errorf("duplicate of %s, which must be restored first: %w", linkSource(hdr), err)
+		}
+		defer in.Close()
+		r = in
+	}
+	if err := root.MkdirAll(filepath.Dir(rel), 0755); err != nil {
+		return err
+	}
+	f, err := root.Create(rel)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	written[rel] = true
+	return root.Chtimes(rel, hdr.ModTime, hdr.ModTime)
+}
+
+// restoreUpload is an upload to RESTORE_BUCKET in the background.
+type restoreUpload struct {
+	done chan struct{}
+	err  error
+}
+
+// restoreUploads tracks the uploads by key, so links written by DEDUP can
+// wait for their first copy to be uploaded before copying it.
+type restoreUploads struct {
+	mu sync.Mutex
+	m  map[string]*restoreUpload
+}
+
+func newRestoreUploads() *restoreUploads {
+	return &restoreUploads{m: make(map[string]*restoreUpload)}
+}
+
+// start records the upload of key, to be passed to finish when it is done.
+func (r *restoreUploads) start(key string) *restoreUpload {
+	u := &restoreUpload{done: make(chan struct{})}
+	r.mu.Lock()
+	r.m[key] = u
+	r.mu.Unlock()
+	return u
+}
+
+// lookup returns the upload of key, or nil if there is none this run.
+func (r *restoreUploads) lookup(key string) *restoreUpload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.m[key]
+}
+
+func (u *restoreUpload) finish(err error) {
+	u.err = err
+	close(u.done)
+}
+
+// extractToBucket copies the entry to a temp file, as the tar stream can't
+// be read out of order, and uploads it to RESTORE_BUCKET in the background.
+// Links written by DEDUP are copied within the bucket from their first copy
+// instead, once it is uploaded, and fail if it isn't restored in this run.
+func extractToBucket(ctx context.Context, swg *sizedwaitgroup.SizedWaitGroup, uploads *restoreUploads, tr io.Reader, hdr *tar.Header, restored, failed *int64) error {
+	if hdr.Typeflag == tar.TypeLink {
+		first := uploads.lookup(hdr.Linkname)
+		u := uploads.start(hdr.Name)
+		swg.Add()
+		go func() {
+			defer swg.Done()
+			var err error
+			defer func() { u.finish(err) }()
+			if first == nil {
+				// Whatever is in the bucket under that key may not be the
+				// archived contents, so it isn't copied
+				err = fmt.Errorf("duplicate of %s, which wasn't restored", linkSource(hdr))
+				Errorf("failed to restore %s: %v in this run; restore its archive along with this one", hdr.Name, err)
+				atomic.AddInt64(failed, 1)
+				return
+			}
+			<-first.done // Copying sooner would find nothing or an older object
+			if first.err != nil {
+				err = first.err
+				Errorf("failed to restore %s: duplicate of %s, which failed", hdr.Name, linkSource(hdr))
+				atomic.AddInt64(failed, 1)
+				return
+			}
+			if err = copyObject(ctx, dstClient(), restoreBucket, hdr.Linkname, hdr.Name, restoreMeta(hdr)); err != nil {
+				Errorf("failed to copy %s to %s: %v", linkSource(hdr), hdr.Name, err)
+				atomic.AddInt64(failed, 1)
+				return
+			}
+			atomic.AddInt64(restored, 1)
+		}()
+		return nil
+	}
+
+	f, err := os.CreateTemp(tempDir, "s3restore-*")
+	if err != nil {
+		return err
+	}
+	tempName := f.Name()
+	trackTempFile(tempName)
+	cleanup := func() {
+		os.Remove(tempName)
+		untrackTempFile(tempName)
+	}
+	_, err = io.Copy(f, tr)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return err
+	}
+
+	u := uploads.start(hdr.Name)
+	swg.Add()
+	go func() {
+		defer swg.Done()
+		defer cleanup()
+		var err error
+		defer func() { u.finish(err) }()
+		meta := restoreMeta(hdr)
+		if hdr.Size == 0 {
+			err = putEmptyObject(ctx, dstClient(), restoreBucket, hdr.Name, meta)
+		} else {
+			err = uploadFileInParts(ctx, dstClient(), restoreBucket, hdr.Name, tempName, meta, nil)
+		}
+		if err != nil {
+			Errorf("failed to upload %s: %v", hdr.Name, err)
+			atomic.AddInt64(failed, 1)
+			return
+		}
+		atomic.AddInt64(restored, 1)
+	}()
+	return nil
+}
+
+// putEmptyObject writes a zero byte object, which uploadFileInParts refuses.
+func putEmptyObject(ctx context.Context, client *s3.Client, bucket, key string, meta *ObjectMeta) error {
+	return withRetry(ctx, uploadRetryMax, func() error {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(nil),
+			ContentType:          uploadContentType(meta),
+			Metadata:             uploadMetadata(meta),
+			StorageClass:         destStorageClass,
+			ServerSideEncryption: destSSE,
+			SSEKMSKeyId:          kmsKeyID(),
+		})
+		return err
+	})
+}
+
+// openArchiveStream opens the named archive, from a local file or else from
+// DST_BUCKET, and returns a tar reader over it.  The compression is detected
+// from the first bytes, so gzip, zstd and plain tar archives all work.  Zip
+// archives return errZipArchive, to be read with forEachZipEntry.
+func openArchiveStream(ctx context.Context, name string) (*tar.Reader, io.Closer, error) {
+	rc, err := openArchiveFile(ctx, name, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(rc)
+	magic, err := br.Peek(len(encMagic))
+	switch {
+	case err != nil && err != io.EOF: // Short archives are left to fail as tar
+		rc.Close()
+		return nil, nil, err
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")): // An entry, or empty
+		rc.Close()
+		return nil, nil, errZipArchive
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), rc, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), closerFunc(func() error { zr.Close(); return rc.Close() }), nil
+	case bytes.Equal(magic, []byte(encMagic)):
+		rc.Close()
+		return nil, nil, errors.New("archive is encrypted; set ENCRYPTION_KEY or ENCRYPTION_KMS_KEY_ID to restore it")
+	}
+	return tar.NewReader(br), rc, nil
+}
+
+// openArchiveFile opens the named archive, from a local file or else from
+// DST_BUCKET, for reading from start up to end, or to the end of the file if
+// end is 0.  An archive that isn't found is looked for as one split by
+// VOLUME_SIZE, and read across its volumes.  With encryption the range is
+// of the archive decrypted.
+func openArchiveFile(ctx context.Context, name string, start, end int64) (io.ReadCloser, error) {
+	if archiveEncryption() && !strings.HasSuffix(name, volumeIndexSuffix) {
+		return openEncryptedArchive(ctx, func(start, end int64) (io.ReadCloser, error) {
+			return openStoredArchive(ctx, name, start, end)
+		}, start, end)
+	}
+	return openStoredArchive(ctx, name, start, end)
+}
+
+// openStoredArchive opens the archive name for openArchiveFile as it is
+// stored.
+func openStoredArchive(ctx context.Context, name string, start, end int64) (io.ReadCloser, error) {
+	rc, err := openWholeArchive(ctx, name, start, end)
+	if err != nil && !strings.HasSuffix(name, volumeIndexSuffix) {
+		if vs, verr := openVolumeIndex(ctx, name); verr == nil {
+			return vs.open(ctx, start, end), nil
+		}
+	}
+	return rc, err
+}
+
+// openWholeArchive opens the archive name for openStoredArchive, when it is
+// not split.
+func openWholeArchive(ctx context.Context, name string, start, end int64) (io.ReadCloser, error) {
+	f, err := findLocalArchive(name)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		in := &s3.GetObjectInput{Bucket: aws.String(dstBucket), Key: aws.String(dstKey(name))}
+		if end > 0 {
+			in.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1))
+		} else if start > 0 {
+			in.Range = aws.String(fmt.Sprintf("bytes=%d-", start))
+		}
+		obj, err := dstClient().GetObject(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("not found locally or in %s: %w", dstBucket, err)
+		}
+		return obj.Body, nil
+	}
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if end > 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, end-start), f}, nil
+	}
+	return f, nil
+}
+
+// findLocalArchive opens the named archive if it is a local file, or one in
+// DST_DIR when that is set.  It returns nil and no error for an archive to
+// be read from DST_BUCKET instead.
+func findLocalArchive(name string) (*os.File, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) && dstDir != "" {
+		if f, err = os.Open(filepath.Join(dstDir, name)); err != nil {
+			return nil, fmt.Errorf("not found locally or in %s: %w", dstDir, err)
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return f, err
+}
+
+// closerFunc turns a function into an io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/remeh/sizedwaitgroup"
+)
+
+func TestRestoreLinkWithoutFirstCopy(t *testing.T) {
+	// The first copy wasn't restored in this run, so the bucket isn't
+	// trusted to hold its contents and nothing is copied
+	swg := sizedwaitgroup.New(1)
+	uploads := newRestoreUploads()
+	hdr := &tar.Header{Typeflag: tar.TypeLink, Name: "b", Linkname: "a"}
+	var restored, failed int64
+	if err := extractToBucket(context.Background(), &swg, uploads, nil, hdr, &restored, &failed); err != nil {
+		t.Fatal(err)
+	}
+	swg.Wait()
+	if restored != 0 || failed != 1 {
+		t.Errorf("restored %d and failed %d, want 0 and 1", restored, failed)
+	}
+	if u := uploads.lookup("b"); u == nil || u.err == nil {
+		t.Error("link wasn't recorded as failed")
+	}
+}
+
+func TestExtractToDirUnsafeNames(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	written := make(map[string]bool)
+
+	for _, name := range []string{"../evil", "/etc/evil", "a/../../evil", "a/b/../../../evil", "evil\x00.txt", "link/evil", "..", ""} {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: 4}
+		if err := extractToDir(root, strings.NewReader("evil"), hdr, written); err == nil {
+			t.Errorf("%q was extracted", name)
+		}
+		hdr.Typeflag = tar.TypeDir
+		if err := extractToDir(root, strings.NewReader(""), hdr, written); err == nil {
+			t.Errorf("directory %q was made", name)
+		}
+	}
+	// Nor are the times of a directory a symlink points to set
+	hdr := &tar.Header{Typeflag: tar.TypeDir, Name: "link", ModTime: time.Unix(1e9, 0)}
+	if err := extractToDir(root, strings.NewReader(""), hdr, written); err == nil {
+		t.Error("times were set through a symlink out of the directory")
+	}
+	if info, err := os.Stat(outside); err != nil || info.ModTime().Equal(hdr.ModTime) {
+		t.Errorf("times were set on %s outside the directory", outside)
+	}
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d entries were written outside the directory", len(entries))
+	}
+
+	// Names that stay inside are kept as they are
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"a/b/c.txt", "a/./d.txt", "a/b/../e.txt", "..f"} {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: 2, ModTime: modified}
+		if err := extractToDir(root, strings.NewReader("ok"), hdr, written); err != nil {
+			t.Errorf("%q: %v", name, err)
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+		} else if !info.ModTime().Equal(modified) {
+			t.Errorf("%q modified %v, want %v", name, info.ModTime(), modified)
+		}
+	}
+}
+
+func TestExtractToDirLink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "local"), []byte("local"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	written := make(map[string]bool)
+
+	// A file already on disk isn't the first copy, so nothing is copied in
+	hdr := &tar.Header{Typeflag: tar.TypeLink, Name: "copy", Linkname: "local"}
+	if err := extractToDir(root, strings.NewReader(""), hdr, written); err == nil {
+		t.Error("link was copied from a file this restore didn't extract")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "copy")); err == nil {
+		t.Error("copy was written")
+	}
+
+	hdr = &tar.Header{Typeflag: tar.TypeReg, Name: "a/first", Size: 5}
+	if err := extractToDir(root, strings.NewReader("first"), hdr, written); err != nil {
+		t.Fatal(err)
+	}
+	hdr = &tar.Header{Typeflag: tar.TypeLink, Name: "b/second", Linkname: "a/./first"}
+	if err := extractToDir(root, strings.NewReader(""), hdr, written); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "b", "second")); err != nil || string(data) != "first" {
+		t.Errorf("link restored as %q, %v", data, err)
+	}
+}
+
+func TestRestoreSelected(t *testing.T) {
+	defer func(res []*regexp.Regexp) { restoreRes = res }(restoreRes)
+	var err error
+	if restoreRes, err = compileGlobs("logs/**/*.gz, docs/*.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{
+		"logs/a.gz":            true,
+		"logs/2024/01/02/b.gz": true,
+		"logs/a.txt":           false,
+		"docs/report.pdf":      true,
+		"docs/old/report.pdf":  false,
+		"other/a.gz":           false,
+	} {
+		if got := restoreSelected(key); got != want {
+			t.Errorf("restoreSelected(%q) = %v, want %v", key, got, want)
+		}
+	}
+	restoreRes = nil
+	if !restoreSelected("anything") {
+		t.Error("key left out without RESTORE_GLOB")
+	}
+}
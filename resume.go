@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var resumeDownloads = Env("DISABLE_RESUME", "", "Disable resuming interrupted large downloads") == ""
+
+// resumeFileName names the temp file for a large download after the object
+// it holds, so a later run can find and finish it.  The ETag is part of the
+// name so a changed object is never mixed with an old partial copy.
+func resumeFileName(key, versionID string, size int64, etag string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s", key, versionID, size, etag)))
+	return "s3obj-" + hex.EncodeToString(sum[:16])
+}
+
+// isResumeFileName reports whether name, ending in ext, is one made by
+// resumeFileName.
+func isResumeFileName(name, ext string) bool {
+	hash, ok := strings.CutPrefix(strings.TrimSuffix(name, ext), "s3obj-")
+	if !ok || len(hash) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// resumeState is the sidecar file listing the ranges of a temp file that
+// have been completely written.
+type resumeState struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+func rangeKey(r partRange) string {
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+// openResumeState loads the ranges already finished, creating the sidecar if
+// this is the first attempt.
+func openResumeState(path string) (*resumeState, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rs := &resumeState{f: f, done: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			rs.done[line] = true
+		}
+	}
+	return rs, nil
+}
+
+// isDone reports whether the range was finished by an earlier attempt.
+func (rs *resumeState) isDone(r partRange) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.done[rangeKey(r)]
+}
+
+// markDone records the range as written.
+func (rs *resumeState) markDone(r partRange) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.done[rangeKey(r)] = true
+	_, err := fmt.Fprintln(rs.f, rangeKey(r))
+	return err
+}
+
+// close closes the sidecar, removing it when remove is set.
+func (rs *resumeState) close(remove bool) {
+	rs.f.Close()
+	if remove {
+		os.Remove(rs.f.Name())
+	}
+}
+
+// verifyFileRange checks a range already on disk against its checksum, and
+// returns its hash.
+func verifyFileRange(f *os.File, r partRange) (hash.Hash, error) {
+	if len(r.parts) > 0 {
+		c := newPartsChecker(r)
+		if _, err := io.Copy(c, io.NewSectionReader(f, r.start, r.end-r.start+1)); err != nil {
+			return nil, err
+		}
+		return c.Hash, c.err
+	}
+	h := newChecksum()
+	if _, err := io.Copy(h, io.NewSectionReader(f, r.start, r.end-r.start+1)); err != nil {
+		return nil, err
+	}
+	return h, compareChecksum(h, r.checksum)
+}
+
+// errETagUnverified is returned when a file can't be checked against its
+// ETag, because there is no MD5 ETag or the upload part size isn't known.
+var errETagUnverified = errors.New("ETag can't be verified")
+
+// verifyFileETag checks the file against the object's ETag.  A single part
+// ETag is the MD5 of the contents.  A multipart ETag is the MD5 of the part
+// MD5s followed by the part count, so it can only be checked when the parts
+// were all partSize bytes, bar the last.
+func verifyFileETag(path, etag string, partSize int64) error {
+	etag = strings.Trim(etag, `"`)
+	if etag == "" {
+		return errETagUnverified
+	}
+	count := 0
+	if i := strings.LastIndexByte(etag, '-'); i >= 0 {
+		n, err := strconv.Atoi(etag[i+1:])
+		if err != nil || n <= 0 || partSize <= 0 {
+			return errETagUnverified
+		}
+		count = n
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if count == 0 {
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, etag) {
+			return fmt.Errorf("ETag %w: expected %s, got %s", errChecksumMismatch, etag, got)
+		}
+		return nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if max(1, (fi.Size()+partSize-1)/partSize) != int64(count) {
+		// The parts weren't all the same size
+		return errETagUnverified
+	}
+	var sums []byte
+	for range count {
+		h := md5.New()
+		if _, err := io.CopyN(h, f, partSize); err != nil && err != io.EOF {
+			return err
+		}
+		sums = h.Sum(sums)
+	}
+	whole := md5.Sum(sums)
+	if got := fmt.Sprintf("%x-%d", whole, count); !strings.EqualFold(got, etag) {
+		return fmt.Errorf("ETag %w: expected %s, got %s", errChecksumMismatch, etag, got)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyFileETag(t *testing.T) {
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var sums []byte
+	for i := 0; i < len(data); i += 1000 {
+		sum := md5.Sum(data[i:min(i+1000, len(data))])
+		sums = append(sums, sum[:]...)
+	}
+	multipart := fmt.Sprintf(`"%x-3"`, md5.Sum(sums))
+
+	for _, tc := range []struct {
+		etag     string
+		partSize int64
+		want     error
+	}{
+		{fmt.Sprintf(`"%x"`, md5.Sum(data)), 0, nil},
+		{`"00000000000000000000000000000000"`, 0, errChecksumMismatch},
+		{multipart, 1000, nil},
+		{`"00000000000000000000000000000000-3"`, 1000, errChecksumMismatch},
+		{multipart, 0, errETagUnverified},
+		{multipart, 2000, errETagUnverified}, // Two parts of that size, not three
+		{"", 0, errETagUnverified},
+	} {
+		if err := verifyFileETag(path, tc.etag, tc.partSize); !errors.Is(err, tc.want) {
+			t.Errorf("verifyFileETag(%s, %d) = %v, want %v", tc.etag, tc.partSize, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+var (
+	retryMax    = EnvInt("RETRY_MAX", 3, "Maximum attempts for a transient download failure")
+	retryBaseMs = EnvInt("RETRY_BASE_MS", 200, "Base delay in milliseconds for retry backoff")
+
+	partRetryMax = EnvInt("PART_RETRY_MAX", 3, "Maximum attempts for each part of a multipart download")
+
+	retryables = retry.IsErrorRetryables(retry.DefaultRetryables)
+)
+
+// isRetryable reports whether err looks transient, such as a 5xx response or
+// a dropped connection.  Missing or forbidden objects are never retried.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		switch code := httpErr.HTTPStatusCode(); {
+		case code == 403 || code == 404:
+			return false
+		case code >= 500:
+			return true
+		}
+	}
+	return retryables.IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// backoff returns the delay before the given retry attempt (starting at 0),
+// doubling each time with up to 50% random jitter added.
+func backoff(attempt int) time.Duration {
+	d := time.Duration(retryBaseMs) * time.Millisecond << attempt
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// withRetry calls fn until it succeeds, fails with a permanent error, or
+// maxAttempts attempts have been made.  The last error is returned wrapped with
+// the number of attempts when more than one was made.  Throttled attempts
+// back off longer, by throttleBackoff, and may take up to THROTTLE_RETRY_MAX
+// attempts.
+func withRetry(ctx context.Context, maxAttempts int, fn func() error) error {
+	var err error
+	attempt := 0
+	for ; ; attempt++ {
+		if err = throttle.acquire(ctx); err != nil {
+			return err
+		}
+		err = fn()
+		throttle.release()
+		if err == nil {
+			throttle.succeeded()
+			return nil
+		}
+		delay := backoff(attempt)
+		limit := maxAttempts
+		if isThrottled(err) {
+			delay = throttleBackoff(attempt, throttle.throttled())
+			limit = max(maxAttempts, throttleRetryMax)
+		}
+		if attempt+1 >= limit || !isRetryable(err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+	if attempt > 0 && isRetryable(err) {
+		return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+	}
+	return err
+}
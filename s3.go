@@ -4,10 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,20 +16,73 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
+	"github.com/remeh/sizedwaitgroup"
 )
 
 var (
-	region   string
-	s3client *s3.Client
+	dstS3client *s3.Client // For DST_BUCKET
+	srcS3client *s3.Client // For SRC_BUCKET, the same client when its settings are the same
 
 	s3Ready              sync.WaitGroup // channel to signal when the S3 client is ready
-	awscliLog            = log.New(os.Stderr, "awscli: ", log.LstdFlags)
+	awscliLog            = componentLogger{logger.With("component", "awscli")}
 	srcBucket, dstBucket string // Source and destination buckets
+
+	s3Endpoint       = Env("S3_ENDPOINT", "", "Custom S3 endpoint URL, such as for MinIO or Ceph")
+	awsRegion        = Env("AWS_REGION", "", "The region to sign requests for, default the instance's, or us-east-1 with S3_ENDPOINT")
+	s3ForcePathStyle = Env("S3_FORCE_PATH_STYLE", "", "Address buckets by path instead of by host name") != ""
+	s3Insecure       = Env("S3_INSECURE", "", "Skip verifying the S3 endpoint TLS certificate") != ""
+	s3RequesterPays  = Env("S3_REQUESTER_PAYS", "", "Accept the request charges on requester-pays source buckets") != ""
+
+	// The connection settings for each bucket, which default to the ones above
+	srcS3 = s3Settings{
+		bucket:      "SRC_BUCKET",
+		endpoint:    Env("SRC_S3_ENDPOINT", s3Endpoint, "S3_ENDPOINT for reading SRC_BUCKET"),
+		region:      Env("SRC_AWS_REGION", awsRegion, "AWS_REGION for reading SRC_BUCKET"),
+		credentials: srcCredentials,
+	}
+	dstS3 = s3Settings{
+		bucket:      "DST_BUCKET",
+		endpoint:    Env("DST_S3_ENDPOINT", s3Endpoint, "S3_ENDPOINT for writing DST_BUCKET"),
+		region:      Env("DST_AWS_REGION", awsRegion, "AWS_REGION for writing DST_BUCKET"),
+		credentials: dstCredentials,
+	}
 )
 
+// s3Settings is how to reach one of the buckets.  An empty region is looked
+// up from the profile, the instance or the bucket itself.
+type s3Settings struct {
+	bucket      string // The setting they are for, for messages
+	endpoint    string
+	region      string
+	credentials credentialSettings
+}
+
+// sameS3Settings reports whether a and b reach their buckets the same way,
+// so they can share a client.
+func sameS3Settings(a, b s3Settings) bool {
+	a.bucket, b.bucket = "", ""
+	return sameCredentials(a.credentials, b.credentials) && a.endpoint == b.endpoint && a.region == b.region
+}
+
+// clientOptions applies the endpoint and transport settings to the S3 client
+// options.
+func (s s3Settings) clientOptions(o *s3.Options) {
+	if s.endpoint != "" {
+		o.BaseEndpoint = aws.String(s.endpoint)
+	}
+	o.UsePathStyle = s3ForcePathStyle
+	o.HTTPClient = s.httpClient()
+}
+
+// dstClient returns the client for DST_BUCKET once it is ready, or nil when
+// there is none.
+func dstClient() *s3.Client {
+	s3Ready.Wait() // Wait for the S3 client to be ready
+	return dstS3client
+}
+
 func initS3() {
 	awscliLog.Println("Initializing S3 client...")
 	s3RefreshTime, err := time.ParseDuration(Env("REFRESH", "20m", "The refresh interval for grabbing new AMI credentials"))
@@ -37,13 +91,34 @@ func initS3() {
 	}
 
 	// Load environment variables for source and destination buckets and tarball key
-	srcBucket = Env("SRC_BUCKET", "mySourceBucket", "The source S3 bucket name")
-	dstBucket = Env("DST_BUCKET", "myDestinationBucket", "The destination S3 bucket name")
+	srcBucket = Env("SRC_BUCKET", "mySourceBucket", "The source S3 bucket name or s3://bucket/prefix URI")
+	dstBucket = Env("DST_BUCKET", "myDestinationBucket", "The destination S3 bucket name or s3://bucket/prefix URI")
+
+	// Either can be a URI, which also gives the key prefix
+	var srcPrefix string
+	if srcBucket, srcPrefix, err = parseS3URI(srcBucket); err != nil {
+		awscliLog.Fatal("Invalid SRC_BUCKET: ", err)
+	}
+	if dstBucket, dstPrefix, err = parseS3URI(dstBucket); err != nil {
+		awscliLog.Fatal("Invalid DST_BUCKET: ", err)
+	}
+	if srcPrefix != "" {
+		if prefixFilter != "" && prefixFilter != srcPrefix {
+			awscliLog.Fatal("SRC_BUCKET prefix and PREFIX_FILTER are both set; use only one")
+		}
+		prefixFilter = srcPrefix
+	}
 
 	// Ensure source and destination buckets are set
 	if srcBucket == "" || dstBucket == "" {
 		awscliLog.Fatal("SRC_BUCKET and DST_BUCKET environment variables must be set")
 	}
+	if localOnly() {
+		awscliLog.Println("SRC_DIR and DST_DIR are both set, so no S3 client is needed")
+		return
+	}
+	checkCredentialSettings()
+	checkHTTPSettings()
 
 	s3Ready.Add(1) // Add to wait group to signal when the S3 client is ready
 	go func() {
@@ -54,42 +129,95 @@ func initS3() {
 			awscliLog.Fatal("Could not load default config,", err)
 		}*/
 
+		// The instance is only asked for its region when a bucket needs it
 		imdsClient := imds.New(imds.Options{})
-		gro, err := imdsClient.GetRegion(context.TODO(), &imds.GetRegionInput{})
-		if err != nil {
-			awscliLog.Fatal("Could not get region property,", err)
-		}
-
-		iam, err := imdsClient.GetIAMInfo(context.TODO(), &imds.GetIAMInfoInput{})
-		if err != nil {
-			awscliLog.Fatal("Could not get IAM property,", err)
-		}
+		var instanceRegion string
+		regionOf := func(s s3Settings) string {
+			switch {
+			case s.region != "":
+				return s.region
+			case s.credentials.profileRegion() != "":
+				return s.credentials.profileRegion()
+			case s.endpoint != "":
+				// Off EC2 there is no instance metadata to ask
+				return "us-east-1"
+			case s.credentials.anonymous:
+				// Public buckets are read from anywhere, and their region
+				// is looked up below
+				return "us-east-1"
+			case instanceRegion != "":
+				return instanceRegion
+			}
+			gro, err := imdsClient.GetRegion(context.TODO(), &imds.GetRegionInput{})
+			if err != nil {
+				awscliLog.Fatal("Could not get region property,", err)
+			}
 
-		region = gro.Region
-		awscliLog.Println("EC2 Environment:")
-		awscliLog.Println("  AWS_REGION:", gro.Region)
-		awscliLog.Println("  IMDS_ARN:", iam.IAMInfo.InstanceProfileArn)
-		awscliLog.Println("  IMDS_ID:", iam.IAMInfo.InstanceProfileID)
+			iam, err := imdsClient.GetIAMInfo(context.TODO(), &imds.GetIAMInfoInput{})
+			if err != nil {
+				awscliLog.Fatal("Could not get IAM property,", err)
+			}
 
-		getConfig := func() error {
-			// Get a credential provider from the configured role attached to the currently running EC2 instance
-			provider := ec2rolecreds.New(func(o *ec2rolecreds.Options) {
-				o.Client = imdsClient
-			})
+			instanceRegion = gro.Region
+			awscliLog.Println("EC2 Environment:")
+			awscliLog.Println("  AWS_REGION:", gro.Region)
+			awscliLog.Println("  IMDS_ARN:", iam.IAMInfo.InstanceProfileArn)
+			awscliLog.Println("  IMDS_ID:", iam.IAMInfo.InstanceProfileID)
+			return instanceRegion
+		}
 
-			// Construct a client, wrap the provider in a cache, and supply the region for the desired service
-			s3client = s3.New(s3.Options{
-				Credentials: aws.NewCredentialsCache(provider),
+		// Construct a client, wrap the provider in a cache, and supply the region for the desired service
+		var caches []*aws.CredentialsCache
+		newClient := func(s s3Settings, region string) *s3.Client {
+			// Buckets without a profile use the role attached to the
+			// currently running EC2 instance, or the keys in the
+			// environment with a custom endpoint
+			base := func() aws.CredentialsProvider {
+				return ec2rolecreds.New(func(o *ec2rolecreds.Options) {
+					o.Client = imdsClient
+				})
+			}
+			if s.endpoint != "" {
+				base = envCredentials
+			}
+			cache, err := s.credentials.provider(base, region)
+			if err != nil {
+				awscliLog.Fatal("Error getting config:", err)
+			}
+			caches = append(caches, cache)
+			return s3.New(s3.Options{
+				Credentials: cache,
 				Region:      region,
-			})
-			//fmt.Printf("config: %#v\n\n", sdkConfig)
-
-			return nil
+			}, s.clientOptions)
 		}
 
 		awscliLog.Println("Testing call to AWS...")
-		if err := getConfig(); err != nil {
-			awscliLog.Fatal("Error getting config:", err)
+		dst, src := dstS3, srcS3
+		dst.region, src.region = regionOf(dst), regionOf(src)
+		dstS3client = newClient(dst, dst.region)
+		srcS3client = dstS3client
+		if !sameS3Settings(src, dst) {
+			srcS3client = newClient(src, src.region)
+		}
+
+		// Buckets in other regions get a client of their own
+		if dstDir == "" {
+			if r := detectRegion(context.TODO(), dstS3, dstS3client, dstBucket); r != "" && r != dst.region {
+				dst.region = r
+				dstS3client = newClient(dst, r)
+			}
+		}
+		if srcDir == "" {
+			if r := detectRegion(context.TODO(), srcS3, srcS3client, srcBucket); r != "" && r != src.region {
+				src.region = r
+				srcS3client = newClient(src, r)
+			}
+		}
+		if sameS3Settings(src, dst) {
+			srcS3client = dstS3client
+		}
+		if s3Endpoint != "" {
+			awscliLog.Println("S3 client initialized for endpoint", s3Endpoint)
 		}
 
 		go func() {
@@ -97,32 +225,90 @@ func initS3() {
 			// and recovery should the server not have a policy assigned to it yet.
 			for {
 				time.Sleep(s3RefreshTime)
-				//awscliLog.Printf("Pulling new creds for s3Client %#v\n", s3client)
-				getConfig()
+				//awscliLog.Printf("Pulling new creds for s3Client %#v\n", dstS3client)
+				for _, cache := range caches {
+					cache.Invalidate()
+				}
 			}
 		}()
 		awscliLog.Println("S3 client initialized successfully")
 	}()
 }
 
-func downloadObjectInParts(ctx context.Context, srcBucket string, key string, size int64, partCount int) (string, error) {
-	s3Ready.Wait()
-
+// downloadObjectInParts downloads the object to a temporary file using
+// partCount parallel ranged requests and returns the file path.  If meta is
+// set, the object metadata is stored in it, with the checksum of the contents
+// if one was computed.
+func (d *Downloader) downloadObjectInParts(ctx context.Context, key, versionID string, size int64, partCount int, meta *ObjectMeta) (string, error) {
+	out := meta                     // Gets the checksum once the download is done
+	slots := d.fileSlots(partCount) // As reserved by Run, before partCount is clamped
 	ext := filepath.Ext(key)
 	if len(ext) == 0 {
 		ext = ".tmp"
 	}
 
-	outFile, err := os.CreateTemp("", "s3obj-*"+ext)
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+	// Large downloads go to a file named after the object so an interrupted
+	// run can pick up the parts it already finished.
+	var (
+		outFile *os.File
+		state   *resumeState
+		etag    string
+		err     error
+	)
+	if resumeDownloads {
+		info, err := d.Store.HeadObject(ctx, key, versionID)
+		if err != nil {
+			return "", fmt.Errorf("failed to head object: %w", err)
+		}
+		if meta != nil {
+			*meta = info.Meta
+			meta = nil // No need to take it from the first part as well
+		}
+		if info.Size == size && info.ETag != "" {
+			path := filepath.Join(tempDir, resumeFileName(key, versionID, size, info.ETag)+ext)
+			if !info.Encrypted {
+				etag = info.ETag // Checked against the resumed file
+			}
+			if err := checkDiskSpace(tempDir, path, size); err != nil {
+				return "", err
+			}
+			if outFile, err = openResumeFile(path); err != nil {
+				return "", fmt.Errorf("failed to open temp file: %w", err)
+			}
+			if state, err = openResumeState(path + ".parts"); err != nil {
+				outFile.Close()
+				return "", fmt.Errorf("failed to open resume state: %w", err)
+			}
+		}
+	}
+	if outFile == nil {
+		if err := checkDiskSpace(tempDir, "", size); err != nil {
+			return "", err
+		}
+		outFile, err = createTempFile(ext)
+		if err != nil {
+			return "", fmt.Errorf("failed to create temp file: %w", err)
+		}
 	}
 
 	tempName := outFile.Name()
+	if state == nil {
+		// Resumable files are left for the next run instead
+		trackTempFile(tempName)
+	}
 	defer func() {
 		outFile.Close()
-		if tempName != "" {
-			os.Remove(tempName)
+		// Keep the partial file around for the next run if we're stopping
+		keep := state != nil && tempName != "" && errors.Is(ctx.Err(), context.Canceled)
+		if state != nil {
+			state.close(!keep)
+		}
+		switch {
+		case tempName == "":
+		case keep:
+			untrackTempFile(tempName)
+		default:
+			releaseTempFile(tempName)
 		}
 	}()
 
@@ -130,98 +316,237 @@ func downloadObjectInParts(ctx context.Context, srcBucket string, key string, si
 		return "", fmt.Errorf("failed to pre-allocate file: %w", err)
 	}
 
-	var (
-		partSize = size / int64(partCount)
-		wg       sync.WaitGroup
-		errCh    = make(chan error, partCount)
-		proceed  = true
-	)
-
-	for i := 0; i < partCount; i++ {
-		start := int64(i) * partSize
-		end := start + partSize - 1
+	// Split the object into ranges, following the parts it was uploaded in
+	// when those carry checksums so each range can be verified as it streams.
+	// Stored parts beyond what clampParts allows are merged into fewer ranges.
+	partCount = clampParts(size, int64(partCount))
+	ranges := make([]partRange, partCount)
+	partSize := size / int64(partCount)
+	for i := range ranges {
+		ranges[i].start = int64(i) * partSize
+		ranges[i].end = ranges[i].start + partSize - 1
 		if i == partCount-1 {
-			end = size - 1
+			ranges[i].end = size - 1
 		}
-
-		wg.Add(1)
-		go func(partIdx int, start, end int64) {
-			defer wg.Done()
-			rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
-			getObj, err := s3client.GetObject(ctx, &s3.GetObjectInput{
-				Bucket: aws.String(srcBucket),
-				Key:    aws.String(key),
-				Range:  aws.String(rangeHeader),
-			})
+	}
+	var wholeChecksum string
+	if checksumAlgorithm != "" {
+		var whole string
+		var parts []partRange
+		if cs, ok := d.Store.(checksumStore); ok {
+			whole, parts, err = cs.ObjectChecksum(ctx, key, versionID, size)
 			if err != nil {
-				proceed = false
-				// If we encounter an error, we stop processing and report the error
-				errCh <- fmt.Errorf("part %d: failed to get object: %w", partIdx, err)
-				return
+				return "", err
 			}
-			defer getObj.Body.Close()
-
-			buf := bufPool32.Get().([]byte)
-			defer bufPool32.Put(buf)
-			offset := start
-			for proceed {
-				n, readErr := getObj.Body.Read(buf)
-				if n > 0 {
-					_, writeErr := outFile.WriteAt(buf[:n], offset)
-					if writeErr != nil {
-						proceed = false
-						// If we encounter a write error, we stop writing and report the error
-						errCh <- fmt.Errorf("part %d: write error: %w", partIdx, writeErr)
-						return
-					}
-					atomic.AddInt64(&DownloadedBytes, int64(n))
-					offset += int64(n)
-				}
-				if readErr == io.EOF {
-					break
+		}
+		switch {
+		case parts != nil:
+			ranges = mergeParts(parts, clampParts(size, int64(len(parts))))
+		case len(ranges) == 1:
+			ranges[0].checksum = whole
+		default:
+			wholeChecksum = whole
+		}
+	}
+
+	var (
+		wg      = sizedwaitgroup.New(min(len(ranges), slots)) // Parts beyond the limit wait their turn
+		errCh   = make(chan error, len(ranges))
+		proceed atomic.Bool                      // Cleared once a part fails, to stop the others
+		resumed atomic.Bool                      // Some parts were kept from an earlier run unchecked
+		sums    = make([]hash.Hash, len(ranges)) // Of each range as it streams, with CHECKSUM_ALGORITHM
+	)
+
+	proceed.Store(true)
+	for i, r := range ranges {
+		wg.Add()
+		go func(partIdx int, r partRange) {
+			defer wg.Done()
+			if state != nil && state.isDone(r) {
+				if !r.verified() {
+					resumed.Store(true)
+					return
 				}
-				if readErr != nil {
-					proceed = false
-					// If we encounter an error, we stop reading and report the error
-					errCh <- fmt.Errorf("part %d: read error: %w", partIdx, readErr)
+				if h, err := verifyFileRange(outFile, r); err == nil {
+					sums[partIdx] = h
 					return
 				}
+				// The part on disk is bad, so fetch it again
+			}
+			h := newChecksum()
+			var check *partsChecker // Of the stored parts merged into the range
+			if len(r.parts) > 0 {
+				check = newPartsChecker(r)
+				h = check
+			}
+			// Retry the part on its own so a transient failure doesn't throw
+			// away the other parts.  A retry resumes from the last byte written.
+			offset := r.start
+			var partMeta *ObjectMeta
+			if partIdx == 0 {
+				partMeta = meta
+			}
+			err := withRetry(ctx, d.partRetries, func() error {
+				return d.downloadPart(ctx, outFile, key, versionID, &offset, r.end, h, &proceed, partMeta)
+			})
+			if err == nil && r.checksum != "" && proceed.Load() {
+				err = compareChecksum(h, r.checksum)
+			}
+			if err == nil && check != nil && proceed.Load() {
+				h = check.Hash // Of the whole range, to combine with the others
+				err = check.err
+			}
+			if err == nil {
+				sums[partIdx] = h
+			}
+			if err == nil && proceed.Load() && state != nil {
+				err = state.markDone(r)
+			}
+			if err != nil {
+				proceed.Store(false)
+				// If we encounter an error, we stop processing and report the error
+				errCh <- fmt.Errorf("part %d of %d: %w", partIdx+1, len(ranges), err)
 			}
-		}(i, start, end)
+		}(i, r)
 	}
 
 	wg.Wait()
 	close(errCh)
 	for e := range errCh {
 		if e != nil {
-			proceed = false
 			return "", e
 		}
 	}
 
-	tempName = "" // Prevent deletion
+	sum := ""
+	if checksumAlgorithm != "" {
+		sum = combineSums(ranges, sums)
+	}
+	if wholeChecksum != "" && sum != "" {
+		if err := compareSum(sum, wholeChecksum); err != nil {
+			return "", err
+		}
+	} else if wholeChecksum != "" {
+		// The range hashes can't be put together, so read the file back
+		Debugf("reading back %s to check its %s checksum", key, checksumAlgorithm)
+		sp := startSpan("checksum", key).set("bytes", size)
+		sum, err = verifyFile(outFile.Name(), wholeChecksum)
+		if sp.finish(err); err != nil {
+			return "", err
+		}
+	} else if resumed.Load() {
+		// Parts from an earlier run haven't been checked yet
+		sp := startSpan("checksum", key).set("bytes", size)
+		var partSize int64
+		if ps, ok := d.Store.(partSizeStore); ok && strings.Contains(etag, "-") {
+			if n, err := ps.PartSize(ctx, key, versionID); err == nil {
+				partSize = n
+			} else {
+				Debugf("failed to get the part size of %s: %v", key, err)
+			}
+		}
+		err := verifyFileETag(outFile.Name(), etag, partSize)
+		if sp.finish(err); errors.Is(err, errETagUnverified) {
+			Warnf("resumed download of %s is unverified: %v", key, err)
+			d.stats.unverifiedFiles.Add(1)
+		} else if err != nil {
+			return "", fmt.Errorf("resumed download is corrupt: %w", err)
+		}
+	}
+
+	if out != nil {
+		out.Checksum = sum
+	}
+	trackTempFile(tempName) // Removed at shutdown if it never reaches an archive
+	tempName = ""           // Prevent deletion
 	return outFile.Name(), nil
 }
 
-func downloadObjectToBuffer(ctx context.Context, srcBucket string, key string, localBuf []byte) (int, error) {
-	s3Ready.Wait() // Wait for the S3 client to be ready
-	getObj, err := s3client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(srcBucket),
-		Key:    &key,
+// downloadPart fetches the byte range *offset through end of the object into
+// outFile, advancing *offset as data is written so a failed attempt can be
+// resumed where it left off.  If h is set, the data is also written to it,
+// and if meta is set the object metadata is stored in it.
+func (d *Downloader) downloadPart(ctx context.Context, outFile *os.File, key, versionID string, offset *int64, end int64, h hash.Hash, proceed *atomic.Bool, meta *ObjectMeta) error {
+	body, err := d.Store.GetObjectRange(ctx, key, versionID, *offset, end)
+	if err != nil {
+		return fmt.Errorf("failed to get object: %w", err)
+	}
+	defer body.Close()
+	if meta != nil {
+		*meta = body.Meta
+	}
+
+	buf := bufPool32.Get().([]byte)
+	defer bufPool32.Put(buf)
+	for proceed.Load() && *offset <= end {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := outFile.WriteAt(buf[:n], *offset); err != nil {
+				// If we encounter a write error, we stop writing and report the error
+				return fmt.Errorf("write error: %w", err)
+			}
+			if h != nil {
+				h.Write(buf[:n])
+			}
+			d.addBytes(int64(n))
+			*offset += int64(n)
+			if err := downloadLimiter.wait(ctx, n); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// If we encounter an error, we stop reading and report the error
+			return fmt.Errorf("read error: %w", readErr)
+		}
+	}
+	return nil
+}
+
+// downloadObjectToBuffer reads the object into localBuf, retrying transient
+// failures.  The same buffer is refilled from the start on each attempt.  If
+// meta is set, the object metadata is stored in it.
+func (d *Downloader) downloadObjectToBuffer(ctx context.Context, key, versionID string, localBuf []byte, meta *ObjectMeta) (int, error) {
+	var total int
+	err := withRetry(ctx, d.retries, func() (err error) {
+		total, err = d.fetchObjectToBuffer(ctx, key, versionID, localBuf, meta)
+		if err != nil {
+			// Don't count the partial read towards the progress
+			d.addBytes(-int64(total))
+		}
+		return err
 	})
+	return total, err
+}
+
+func (d *Downloader) fetchObjectToBuffer(ctx context.Context, key, versionID string, localBuf []byte, meta *ObjectMeta) (int, error) {
+	body, err := d.Store.GetObjectRange(ctx, key, versionID, 0, -1)
 	if err != nil {
 		return 0, fmt.Errorf("failed to download object %s: %w", key, err)
 	}
-	defer getObj.Body.Close()
+	defer body.Close()
+	if meta != nil {
+		*meta = body.Meta
+	}
+	h := newChecksum()
 
 	var total int
+	data := localBuf
 
 	for len(localBuf) > 0 {
-		n, readErr := getObj.Body.Read(localBuf)
+		n, readErr := body.Read(localBuf)
 		if n > 0 {
+			if h != nil {
+				h.Write(localBuf[:n])
+			}
 			localBuf = localBuf[n:] // Reduce the buffer size
-			atomic.AddInt64(&DownloadedBytes, int64(n))
+			d.addBytes(int64(n))
 			total += n
+			if err := downloadLimiter.wait(ctx, n); err != nil {
+				return total, err
+			}
 		}
 		if readErr == io.EOF {
 			break
@@ -230,15 +555,76 @@ func downloadObjectToBuffer(ctx context.Context, srcBucket string, key string, l
 			return total, fmt.Errorf("failed to read object body: %w", readErr)
 		}
 	}
+	if meta != nil && h != nil {
+		meta.Checksum = encodeSum(h)
+	}
+	if !verifyETag && h == nil {
+		return total, nil
+	}
+	sp := startSpan("checksum", key).set("bytes", int64(total))
+	if verifyETag {
+		err = checkETag(body.ETag, data[:total])
+	}
+	if err == nil && h != nil {
+		err = d.verifyBufferChecksum(ctx, key, versionID, body, h, data[:total])
+	}
+	if sp.finish(err); err != nil {
+		return total, fmt.Errorf("failed to verify object %s: %w", key, err)
+	}
 	return total, nil
 }
 
-func uploadFileInParts(ctx context.Context, dstBucket, key, filePath string, partCount int) error {
+// verifyBufferChecksum checks an in-memory download against the checksum in
+// the GET response.  Composite checksums from multipart uploads are checked
+// part by part using the part sizes from the object attributes.
+func (d *Downloader) verifyBufferChecksum(ctx context.Context, key, versionID string, body *ObjectBody, h hash.Hash, data []byte) error {
+	if body.Checksum == "" {
+		return nil // No checksum of this type stored with the object
+	}
+	if !body.ChecksumComposite {
+		return compareChecksum(h, body.Checksum)
+	}
+	cs, ok := d.Store.(checksumStore)
+	if !ok {
+		return nil
+	}
+	_, parts, err := cs.ObjectChecksum(ctx, key, versionID, int64(len(data)))
+	if err != nil || parts == nil {
+		return err
+	}
+	return verifyParts(data, parts)
+}
+
+// downloadObjectInParts downloads from srcBucket with the shared S3 client.
+func downloadObjectInParts(ctx context.Context, srcBucket string, key string, size int64, partCount int) (string, error) {
+	d, err := NewDownloader(&S3Store{Bucket: srcBucket, Client: sharedS3Client{},
+		RequesterPays: s3RequesterPays, SSECustomerKey: sseCustomerKey})
+	if err != nil {
+		return "", err
+	}
+	return d.downloadObjectInParts(ctx, key, "", size, partCount, nil)
+}
+
+// downloadObjectToBuffer downloads from srcBucket with the shared S3 client.
+func downloadObjectToBuffer(ctx context.Context, srcBucket string, key string, localBuf []byte) (int, error) {
+	d, err := NewDownloader(&S3Store{Bucket: srcBucket, Client: sharedS3Client{},
+		RequesterPays: s3RequesterPays, SSECustomerKey: sseCustomerKey})
+	if err != nil {
+		return 0, err
+	}
+	return d.downloadObjectToBuffer(ctx, key, "", localBuf, nil)
+}
+
+// uploadFileInParts uploads the file at filePath to key in dstBucket through
+// client, with the metadata in meta if set, and the tags and retention of archive if it is
+// one.  Files larger than one part go up as a multipart upload, sending UPLOAD_CONCURRENCY
+// parts at once, and the upload is aborted if a part can't be sent.
+func uploadFileInParts(ctx context.Context, client *s3.Client, dstBucket, key, filePath string, meta *ObjectMeta, archive *archiveUpload) error {
 	file, err := os.Open(filePath)
-	defer file.Close()
 	if err != nil {
 		return fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
+	defer file.Close()
 
 	info, err := file.Stat()
 	if err != nil {
@@ -246,38 +632,107 @@ func uploadFileInParts(ctx context.Context, dstBucket, key, filePath string, par
 	}
 
 	size := info.Size()
-	if partCount <= 0 || size == 0 {
-		return fmt.Errorf("invalid partCount or file size")
+	if size == 0 {
+		return fmt.Errorf("invalid file size")
 	}
 
-	s3Ready.Wait() // Wait for the S3 client to be ready
-
-	var partMiBs int64 = 10
-	uploader := manager.NewUploader(s3client, func(u *manager.Uploader) {
-		u.PartSize = partMiBs * 1024 * 1024
-	})
-	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket:   aws.String(dstBucket),
-		Key:      aws.String(key),
-		Body:     &UploadReader{file},
-		Metadata: virusScanMap,
-	})
+	if size <= uploadPartSize {
+		err = withRetry(ctx, uploadRetryMax, func() error {
+			_, err := client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:                    aws.String(dstBucket),
+				Key:                       aws.String(key),
+				Body:                      io.NewSectionReader(file, 0, size),
+				ContentLength:             aws.Int64(size),
+				ContentType:               uploadContentType(meta),
+				Metadata:                  uploadMetadata(meta),
+				StorageClass:              destStorageClass,
+				ServerSideEncryption:      destSSE,
+				SSEKMSKeyId:               kmsKeyID(),
+				Tagging:                   archive.tagging(),
+				ObjectLockMode:            archive.lockMode(),
+				ObjectLockRetainUntilDate: archive.retainUntil(),
+				ChecksumAlgorithm:         uploadChecksumAlgorithm(),
+			})
+			return err
+		})
+		if err == nil {
+			atomic.AddInt64(&UploadedBytes, size)
+		}
+	} else {
+		err = uploadMultipart(ctx, client, dstBucket, key, file, size, meta, archive)
+	}
 	if err != nil {
 		var apiErr smithy.APIError
 		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "EntityTooLarge" {
-			log.Printf("Error while uploading object to %s. The object is too large.\n"+
+			Errorf("Error while uploading object to %s. The object is too large.\n"+
 				"The maximum size for a multipart upload is 5TB.", dstBucket)
+		} else if isObjectLockMissing(err) {
+			Errorf("Error while uploading object to %s. The bucket doesn't have Object Lock enabled, "+
+				"which OBJECT_LOCK_MODE needs.", dstBucket)
 		} else {
-			log.Printf("Couldn't upload large object to %v:%v. Here's why: %v\n",
+			Errorf("Couldn't upload large object to %v:%v. Here's why: %v\n",
 				dstBucket, key, err)
 		}
 	} else {
-		err = s3.NewObjectExistsWaiter(s3client).Wait(
+		err = s3.NewObjectExistsWaiter(client).Wait(
 			ctx, &s3.HeadObjectInput{Bucket: aws.String(dstBucket), Key: aws.String(key)}, time.Minute)
 		if err != nil {
-			log.Printf("Failed attempt to wait for object %s to exist.\n", key)
+			Errorf("Failed attempt to wait for object %s to exist.\n", key)
 		}
 	}
 
 	return err
 }
+
+// uploadMultipart sends file to key in parts, aborting the upload on error.
+func uploadMultipart(ctx context.Context, client *s3.Client, dstBucket, key string, file *os.File, size int64, meta *ObjectMeta, archive *archiveUpload) error {
+	// Grow the parts if need be to stay within the S3 part limit
+	partSize := max(uploadPartSize, (size+maxPartCount-1)/maxPartCount)
+
+	upload, err := startMultipartUpload(ctx, client, dstBucket, key, meta, archive)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg    = sizedwaitgroup.New(uploadConcurrency)
+		errMu sync.Mutex
+		first error
+	)
+	for partNumber, off := int32(1), int64(0); off < size; partNumber, off = partNumber+1, off+partSize {
+		if ctx.Err() != nil {
+			break
+		}
+		errMu.Lock()
+		failed := first != nil
+		errMu.Unlock()
+		if failed {
+			break // Don't send more parts of an upload that will be aborted
+		}
+
+		wg.Add()
+		go func(partNumber int32, off int64) {
+			defer wg.Done()
+			n := min(partSize, size-off)
+			if err := upload.uploadPart(ctx, partNumber, io.NewSectionReader(file, off, n), n); err != nil {
+				errMu.Lock()
+				if first == nil {
+					first = err
+				}
+				errMu.Unlock()
+			}
+		}(partNumber, off)
+	}
+	wg.Wait()
+
+	if first == nil {
+		first = ctx.Err()
+	}
+	if first == nil {
+		first = upload.complete(ctx)
+	}
+	if first != nil {
+		upload.abort()
+	}
+	return first
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dstPrefix is put in front of the archive names when uploading, from the key
+// part of an s3:// DST_BUCKET.
+var dstPrefix string
+
+// parseS3URI splits s3://bucket/prefix into its bucket and key prefix, which
+// may be empty.  A plain bucket name is accepted as is.  The prefix is taken
+// as it is written, as %, # and ? are all allowed in keys.
+func parseS3URI(s string) (bucket, prefix string, err error) {
+	if !strings.Contains(s, "://") {
+		if strings.Contains(s, "/") {
+			return "", "", fmt.Errorf("%q is not a bucket name; use s3://bucket/prefix to give a prefix", s)
+		}
+		return s, "", nil
+	}
+	rest, ok := strings.CutPrefix(s, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("S3 URI %q must start with s3://", s)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	switch {
+	case bucket == "":
+		return "", "", fmt.Errorf("S3 URI %q has no bucket", s)
+	case strings.ContainsAny(bucket, ":@?#%"):
+		return "", "", fmt.Errorf("malformed S3 URI %q", s)
+	}
+	return bucket, prefix, nil
+}
+
+// dstKey returns the key an archive is uploaded to, under the DST_BUCKET
+// prefix taken as a folder.
+func dstKey(name string) string {
+	if dstPrefix == "" || strings.HasSuffix(dstPrefix, "/") {
+		return dstPrefix + name
+	}
+	return dstPrefix + "/" + name
+}
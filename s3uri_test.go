@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestParseS3URI(t *testing.T) {
+	tests := []struct {
+		in, bucket, prefix string
+		bad                bool
+	}{
+		{in: "bucket", bucket: "bucket"},
+		{in: "s3://bucket", bucket: "bucket"},
+		{in: "s3://bucket/", bucket: "bucket"},
+		{in: "s3://bucket/logs/2024", bucket: "bucket", prefix: "logs/2024"},
+		{in: "s3://bucket/a%20b/", bucket: "bucket", prefix: "a%20b/"},
+		{in: "s3://bucket/issue#1?draft", bucket: "bucket", prefix: "issue#1?draft"},
+		{in: "s3://bucket//double", bucket: "bucket", prefix: "/double"},
+		{in: "bucket/prefix", bad: true},
+		{in: "https://bucket/prefix", bad: true},
+		{in: "s3:///prefix", bad: true},
+		{in: "s3://user@bucket/x", bad: true},
+		{in: "s3://bucket:443/x", bad: true},
+	}
+	for _, tt := range tests {
+		bucket, prefix, err := parseS3URI(tt.in)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("parseS3URI(%q) was accepted", tt.in)
+			}
+			continue
+		}
+		if err != nil || bucket != tt.bucket || prefix != tt.prefix {
+			t.Errorf("parseS3URI(%q) = %q, %q, %v; want %q, %q", tt.in, bucket, prefix, err, tt.bucket, tt.prefix)
+		}
+	}
+}
+
+func TestDstKey(t *testing.T) {
+	defer func(p string) { dstPrefix = p }(dstPrefix)
+	for prefix, want := range map[string]string{
+		"":          "a.tgz",
+		"backups":   "backups/a.tgz",
+		"backups/":  "backups/a.tgz",
+		"x%2Fy#1":   "x%2Fy#1/a.tgz",
+		"2024/jan/": "2024/jan/a.tgz",
+	} {
+		dstPrefix = prefix
+		if got := dstKey("a.tgz"); got != want {
+			t.Errorf("dstKey with prefix %q = %q, want %q", prefix, got, want)
+		}
+	}
+}
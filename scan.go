@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -18,7 +17,7 @@ var (
 	virusScanMap   = map[string]string{} // Metadata map for virus scan
 	scanReady      sync.WaitGroup        // channel to signal scan readiness
 
-	clamLog         = log.New(os.Stderr, "clamav: ", log.LstdFlags)
+	clamLog         = componentLogger{logger.With("component", "clamav")}
 	concurrentScans = EnvInt("CONCURRENT_SCANNERS", 3, "How many concurrent scanners can run at once")
 )
 
@@ -149,20 +148,22 @@ func initScan() {
 
 // Scanner listens for WorkFile on tasksCh, scans them, and sends WorkFile to doneCh.
 func Scanner(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkFile) {
-	log.Println("Starting scanner...")
+	Infof("Starting scanner...")
 	swg := sizedwaitgroup.New(concurrentScans)
 	defer close(doneCh) // Ensure doneCh is closed when the function exits
 
 	scanReady.Wait() // Wait for the ClamAV instance to be ready
+	var order *turns
+	if reproducible {
+		order = newTurns() // Keep the order the files were downloaded in
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			break
 		case task, ok := <-tasksCh:
-			if debug {
-				log.Printf("Scanner task: %#v %v\n", task, ok)
-			}
+			Debugf("Scanner task: %#v %v\n", task, ok)
 
 			if !ok {
 				swg.Wait()
@@ -170,15 +171,28 @@ func Scanner(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkF
 				return
 			}
 
+			var tu *turn
+			if order != nil {
+				tu = order.take()
+			}
+
 			swg.Add()
 			go func(task *WorkFile) {
 				defer swg.Done()
+				defer tu.done()
 				defer atomic.AddInt64(&ScannedFiles, 1)
 
 				if task.Size == 0 {
+					tu.wait()
 					doneCh <- &WorkFile{
-						Size:     task.Size,
-						Filename: task.Filename,
+						Size:         task.Size,
+						Filename:     task.Filename,
+						ContentType:  task.ContentType,
+						Metadata:     task.Metadata,
+						LastModified: task.LastModified,
+						ETag:         task.ETag,
+						Checksum:     task.Checksum,
+						Listed:       task.Listed,
 					}
 
 					return // Skip empty files
@@ -189,11 +203,14 @@ func Scanner(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkF
 					fmem := clamav.OpenMemory(task.Bytes)
 					if fmem == nil {
 						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("failed to open memory for scanning %s", task.Filename),
+							Size:         task.Size,
+							Filename:     task.Filename,
+							LastModified: task.LastModified,
+							Err:          fmt.Errorf("failed to open memory for scanning %s", task.Filename),
+							Category:     ErrCategoryScan,
+							Severity:     SeverityTransient,
 						}
-						putMemory(task.Bytes)
+						task.Release()
 						return // Skip this file if memory scan fails
 					}
 					// Scan the file in memory
@@ -205,26 +222,39 @@ func Scanner(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkF
 						// If a virus is found, return an error with the virus name
 						// and the file path for clarity.}
 						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("virus found in %s: %s", task.Filename, virusName),
+							Size:         task.Size,
+							Filename:     task.Filename,
+							LastModified: task.LastModified,
+							Err:          fmt.Errorf("virus found in %s: %s", task.Filename, virusName),
+							Category:     ErrCategoryVirus,
+							Severity:     SeverityPermanent,
 						}
-						putMemory(task.Bytes)
+						task.Release()
 						return // Skip this file if memory scan fails
 					} else if err != nil {
 						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("error scanning %s: %v", task.Filename, err),
+							Size:         task.Size,
+							Filename:     task.Filename,
+							LastModified: task.LastModified,
+							Err:          fmt.Errorf("error scanning %s: %v", task.Filename, err),
+							Category:     ErrCategoryScan,
+							Severity:     SeverityTransient,
 						}
-						putMemory(task.Bytes)
+						task.Release()
 						return // Skip this file if memory scan fails
 					}
+					tu.wait()
 					doneCh <- &WorkFile{
-						Size:     task.Size,
-						Filename: task.Filename,
-						TempFile: task.TempFile,
-						Bytes:    task.Bytes,
+						Size:         task.Size,
+						Filename:     task.Filename,
+						TempFile:     task.TempFile,
+						Bytes:        task.Bytes,
+						ContentType:  task.ContentType,
+						Metadata:     task.Metadata,
+						LastModified: task.LastModified,
+						ETag:         task.ETag,
+						Checksum:     task.Checksum,
+						Listed:       task.Listed,
 					}
 				} else {
 					// If the file is large, we scan it from a temporary file
@@ -235,27 +265,40 @@ func Scanner(ctx context.Context, tasksCh <-chan *WorkFile, doneCh chan<- *WorkF
 						// If a virus is found, return an error with the virus name
 						// and the file path for clarity.}
 						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("virus found in %s: %s", task.Filename, virusName),
+							Size:         task.Size,
+							Filename:     task.Filename,
+							LastModified: task.LastModified,
+							Err:          fmt.Errorf("virus found in %s: %s", task.Filename, virusName),
+							Category:     ErrCategoryVirus,
+							Severity:     SeverityPermanent,
 						}
-						os.Remove(task.TempFile) // Clean up the temporary file after scanning
-						return                   // Skip this file if a virus is found
+						task.Release() // Clean up the temporary file after scanning
+						return         // Skip this file if a virus is found
 					} else if err != nil {
 						// If a virus is found, return an error with the virus name
 						// and the file path for clarity.}
 						fileErrCh <- &ErrorEvent{
-							Size:     task.Size,
-							Filename: task.Filename,
-							Err:      fmt.Errorf("error scanning %s: %v", task.Filename, err),
+							Size:         task.Size,
+							Filename:     task.Filename,
+							LastModified: task.LastModified,
+							Err:          fmt.Errorf("error scanning %s: %v", task.Filename, err),
+							Category:     ErrCategoryScan,
+							Severity:     SeverityTransient,
 						}
-						os.Remove(task.TempFile) // Clean up the temporary file after scanning
-						return                   // Skip this file if a virus is found
+						task.Release() // Clean up the temporary file after scanning
+						return         // Skip this file if a virus is found
 					}
+					tu.wait()
 					doneCh <- &WorkFile{
-						Size:     task.Size,
-						Filename: task.Filename,
-						TempFile: task.TempFile,
+						Size:         task.Size,
+						Filename:     task.Filename,
+						TempFile:     task.TempFile,
+						ContentType:  task.ContentType,
+						Metadata:     task.Metadata,
+						LastModified: task.LastModified,
+						ETag:         task.ETag,
+						Checksum:     task.Checksum,
+						Listed:       task.Listed,
 					}
 				}
 			}(task)
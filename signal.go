@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = Env("SHUTDOWN_TIMEOUT", "5m", "Time allowed to finish in-flight files after a stop signal")
+
+// stopRequested is set once a stop signal has been received.
+var stopRequested atomic.Bool
+
+// watchSignals calls stop on the first SIGINT or SIGTERM so no new files are
+// started, while those already in the pipeline are archived and uploaded.  A
+// second signal, or the timeout running out, exits straight away.
+func watchSignals(stop context.CancelFunc, timeout time.Duration) {
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		stopRequested.Store(true)
+		Println("Received", sig, "- finishing in-flight files, signal again to exit now")
+		stop()
+
+		select {
+		case sig = <-sigCh:
+			Println("Received", sig, "- exiting now")
+		case <-time.After(timeout):
+			Println("Shutdown took longer than", timeout, "- exiting now")
+		}
+		if n := removeTempFiles(); n > 0 {
+			Infof("Removed %d leftover temp files", n)
+		}
+		os.Exit(2)
+	}()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+var (
+	sseCustomerKeyFile = Env("SSE_C_KEY_FILE", "", "File holding the base64 SSE-C key for reading encrypted objects")
+
+	// sseCustomerKey is the raw AES-256 key, which is never printed.
+	sseCustomerKey []byte
+)
+
+// loadSSECustomerKey reads the SSE-C key from SSE_C_KEY or SSE_C_KEY_FILE.
+func loadSSECustomerKey() {
+	usage := "Base64 SSE-C key for reading encrypted objects"
+	encoded := os.Getenv("SSE_C_KEY")
+	if encoded != "" {
+		fmt.Printf("  %-30s # %s\n", `SSE_C_KEY="<redacted>"`, usage)
+	} else {
+		fmt.Printf("  %-30s # %s\n", `SSE_C_KEY="" (default)`, usage)
+	}
+
+	if sseCustomerKeyFile != "" {
+		if encoded != "" {
+			log.Fatalf("SSE_C_KEY and SSE_C_KEY_FILE are both set; use only one")
+		}
+		data, err := os.ReadFile(sseCustomerKeyFile)
+		if err != nil {
+			log.Fatalf("failed to read SSE_C_KEY_FILE: %v", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	if encoded == "" {
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Fatalf("SSE-C key is not valid base64")
+	} else if len(key) != 32 {
+		log.Fatalf("SSE-C key is %d bytes; must be 32 bytes for AES256", len(key))
+	}
+	sseCustomerKey = key
+}
+
+// sseCustomerParams returns the algorithm, base64 key and base64 key MD5 to
+// send with a request, or nils when no key is set.
+func sseCustomerParams(key []byte) (algorithm, encoded, keyMD5 *string) {
+	if len(key) == 0 {
+		return nil, nil, nil
+	}
+	sum := md5.Sum(key)
+	return aws.String("AES256"), aws.String(base64.StdEncoding.EncodeToString(key)),
+		aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
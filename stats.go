@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the Downloader's counters.
+type Stats struct {
+	DownloadedFiles int64 // Files handed on to the next stage
+	FailedFiles     int64 // Files sent to the error log instead
+	FailedBytes     int64 // Size of the failed files
+	SkippedFiles    int64 // Files gone (404) by the time they were downloaded, unless NOT_FOUND_FAILS
+	ArchivedFiles   int64 // Failed files that are archived and need a restore
+	DownloadedBytes int64 // Bytes read from the store, including retried reads
+	MemoryBytes     int64 // Bytes of the files downloaded into memory
+	DiskBytes       int64 // Bytes of the files spilled to temporary files
+	SpilledFiles    int64 // Small files sent to disk as the memory budget was used up
+	InFlight        int64 // Files being downloaded right now
+	InFlightParts   int64 // Download slots held by those files
+	CheckedFiles    int64 // Files found with a HEAD request in dry-run mode
+	CheckedBytes    int64 // Size of the files found in dry-run mode
+	UnverifiedFiles int64 // Resumed downloads that couldn't be checked against their ETag
+
+	Paths   map[string]PathStats // Files downloaded by the path they took, pathMemory or pathDisk
+	Slowest []FileTiming         // The files that took longest to download, slowest first
+}
+
+// The paths a download takes: into memory, or to a temp file on disk.
+const (
+	pathMemory = "memory"
+	pathDisk   = "disk"
+)
+
+// PathStats totals the files downloaded along one path.
+type PathStats struct {
+	Files    int64
+	Bytes    int64
+	Duration time.Duration // Summed over the files, so overlapping downloads all count
+}
+
+// Throughput returns the average rate a file on the path downloaded at, in
+// bytes per second.
+func (p PathStats) Throughput() float64 {
+	return throughput(p.Bytes, p.Duration)
+}
+
+// FileTiming is how long a file took to download, from being picked up to
+// being handed on.
+type FileTiming struct {
+	Key      string
+	Size     int64
+	Path     string // pathMemory or pathDisk
+	Parts    int
+	Duration time.Duration
+}
+
+// Throughput returns the rate the file downloaded at, in bytes per second.
+func (t FileTiming) Throughput() float64 {
+	return throughput(t.Size, t.Duration)
+}
+
+func throughput(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) / d.Seconds()
+}
+
+// slowestKept is how many of the slowest downloads Stats keeps.
+const slowestKept = 10
+
+// fileTimings collects the download timings behind Stats.
+type fileTimings struct {
+	mu      sync.Mutex
+	paths   map[string]PathStats
+	slowest []FileTiming
+}
+
+// add records the timing of a downloaded file, in the metrics too.
+func (f *fileTimings) add(t FileTiming) {
+	downloadDuration[t.Path].observe(t.Duration.Seconds())
+	if t.Size > 0 {
+		downloadThroughput[t.Path].observe(t.Throughput())
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paths == nil {
+		f.paths = make(map[string]PathStats, 2)
+	}
+	p := f.paths[t.Path]
+	p.Files++
+	p.Bytes += t.Size
+	p.Duration += t.Duration
+	f.paths[t.Path] = p
+	if len(f.slowest) < slowestKept || t.Duration > f.slowest[len(f.slowest)-1].Duration {
+		i := sort.Search(len(f.slowest), func(i int) bool { return f.slowest[i].Duration < t.Duration })
+		f.slowest = append(f.slowest[:i], append([]FileTiming{t}, f.slowest[i:]...)...)
+		f.slowest = f.slowest[:min(len(f.slowest), slowestKept)]
+	}
+}
+
+// snapshot copies the timings out for Stats.
+func (f *fileTimings) snapshot() (map[string]PathStats, []FileTiming) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	paths := make(map[string]PathStats, len(f.paths))
+	for k, v := range f.paths {
+		paths[k] = v
+	}
+	return paths, append([]FileTiming(nil), f.slowest...)
+}
+
+// downloadStats holds the live counters behind Stats.
+type downloadStats struct {
+	downloadedFiles atomic.Int64
+	failedFiles     atomic.Int64
+	failedBytes     atomic.Int64
+	skippedFiles    atomic.Int64
+	archivedFiles   atomic.Int64
+	downloadedBytes atomic.Int64
+	memoryBytes     atomic.Int64
+	diskBytes       atomic.Int64
+	spilledFiles    atomic.Int64
+	inFlight        atomic.Int64
+	inFlightParts   atomic.Int64
+	checkedFiles    atomic.Int64
+	checkedBytes    atomic.Int64
+	unverifiedFiles atomic.Int64
+	timings         fileTimings
+}
+
+// Stats returns a snapshot of the download counters.
+func (d *Downloader) Stats() Stats {
+	paths, slowest := d.stats.timings.snapshot()
+	return Stats{
+		Paths:           paths,
+		Slowest:         slowest,
+		DownloadedFiles: d.stats.downloadedFiles.Load(),
+		FailedFiles:     d.stats.failedFiles.Load(),
+		FailedBytes:     d.stats.failedBytes.Load(),
+		SkippedFiles:    d.stats.skippedFiles.Load(),
+		ArchivedFiles:   d.stats.archivedFiles.Load(),
+		DownloadedBytes: d.stats.downloadedBytes.Load(),
+		MemoryBytes:     d.stats.memoryBytes.Load(),
+		DiskBytes:       d.stats.diskBytes.Load(),
+		SpilledFiles:    d.stats.spilledFiles.Load(),
+		InFlight:        d.stats.inFlight.Load(),
+		InFlightParts:   d.stats.inFlightParts.Load(),
+		CheckedFiles:    d.stats.checkedFiles.Load(),
+		CheckedBytes:    d.stats.checkedBytes.Load(),
+		UnverifiedFiles: d.stats.unverifiedFiles.Load(),
+	}
+}
+
+// addBytes counts n bytes read from the store, which may be negative to take
+// back a read that is being retried.
+func (d *Downloader) addBytes(n int64) {
+	atomic.AddInt64(&DownloadedBytes, n)
+	d.stats.downloadedBytes.Add(n)
+}
+
+// fail sends the error for the task to the error log and counts the failure.
+// An object deleted since it was listed is skipped instead, unless
+// NOT_FOUND_FAILS is set.
+func (d *Downloader) fail(task *DownloadTask, err error) {
+	event := &ErrorEvent{
+		Size:         task.Size,
+		Filename:     task.Filename,
+		Err:          err,
+		LastModified: task.LastModified,
+	}
+	if !notFoundFails && errorCategory(err) == ErrCategoryNotFound {
+		d.stats.skippedFiles.Add(1)
+		skipped.add(task.Filename)
+		Warnf("skipping %s, which is gone since it was listed: %v", task.Filename, err)
+		return
+	}
+	d.stats.failedFiles.Add(1)
+	d.stats.failedBytes.Add(task.Size)
+	if event.Category = errorCategory(err); event.Category == ErrCategoryArchived {
+		d.stats.archivedFiles.Add(1)
+	}
+	event.Severity = errorSeverity(event.Category, err)
+	fileErrCh <- event
+}
+
+// reportTimings logs the average download rate along each path, and at
+// debug level the slowest files, to find the objects that hold a run up.
+func reportTimings(st Stats) {
+	for _, path := range []string{pathMemory, pathDisk} {
+		if p := st.Paths[path]; p.Files > 0 {
+			Infof("Downloaded %d files, %s, to %s at %s/s each on average", p.Files, humanizeBytes(p.Bytes), path,
+				humanizeBytes(int64(p.Throughput())))
+		}
+	}
+	for _, t := range st.Slowest {
+		Debugf("Slow download: %s (%s) took %s at %s/s, %s in %d parts", t.Key, humanizeBytes(t.Size),
+			t.Duration.Round(time.Millisecond), humanizeBytes(int64(t.Throughput())), t.Path, t.Parts)
+	}
+}
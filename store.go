@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectStore is where the Downloader reads objects from.
+type ObjectStore interface {
+	// GetObjectRange opens the bytes start through end (inclusive) of the
+	// object.  A negative end reads the whole object.  An empty versionID
+	// means the latest version.
+	GetObjectRange(ctx context.Context, key, versionID string, start, end int64) (*ObjectBody, error)
+
+	// HeadObject returns the object's details without its contents.
+	HeadObject(ctx context.Context, key, versionID string) (*ObjectInfo, error)
+}
+
+// checksumStore is implemented by stores that can list the checksums of the
+// parts an object was uploaded in.
+type checksumStore interface {
+	ObjectChecksum(ctx context.Context, key, versionID string, size int64) (whole string, parts []partRange, err error)
+}
+
+// partSizeStore is implemented by stores that can tell the size of the first
+// part a multipart object was uploaded in.
+type partSizeStore interface {
+	PartSize(ctx context.Context, key, versionID string) (int64, error)
+}
+
+// ObjectBody is the contents of an object, or a range of it, being read.
+type ObjectBody struct {
+	io.ReadCloser
+
+	ETag              string // Empty when it isn't the MD5 of the contents
+	Checksum          string // Stored checksum of the CHECKSUM_ALGORITHM type, if any
+	ChecksumComposite bool   // The checksum is made from the upload part checksums
+	Meta              ObjectMeta
+}
+
+// ObjectInfo describes an object.
+type ObjectInfo struct {
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	Restored     bool // A restored copy of an archived object is ready
+	Encrypted    bool // Uses SSE-C or SSE-KMS, so the ETag isn't the MD5 of the contents
+	Meta         ObjectMeta
+}
+
+// S3Store reads objects from an S3 bucket.
+type S3Store struct {
+	Bucket         string   // Bucket to download from
+	Client         S3Client // Client used for the requests
+	RequesterPays  bool     // Accept the charges on requester-pays buckets
+	SSECustomerKey []byte   // Key for objects encrypted with SSE-C, if any
+}
+
+// versionIDParam returns the VersionId to send, leaving it out for the latest.
+func versionIDParam(versionID string) *string {
+	if versionID == "" {
+		return nil
+	}
+	return aws.String(versionID)
+}
+
+// requestPayer returns the RequestPayer value to send with the requests.
+func requestPayer(requesterPays bool) types.RequestPayer {
+	if requesterPays {
+		return types.RequestPayerRequester
+	}
+	return ""
+}
+
+// S3Client is the part of the S3 API used to download objects.
+type S3Client interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObjectAttributes(ctx context.Context, params *s3.GetObjectAttributesInput, optFns ...func(*s3.Options)) (*s3.GetObjectAttributesOutput, error)
+	RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+}
+
+func (s *S3Store) GetObjectRange(ctx context.Context, key, versionID string, start, end int64) (*ObjectBody, error) {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(s.Bucket),
+		Key:          aws.String(key),
+		VersionId:    versionIDParam(versionID),
+		RequestPayer: requestPayer(s.RequesterPays),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = sseCustomerParams(s.SSECustomerKey)
+	if end >= 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end))
+	} else if checksumAlgorithm != "" {
+		// Checksums only cover whole objects, so only ask for them then
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+	getObj, err := s.Client.GetObject(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	sum := pickChecksum(getObj.ChecksumCRC32, getObj.ChecksumCRC32C, getObj.ChecksumSHA1, getObj.ChecksumSHA256)
+	etag := aws.ToString(getObj.ETag)
+	if !etagIsMD5(getObj.ServerSideEncryption, getObj.SSECustomerAlgorithm) {
+		etag = ""
+	}
+	return &ObjectBody{
+		ReadCloser:        getObj.Body,
+		ETag:              etag,
+		Checksum:          sum,
+		ChecksumComposite: getObj.ChecksumType == types.ChecksumTypeComposite || strings.Contains(sum, "-"),
+		Meta: ObjectMeta{ContentType: aws.ToString(getObj.ContentType), Metadata: getObj.Metadata,
+			LastModified: aws.ToTime(getObj.LastModified)},
+	}, nil
+}
+
+// etagIsMD5 reports whether the ETag of an object stored with the given
+// encryption is the MD5 of its contents, which it isn't for SSE-C or SSE-KMS.
+func etagIsMD5(sse types.ServerSideEncryption, sseCustomerAlgorithm *string) bool {
+	return sseCustomerAlgorithm == nil && sse != types.ServerSideEncryptionAwsKms &&
+		sse != types.ServerSideEncryptionAwsKmsDsse
+}
+
+func (s *S3Store) HeadObject(ctx context.Context, key, versionID string) (*ObjectInfo, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(s.Bucket),
+		Key:          aws.String(key),
+		VersionId:    versionIDParam(versionID),
+		RequestPayer: requestPayer(s.RequesterPays),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = sseCustomerParams(s.SSECustomerKey)
+	head, err := s.Client.HeadObject(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Size:         aws.ToInt64(head.ContentLength),
+		ETag:         aws.ToString(head.ETag),
+		LastModified: aws.ToTime(head.LastModified),
+		Restored:     restoreDone(aws.ToString(head.Restore)),
+		Encrypted:    !etagIsMD5(head.ServerSideEncryption, head.SSECustomerAlgorithm),
+		Meta: ObjectMeta{ContentType: aws.ToString(head.ContentType), Metadata: head.Metadata,
+			LastModified: aws.ToTime(head.LastModified)},
+	}, nil
+}
+
+// PartSize returns the size of the object's first upload part, which a HEAD
+// of part 1 reports as its length.
+func (s *S3Store) PartSize(ctx context.Context, key, versionID string) (int64, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(s.Bucket),
+		Key:          aws.String(key),
+		VersionId:    versionIDParam(versionID),
+		PartNumber:   aws.Int32(1),
+		RequestPayer: requestPayer(s.RequesterPays),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = sseCustomerParams(s.SSECustomerKey)
+	head, err := s.Client.HeadObject(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(head.ContentLength), nil
+}
+
+// sharedS3Client forwards to the source S3 client once it is ready, so a
+// store can be made before the client is.
+type sharedS3Client struct{}
+
+func (sharedS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	s3Ready.Wait()
+	return srcS3client.GetObject(ctx, params, optFns...)
+}
+
+func (sharedS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	s3Ready.Wait()
+	return srcS3client.HeadObject(ctx, params, optFns...)
+}
+
+func (sharedS3Client) GetObjectAttributes(ctx context.Context, params *s3.GetObjectAttributesInput, optFns ...func(*s3.Options)) (*s3.GetObjectAttributesOutput, error) {
+	s3Ready.Wait()
+	return srcS3client.GetObjectAttributes(ctx, params, optFns...)
+}
+
+func (sharedS3Client) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	s3Ready.Wait()
+	return srcS3client.RestoreObject(ctx, params, optFns...)
+}
+
+func (sharedS3Client) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	s3Ready.Wait()
+	return srcS3client.DeleteObjects(ctx, params, optFns...)
+}
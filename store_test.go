@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3Client answers GetObject and HeadObject with one object.
+type fakeS3Client struct {
+	S3Client // Calls not faked panic
+	body     []byte
+	etag     string
+	sse      types.ServerSideEncryption
+	sseC     *string
+}
+
+func (c *fakeS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(c.body)), ETag: aws.String(c.etag),
+		ServerSideEncryption: c.sse, SSECustomerAlgorithm: c.sseC}, nil
+}
+
+func (c *fakeS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(c.body))), ETag: aws.String(c.etag),
+		ServerSideEncryption: c.sse, SSECustomerAlgorithm: c.sseC}, nil
+}
+
+func TestEncryptedObjectETag(t *testing.T) {
+	// The ETag of an encrypted object isn't the MD5 of its contents
+	const etag = `"0123456789abcdef0123456789abcdef"`
+	tests := []struct {
+		name    string
+		sse     types.ServerSideEncryption
+		sseC    *string
+		checked bool
+	}{
+		{"SSE-S3", types.ServerSideEncryptionAes256, nil, true},
+		{"SSE-KMS", types.ServerSideEncryptionAwsKms, nil, false},
+		{"DSSE-KMS", types.ServerSideEncryptionAwsKmsDsse, nil, false},
+		{"SSE-C", "", aws.String("AES256"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &S3Store{Bucket: "b", Client: &fakeS3Client{body: []byte("hello"), etag: etag, sse: tt.sse, sseC: tt.sseC}}
+			body, err := store.GetObjectRange(context.Background(), "k", "", 0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(body)
+			err = checkETag(body.ETag, data)
+			if tt.checked && err == nil {
+				t.Errorf("ETag wasn't checked")
+			} else if !tt.checked && err != nil {
+				t.Errorf("ETag was checked: %v", err)
+			}
+			info, err := store.HeadObject(context.Background(), "k", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Encrypted == tt.checked {
+				t.Errorf("Encrypted = %v, want %v", info.Encrypted, !tt.checked)
+			}
+		})
+	}
+}
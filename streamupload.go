@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	streamUpload   = Env("STREAM_UPLOAD", "", "Upload archives to DST_BUCKET as they are written, without a local copy") != ""
+	streamPartSize = EnvInt("STREAM_PART_SIZE", 16*1024*1024, "Size in bytes of each part of a streamed upload")
+)
+
+// minUploadPartSize is the smallest part S3 accepts, other than the last.
+const minUploadPartSize = 5 * 1024 * 1024
+
+// maxUploadPartSize is the largest part S3 accepts.
+const maxUploadPartSize = 5 * 1024 * 1024 * 1024
+
+// streamPartGrowth is how many parts of a streamed upload are sent before
+// the part size doubles.  The size of an archive isn't known while it
+// streams, so the parts grow instead, letting the 10,000 parts S3 allows
+// hold the largest object S3 allows even from the smallest STREAM_PART_SIZE,
+// while archives of up to 500 parts keep the size set.
+const streamPartGrowth = maxPartCount / 20
+
+// streamPartSizeFor returns the size of part n, counted from 1, of a
+// streamed upload.
+func streamPartSizeFor(n int32) int {
+	size := int64(streamPartSize) << ((n - 1) / streamPartGrowth)
+	return int(min(size, maxUploadPartSize))
+}
+
+// checkStreamSettings validates the streaming upload settings.
+func checkStreamSettings() {
+	if streamUpload && streamPartSize < minUploadPartSize {
+		log.Fatalf("STREAM_PART_SIZE value %d is too small; must be at least %d bytes", streamPartSize, minUploadPartSize)
+	} else if streamUpload && streamPartSize > maxUploadPartSize {
+		log.Fatalf("STREAM_PART_SIZE value %d is too large; must be at most %d bytes", streamPartSize, maxUploadPartSize)
+	}
+}
+
+// s3StreamWriter writes an object to S3 as a multipart upload.  Only the
+// part being filled is held in memory, so the object can be any size S3
+// allows.
+type s3StreamWriter struct {
+	ctx    context.Context
+	upload *multipartUpload
+	buf    []byte // Of the size of the next part
+	parts  int32
+}
+
+// newS3StreamWriter starts a multipart upload of the archive key to bucket
+// through client.
+func newS3StreamWriter(ctx context.Context, client *s3.Client, bucket, key string, archive *archiveUpload) (*s3StreamWriter, error) {
+	upload, err := startMultipartUpload(ctx, client, bucket, key, nil, archive)
+	if err != nil {
+		return nil, err
+	}
+	return &s3StreamWriter{ctx: ctx, upload: upload, buf: make([]byte, 0, streamPartSizeFor(1))}, nil
+}
+
+// Write buffers p, uploading a part each time the buffer fills.
+func (w *s3StreamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), cap(w.buf)-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p, written = p[n:], written+n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.uploadPart(); err != nil {
+				// The archive can't be finished, so its parts aren't kept
+				w.upload.abort()
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// uploadPart sends the buffered bytes as the next part.
+func (w *s3StreamWriter) uploadPart() error {
+	if w.parts == maxPartCount {
+		return fmt.Errorf("archive is too large to stream in S3's %d parts", maxPartCount)
+	}
+	w.parts++
+	if err := w.upload.uploadPart(w.ctx, w.parts, bytes.NewReader(w.buf), int64(len(w.buf))); err != nil {
+		return err
+	}
+	if size := streamPartSizeFor(w.parts + 1); size != cap(w.buf) {
+		w.buf = make([]byte, 0, size)
+	} else {
+		w.buf = w.buf[:0]
+	}
+	return nil
+}
+
+// Close uploads what is left and completes the upload.  On failure the
+// upload is aborted so no parts are left behind.
+func (w *s3StreamWriter) Close() error {
+	err := w.close()
+	if err != nil {
+		w.upload.abort()
+	}
+	return err
+}
+
+func (w *s3StreamWriter) close() error {
+	if len(w.buf) > 0 || w.parts == 0 {
+		if err := w.uploadPart(); err != nil {
+			return err
+		}
+	}
+	return w.upload.complete(w.ctx)
+}
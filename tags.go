@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	archiveTags = Env("ARCHIVE_TAGS", "", "Tags for the uploaded archives as key=value pairs split by commas, with {bucket}, {run} and {seq} tokens")
+	runID       = Env("RUN_ID", "", "Name of this run for the {run} token of ARCHIVE_TAGS, the time it started if empty")
+
+	// archiveTagList is ARCHIVE_TAGS parsed, in order, with the tokens
+	// still in the values.
+	archiveTagList []archiveTag
+)
+
+// The limits S3 puts on the tags of an object.
+const (
+	maxObjectTags  = 10
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+type archiveTag struct {
+	key, value string
+}
+
+// checkTagSettings parses and validates ARCHIVE_TAGS, against the limits S3
+// puts on tags once the tokens are filled in.
+func checkTagSettings() {
+	if runID == "" {
+		runID = time.Now().UTC().Format("20060102T150405Z")
+	}
+	if archiveTags == "" {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(archiveTags, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			log.Fatalf("ARCHIVE_TAGS entry %q is invalid; must be key=value", pair)
+		} else if seen[key] {
+			log.Fatalf("ARCHIVE_TAGS has the key %q more than once", key)
+		}
+		seen[key] = true
+		archiveTagList = append(archiveTagList, archiveTag{key: key, value: value})
+	}
+	if len(archiveTagList) > maxObjectTags {
+		log.Fatalf("ARCHIVE_TAGS has %d tags; S3 allows at most %d", len(archiveTagList), maxObjectTags)
+	}
+	// The values only change by {seq}, checked here at its longest
+	for _, t := range expandTags(strings.Repeat("9", max(archiveSeqWidth, 10))) {
+		if err := checkTag(t); err != nil {
+			log.Fatalf("ARCHIVE_TAGS: %v", err)
+		}
+	}
+}
+
+// checkTag checks a tag against the limits S3 puts on tags.
+func checkTag(t archiveTag) error {
+	switch {
+	case utf8.RuneCountInString(t.key) > maxTagKeyLen:
+		return fmt.Errorf("key %q is longer than %d characters", t.key, maxTagKeyLen)
+	case utf8.RuneCountInString(t.value) > maxTagValueLen:
+		return fmt.Errorf("value %q of %s is longer than %d characters", t.value, t.key, maxTagValueLen)
+	case strings.HasPrefix(t.key, "aws:"):
+		return fmt.Errorf("key %q can't start with aws:, which is reserved", t.key)
+	case !validTagText(t.key):
+		return fmt.Errorf("key %q has characters S3 doesn't allow; use letters, numbers, spaces and + - = . _ : / @", t.key)
+	case !validTagText(t.value):
+		return fmt.Errorf("value %q of %s has characters S3 doesn't allow; use letters, numbers, spaces and + - = . _ : / @", t.value, t.key)
+	}
+	return nil
+}
+
+// validTagText reports whether s only has the characters S3 allows in tags.
+func validTagText(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && !strings.ContainsRune(" +-=._:/@", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandTags returns ARCHIVE_TAGS with the tokens filled in for the archive
+// numbered seq.
+func expandTags(seq string) []archiveTag {
+	r := strings.NewReplacer("{bucket}", srcBucket, "{run}", runID, "{seq}", seq)
+	tags := make([]archiveTag, len(archiveTagList))
+	for i, t := range archiveTagList {
+		tags[i] = archiveTag{key: r.Replace(t.key), value: r.Replace(t.value)}
+	}
+	return tags
+}
+
+// archiveTagging returns the tags of archive number seq encoded as URL query
+// parameters for the Tagging header, or "" if ARCHIVE_TAGS is empty.
+func archiveTagging(seq int) string {
+	var b strings.Builder
+	for i, t := range expandTags(fmt.Sprintf("%0*d", archiveSeqWidth, seq)) {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(tagEscape(t.key) + "=" + tagEscape(t.value))
+	}
+	return b.String()
+}
+
+// tagEscape escapes s for the Tagging header, with spaces as %20 rather than
+// the + of url.QueryEscape.
+func tagEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
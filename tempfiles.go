@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	tempFilePoolSize = EnvInt("TEMP_FILE_POOL", 0, "Temp files kept emptied for reuse by the next large downloads, up to DOWNLOAD_CONCURRENCY, off if 0")
+	tempFileMmap     = Env("TEMP_FILE_MMAP", "", "Read temp files through a memory map to archive them, where supported") != ""
+)
+
+// tempFiles holds the temp files that are still in use, so whatever is left
+// over when the program stops can be removed.
+var tempFiles = struct {
+	sync.Mutex
+	paths map[string]struct{}
+}{paths: make(map[string]struct{})}
+
+// trackTempFile registers a temp file for removal at shutdown.
+func trackTempFile(path string) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	tempFiles.paths[path] = struct{}{}
+}
+
+// untrackTempFile forgets a temp file that has been removed or is meant to
+// outlive the run.
+func untrackTempFile(path string) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	delete(tempFiles.paths, path)
+}
+
+// removeTempFiles deletes every temp file still registered, such as large
+// files downloaded but never archived because the run was stopped.  It
+// reports how many were removed, not counting those pooled for reuse.
+func removeTempFiles() int {
+	drainTempFilePool()
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	n := 0
+	for path := range tempFiles.paths {
+		if err := os.Remove(path); err == nil {
+			n++
+		}
+		delete(tempFiles.paths, path)
+	}
+	return n
+}
+
+// tempFilePool holds the temp files of finished downloads, emptied, for the
+// next large downloads to write to, saving creating and removing a file for
+// each.  Pooled files are registered, so they are removed at shutdown.
+var tempFilePool struct {
+	sync.Mutex
+	free []string
+}
+
+// checkTempFilePool validates TEMP_FILE_POOL and TEMP_FILE_MMAP.
+func checkTempFilePool() {
+	if tempFilePoolSize < 0 {
+		log.Fatalf("TEMP_FILE_POOL value %d is invalid; must be 0 or more", tempFilePoolSize)
+	}
+	if tempFileMmap && !mmapSupported {
+		Warnf("TEMP_FILE_MMAP isn't supported on %s; temp files are read as usual", runtime.GOOS)
+	}
+}
+
+// createTempFile returns a temp file in TMP_DIR to download to, from the pool
+// if one is free.  A pooled file is empty, so whatever is written to it is
+// the only content it has.  It is renamed if its name doesn't end in ext or
+// is one for resuming another download.
+func createTempFile(ext string) (*os.File, error) {
+	pooled, ok := takePooledTempFile()
+	if ok && strings.HasSuffix(pooled, ext) && !isResumeFileName(filepath.Base(pooled), ext) {
+		if f, err := os.OpenFile(pooled, os.O_RDWR, 0600); err == nil {
+			Debugf("Reusing temp file %s", pooled)
+			return f, nil
+		}
+		ok = false // Removed from under us
+	}
+	f, err := os.CreateTemp(tempDir, "s3obj-*"+ext)
+	if !ok {
+		return f, err
+	}
+	if err != nil {
+		os.Remove(pooled)
+		return nil, err
+	}
+	path := f.Name()
+	if err := os.Rename(pooled, path); err != nil {
+		// Keep the new file instead
+		os.Remove(pooled)
+		return f, nil
+	}
+	f.Close()
+	Debugf("Reusing temp file %s as %s", pooled, path)
+	return os.OpenFile(path, os.O_RDWR, 0600)
+}
+
+// takePooledTempFile removes a file from the pool for the caller to reuse.
+func takePooledTempFile() (string, bool) {
+	tempFilePool.Lock()
+	defer tempFilePool.Unlock()
+	n := len(tempFilePool.free)
+	if n == 0 {
+		return "", false
+	}
+	path := tempFilePool.free[n-1]
+	tempFilePool.free = tempFilePool.free[:n-1]
+	untrackTempFile(path) // Registered again by the download as its own
+	return path, true
+}
+
+// openResumeFile opens the temp file at path, named for resuming a download,
+// creating it from a pooled file if it doesn't exist yet.
+func openResumeFile(path string) (*os.File, error) {
+	tempFilePool.Lock()
+	if i := slices.Index(tempFilePool.free, path); i >= 0 {
+		// Pooled since its download finished, and empty
+		tempFilePool.free = slices.Delete(tempFilePool.free, i, i+1)
+		untrackTempFile(path)
+	}
+	tempFilePool.Unlock()
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	if pooled, ok := takePooledTempFile(); ok {
+		if os.Rename(pooled, path) == nil {
+			Debugf("Reusing temp file %s as %s", pooled, path)
+		} else {
+			os.Remove(pooled)
+		}
+	}
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// releaseTempFile is done with the temp file at path: it is emptied and kept
+// for reuse if the pool has room, or else removed.
+func releaseTempFile(path string) error {
+	tempFilePool.Lock()
+	defer tempFilePool.Unlock()
+	if len(tempFilePool.free) < min(tempFilePoolSize, downloadConcurrency) {
+		// Truncated so the pool holds no disk space, only the files
+		if err := os.Truncate(path, 0); err == nil {
+			tempFilePool.free = append(tempFilePool.free, path)
+			trackTempFile(path)
+			return nil
+		}
+	}
+	untrackTempFile(path)
+	return os.Remove(path)
+}
+
+// drainTempFilePool removes the pooled temp files.
+func drainTempFilePool() {
+	tempFilePool.Lock()
+	defer tempFilePool.Unlock()
+	for _, path := range tempFilePool.free {
+		os.Remove(path)
+		untrackTempFile(path)
+	}
+	tempFilePool.free = nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTempFilePoolReuse(t *testing.T) {
+	defer func(dir string, size int) { tempDir, tempFilePoolSize = dir, size }(tempDir, tempFilePoolSize)
+	tempDir, tempFilePoolSize = t.TempDir(), 2
+	defer drainTempFilePool()
+
+	write := func(f *os.File, data []byte) string {
+		t.Helper()
+		defer f.Close()
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+	check := func(path string, want []byte) {
+		t.Helper()
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s holds %d bytes, want %d", path, len(got), len(want))
+		}
+	}
+
+	// A pooled file smaller than the next object is grown to it, with
+	// nothing left over from before
+	f, err := createTempFile(".bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := write(f, bytes.Repeat([]byte("a"), 10))
+	if err := releaseTempFile(first); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = createTempFile(".bin"); err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte("b"), 1000)
+	if path := write(f, want); path != first {
+		t.Errorf("got %s, want the pooled %s", path, first)
+	}
+	check(first, want)
+
+	// One taken for another extension is renamed to it
+	if err := releaseTempFile(first); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = createTempFile(".txt"); err != nil {
+		t.Fatal(err)
+	}
+	want = []byte("text")
+	second := write(f, want)
+	if !strings.HasSuffix(second, ".txt") {
+		t.Errorf("got %s, want a name ending in .txt", second)
+	}
+	if _, err := os.Stat(first); err == nil {
+		t.Errorf("%s was left behind", first)
+	}
+	check(second, want)
+
+	// One named for resuming a download is never reused under that name
+	resume := filepath.Join(tempDir, resumeFileName("key", "", 5, "etag")+".txt")
+	if f, err = openResumeFile(resume); err != nil {
+		t.Fatal(err)
+	}
+	write(f, []byte("12345"))
+	if err := releaseTempFile(resume); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = createTempFile(".txt"); err != nil {
+		t.Fatal(err)
+	}
+	third := write(f, nil)
+	if third == resume {
+		t.Errorf("got the resume file %s for another download", resume)
+	}
+	check(third, nil)
+	if _, err := os.Stat(resume); err == nil {
+		t.Errorf("%s was left behind", resume)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	throttleRetryMax = EnvInt("THROTTLE_RETRY_MAX", 8, "Maximum attempts for a request S3 throttled with SlowDown or 503")
+	throttleBaseMs   = EnvInt("THROTTLE_BASE_MS", 1000, "Base delay in milliseconds for retrying a throttled request, raised while throttling goes on")
+	autoThrottle     = Env("AUTO_THROTTLE", "", "Cut the requests sent at once while S3 keeps throttling, and restore them once it stops") != ""
+)
+
+const (
+	// throttleMaxLevel caps how far sustained throttling raises the delay,
+	// at 2^throttleMaxLevel times THROTTLE_BASE_MS before the attempt's own
+	// doubling.
+	throttleMaxLevel = 5
+
+	// throttleSustained is the level at which AUTO_THROTTLE cuts the
+	// requests let through, halving them at most once per throttleCutEvery.
+	throttleSustained = 3
+	throttleCutEvery  = 5 * time.Second
+
+	// throttleQuiet is how long without throttling eases the level by one,
+	// and lets one more request through.
+	throttleQuiet = 10 * time.Second
+
+	// throttleMaxDelay caps a single throttled retry delay.
+	throttleMaxDelay = time.Minute
+)
+
+// checkThrottleSettings validates the throttling settings.
+func checkThrottleSettings() {
+	if throttleRetryMax < 1 {
+		log.Fatalf("THROTTLE_RETRY_MAX value %d is invalid; must be at least 1", throttleRetryMax)
+	}
+	if throttleBaseMs < 0 {
+		log.Fatalf("THROTTLE_BASE_MS value %d is invalid; must be 0 or more", throttleBaseMs)
+	}
+}
+
+// isThrottled reports whether err is S3 asking for fewer requests, such as
+// 503 SlowDown, rather than a failure.
+func isThrottled(err error) bool {
+	return err != nil && errorCategory(err) == ErrCategoryThrottled
+}
+
+// throttle tracks throttling across every request retried by withRetry, so
+// one request being throttled slows the rest down too.  Each throttled
+// response raises the level, lengthening the delays, and each quiet spell
+// lowers it.  With AUTO_THROTTLE it also limits the requests in flight.
+var throttle = &throttleState{wake: make(chan struct{})}
+
+// throttledRequests counts the throttled responses, for the summary.
+var throttledRequests atomic.Int64
+
+type throttleState struct {
+	mu       sync.Mutex
+	level    int
+	eased    time.Time // Of the last throttled response or easing
+	cut      time.Time // Of the last cut in limit
+	limit    int       // Requests let through at once, or 0 for all
+	inFlight int
+	peak     int           // Most requests in flight before the first cut
+	wake     chan struct{} // Closed when a request can be let through
+}
+
+// acquire waits until a request may be sent under the AUTO_THROTTLE limit.
+func (t *throttleState) acquire(ctx context.Context) error {
+	if !autoThrottle {
+		return nil
+	}
+	for {
+		t.mu.Lock()
+		if t.limit == 0 || t.inFlight < t.limit {
+			t.inFlight++
+			if t.limit == 0 {
+				t.peak = max(t.peak, t.inFlight)
+			}
+			t.mu.Unlock()
+			return nil
+		}
+		wake := t.wake
+		t.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// release ends a request let through by acquire.
+func (t *throttleState) release() {
+	if !autoThrottle {
+		return
+	}
+	t.mu.Lock()
+	t.inFlight--
+	t.wakeAll()
+	t.mu.Unlock()
+}
+
+// wakeAll lets the requests waiting in acquire check the limit again.  It is
+// called with mu held.
+func (t *throttleState) wakeAll() {
+	close(t.wake)
+	t.wake = make(chan struct{})
+}
+
+// throttled records a throttled response, and returns the level to back off
+// by.
+func (t *throttleState) throttled() int {
+	throttledRequests.Add(1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.level = min(t.level+1, throttleMaxLevel)
+	t.eased = now
+	if autoThrottle && t.level >= throttleSustained && now.Sub(t.cut) >= throttleCutEvery {
+		limit := t.limit
+		if limit == 0 {
+			limit = t.inFlight
+		}
+		if limit = max(limit/2, 1); limit != t.limit {
+			t.limit, t.cut = limit, now
+			Warnf("S3 keeps throttling requests; sending at most %d at once (AUTO_THROTTLE)", limit)
+		}
+	}
+	return t.level
+}
+
+// succeeded eases the throttling once it has been quiet for throttleQuiet,
+// by one level and one more request let through at a time.
+func (t *throttleState) succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.level == 0 && t.limit == 0 || time.Since(t.eased) < throttleQuiet {
+		return
+	}
+	t.eased = time.Now()
+	t.level = max(t.level-1, 0)
+	if t.limit > 0 {
+		if t.limit++; t.limit >= t.peak {
+			t.limit = 0
+			Infof("S3 throttling has stopped; sending requests at full concurrency again")
+		}
+		t.wakeAll()
+	}
+}
+
+// throttleBackoff returns the delay before retrying a request throttled on
+// the given attempt (starting at 0) at the given level.  It starts at
+// THROTTLE_BASE_MS, doubling with each attempt and level, with up to 100%
+// random jitter added so the throttled requests don't all come back at once.
+func throttleBackoff(attempt, level int) time.Duration {
+	d := min(time.Duration(throttleBaseMs)*time.Millisecond<<min(attempt+level, 16), throttleMaxDelay)
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration(rand.Int63n(int64(d)+1))
+}
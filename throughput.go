@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// downloadRateSpan is the window the status line takes the download rate
+// over for its ETA, and the summary takes the peak rate over.
+const downloadRateSpan = 10 * time.Second
+
+// downloadRate follows DownloadedBytes for the status line and the summary,
+// from StartMetrics.
+var downloadRate *rateWindow
+
+// rateWindow follows a growing byte count, taking its rate over a sliding
+// window of the last span so it follows the current speed, and keeping the
+// highest rate over a full window and the average since the start.  The
+// status line, the progress lines and the summary all use it.
+type rateWindow struct {
+	mu      sync.Mutex
+	span    time.Duration
+	start   progressSample
+	samples []progressSample
+	rate    float64 // Over the window, as of the last sample
+	peak    float64
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+func newRateWindow(span time.Duration, now time.Time, bytes int64) *rateWindow {
+	s := progressSample{at: now, bytes: bytes}
+	return &rateWindow{span: span, start: s, samples: []progressSample{s}}
+}
+
+// add samples the count, and returns the rate over the window in bytes per
+// second.
+func (w *rateWindow) add(now time.Time, bytes int64) float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples = append(w.samples, progressSample{at: now, bytes: bytes})
+	// The oldest sample kept is the newest at least span old
+	for len(w.samples) > 2 && now.Sub(w.samples[1].at) >= w.span {
+		w.samples = w.samples[1:]
+	}
+	first := w.samples[0]
+	d := now.Sub(first.at)
+	w.rate = throughput(bytes-first.bytes, d)
+	if d >= w.span {
+		w.peak = max(w.peak, w.rate)
+	}
+	return w.rate
+}
+
+// eta returns how long left bytes more take at the rate over the window, or
+// false if there is no rate to tell by.
+func (w *rateWindow) eta(left int64) (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.rate <= 0 || left <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(left) / w.rate * float64(time.Second)), true
+}
+
+// summary returns the time since the start, the average rate over it, and
+// the peak rate over a window.  A run shorter than a window has its average
+// for its peak.
+func (w *rateWindow) summary(now time.Time, bytes int64) (elapsed time.Duration, average, peak float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	elapsed = now.Sub(w.start.at)
+	average = throughput(bytes-w.start.bytes, elapsed)
+	return elapsed, average, max(w.peak, average)
+}
+
+// reportThroughput logs the totals of the downloads at the end of a run:
+// files, bytes, the time taken, and the average and peak rates.
+func reportThroughput(files int64) {
+	if downloadRate == nil {
+		return
+	}
+	bytes := atomic.LoadInt64(&DownloadedBytes)
+	elapsed, average, peak := downloadRate.summary(time.Now(), bytes)
+	round := time.Second
+	if elapsed < time.Minute {
+		round = time.Millisecond
+	}
+	Infof("Downloaded %d files, %s in %s: average %s/s, peak %s/s", files, humanizeBytes(bytes),
+		elapsed.Round(round), humanizeBytes(int64(average)), humanizeBytes(int64(peak)))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// tempDir holds the temporary files for downloads too large to keep in memory.
+var tempDir = Env("TMP_DIR", os.TempDir(), "Directory for temporary download files")
+
+// checkTempDir creates the temp directory if needed and makes sure files can
+// be written to it, so a bad setting is caught before any downloads start.
+func checkTempDir() {
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		log.Fatalf("failed to create TMP_DIR %s: %v", tempDir, err)
+	}
+	f, err := os.CreateTemp(tempDir, "s3obj-check-*")
+	if err != nil {
+		log.Fatalf("TMP_DIR %s is not writable: %v", tempDir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	checkDiskMargin()
+	checkTempFilePool()
+}
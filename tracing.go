@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	otlpEndpoint    = Env("OTEL_EXPORTER_OTLP_ENDPOINT", "", "OTLP/HTTP endpoint to export trace spans to, such as http://localhost:4318, off if empty")
+	otelServiceName = Env("OTEL_SERVICE_NAME", "bucket-archiver", "Service name the trace spans are exported with")
+)
+
+// maxSpanLinks caps the objects an upload span links to, as collectors drop
+// spans with too many.
+const maxSpanLinks = 128
+
+// tracer batches the spans ended and exports them.  The spans of an object
+// share a trace ID made from its key, so the stages line up in one trace
+// without passing anything along the pipeline.
+var tracer struct {
+	seed    [16]byte // Keeps the trace IDs of different runs apart
+	spans   chan *span
+	done    chan struct{}
+	dropped atomic.Int64 // Spans lost to a full queue, or ended after finishTracing
+
+	mu     sync.Mutex // Guards closed, so no span is sent once spans is closed
+	closed bool
+}
+
+// span is one timed stage of an object, or of an archive for uploads.
+type span struct {
+	name     string
+	traceID  []byte
+	spanID   []byte
+	parentID []byte
+	links    [][2][]byte // Trace and span IDs
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	err      error
+}
+
+type spanAttr struct {
+	key   string
+	value any // string or int64
+}
+
+// initTracing starts exporting spans if OTEL_EXPORTER_OTLP_ENDPOINT is set.
+func initTracing() {
+	if otlpEndpoint == "" {
+		return
+	}
+	rand.Read(tracer.seed[:])
+	tracer.spans = make(chan *span, 4096)
+	tracer.done = make(chan struct{})
+	go exportSpans(strings.TrimSuffix(otlpEndpoint, "/") + "/v1/traces")
+	Infof("Exporting trace spans to %s", otlpEndpoint)
+}
+
+// finishTracing exports the spans still queued, waiting a little for them.
+func finishTracing() {
+	if tracer.spans == nil {
+		return
+	}
+	tracer.mu.Lock()
+	tracer.closed = true
+	close(tracer.spans)
+	tracer.mu.Unlock()
+	select {
+	case <-tracer.done:
+	case <-time.After(10 * time.Second):
+		Warnf("gave up exporting the last trace spans")
+	}
+	if n := tracer.dropped.Load(); n > 0 {
+		Warnf("%d trace spans were dropped as the exporter fell behind", n)
+	}
+}
+
+// traceIDFor returns the trace ID of the spans for key.
+func traceIDFor(key string) []byte {
+	sum := sha256.Sum256(append(tracer.seed[:], key...))
+	return sum[:16]
+}
+
+// objectSpanID returns the ID of the download span of key, which its other
+// spans are children of and upload spans link to.
+func objectSpanID(key string) []byte {
+	sum := sha256.Sum256(append(append(tracer.seed[:], key...), "/download"...))
+	return sum[:8]
+}
+
+// startSpan starts a span of the object key.  The download span is the
+// parent of the others, and the rest get IDs of their own.  It returns nil
+// when tracing is off, which the span methods accept.
+func startSpan(name, key string) *span {
+	if tracer.spans == nil {
+		return nil
+	}
+	s := &span{name: name, traceID: traceIDFor(key), start: time.Now()}
+	if name == "download" {
+		s.spanID = objectSpanID(key)
+	} else {
+		s.spanID = make([]byte, 8)
+		rand.Read(s.spanID)
+		s.parentID = objectSpanID(key)
+	}
+	return s.set("object.key", key)
+}
+
+// set adds an attribute to the span.
+func (s *span) set(key string, value any) *span {
+	if s != nil {
+		s.attrs = append(s.attrs, spanAttr{key, value})
+	}
+	return s
+}
+
+// startUploadSpan starts the span of uploading the archive key, in a trace
+// of its own that links to the download spans of the contents.
+func startUploadSpan(key string, contents []string) *span {
+	if tracer.spans == nil {
+		return nil
+	}
+	s := &span{name: "upload", traceID: traceIDFor(key), spanID: objectSpanID(key), start: time.Now()}
+	for _, k := range contents[:min(len(contents), maxSpanLinks)] {
+		s.links = append(s.links, [2][]byte{traceIDFor(k), objectSpanID(k)})
+	}
+	return s.set("archive.key", key).set("archive.files", int64(len(contents)))
+}
+
+// finish ends the span, marking it failed if err is set, and queues it, or
+// drops it if finishTracing already ran.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if tracer.closed {
+		tracer.dropped.Add(1)
+		return
+	}
+	select {
+	case tracer.spans <- s:
+	default:
+		tracer.dropped.Add(1)
+	}
+}
+
+// exportSpans posts the queued spans to url in batches, every few seconds or
+// when a batch fills, until the queue is closed.
+func exportSpans(url string) {
+	defer close(tracer.done)
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	warned := false
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := postSpans(client, url, batch); err != nil && !warned {
+			// Once is enough, as a collector that is down fails every batch
+			Warnf("failed to export trace spans: %v", err)
+			warned = true
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-tracer.spans:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, s); len(batch) >= 512 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// postSpans sends spans as an OTLP JSON export request.
+func postSpans(client *http.Client, url string, spans []*span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest builds the OTLP JSON for spans, in which the IDs are hex and
+// the 64 bit numbers strings.
+func otlpRequest(spans []*span) map[string]any {
+	attrs := func(list []spanAttr) []map[string]any {
+		out := make([]map[string]any, 0, len(list))
+		for _, a := range list {
+			v := map[string]any{"stringValue": fmt.Sprint(a.value)}
+			if n, ok := a.value.(int64); ok {
+				v = map[string]any{"intValue": strconv.FormatInt(n, 10)}
+			}
+			out = append(out, map[string]any{"key": a.key, "value": v})
+		}
+		return out
+	}
+	list := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		o := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID),
+			"spanId":            hex.EncodeToString(s.spanID),
+			"name":              s.name,
+			"kind":              1, // Internal
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs(s.attrs),
+		}
+		if s.parentID != nil {
+			o["parentSpanId"] = hex.EncodeToString(s.parentID)
+		}
+		if len(s.links) > 0 {
+			links := make([]map[string]any, 0, len(s.links))
+			for _, l := range s.links {
+				links = append(links, map[string]any{"traceId": hex.EncodeToString(l[0]), "spanId": hex.EncodeToString(l[1])})
+			}
+			o["links"] = links
+		}
+		if s.err != nil {
+			o["status"] = map[string]any{"code": 2, "message": s.err.Error()}
+		}
+		list = append(list, o)
+	}
+	return map[string]any{"resourceSpans": []any{map[string]any{
+		"resource": map[string]any{"attributes": attrs([]spanAttr{{"service.name", otelServiceName}, {"service.version", version}})},
+		"scopeSpans": []any{map[string]any{
+			"scope": map[string]any{"name": "bucket-archiver", "version": version},
+			"spans": list,
+		}},
+	}}}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSpanAfterFinishTracing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	defer func(endpoint string) {
+		otlpEndpoint = endpoint
+		tracer.spans, tracer.done, tracer.closed = nil, nil, false
+		tracer.dropped.Store(0)
+	}(otlpEndpoint)
+	otlpEndpoint = srv.URL
+
+	initTracing()
+	late := startSpan("download", "key")
+	startSpan("download", "other").finish(nil)
+	finishTracing()
+
+	late.finish(nil) // Must not send on the closed queue
+	if n := tracer.dropped.Load(); n != 1 {
+		t.Errorf("dropped %d spans, want 1", n)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+var (
+	httpMaxIdleConns        = EnvInt("HTTP_MAX_IDLE_CONNS", 0, "Idle connections kept open in all, 0 for the larger of 100 and HTTP_MAX_IDLE_CONNS_PER_HOST")
+	httpMaxIdleConnsPerHost = EnvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 0, "Idle connections kept open to each host, 0 for DOWNLOAD_CONCURRENCY plus UPLOAD_CONCURRENCY")
+	httpIdleConnTimeoutStr  = Env("HTTP_IDLE_CONN_TIMEOUT", "90s", "How long an idle connection is kept open")
+	httpRequestTimeoutStr   = Env("HTTP_REQUEST_TIMEOUT", "0s", "Limit on each whole S3 request, including reading the body, 0 for none")
+	s3ProxyStr              = Env("S3_PROXY", "", "Proxy URL for the S3 requests, http://, https://, socks5:// or socks5h://, instead of HTTPS_PROXY")
+	s3CABundle              = Env("S3_CA_BUNDLE", os.Getenv("AWS_CA_BUNDLE"), "PEM file of CA certificates trusted for the S3 endpoints, on top of the system ones")
+	s3ClientCert            = Env("S3_CLIENT_CERT", "", "PEM file of the client certificate for endpoints that require mutual TLS")
+	s3ClientKey             = Env("S3_CLIENT_KEY", "", "PEM file of the private key of S3_CLIENT_CERT")
+
+	httpIdleConnTimeout, httpRequestTimeout time.Duration
+	s3Proxy                                 *url.URL
+	s3TLSConfig                             *tls.Config // With S3_CA_BUNDLE or S3_CLIENT_CERT
+)
+
+// checkHTTPSettings validates the HTTP transport settings before the S3
+// clients are made, filling in the defaults that follow the concurrency.
+func checkHTTPSettings() {
+	var err error
+	if httpIdleConnTimeout, err = time.ParseDuration(httpIdleConnTimeoutStr); err != nil {
+		log.Fatalf("failed to parse HTTP_IDLE_CONN_TIMEOUT: %v", err)
+	}
+	if httpRequestTimeout, err = time.ParseDuration(httpRequestTimeoutStr); err != nil {
+		log.Fatalf("failed to parse HTTP_REQUEST_TIMEOUT: %v", err)
+	}
+	switch {
+	case httpMaxIdleConns < 0:
+		log.Fatalf("HTTP_MAX_IDLE_CONNS value %d is invalid; must be 0 or more", httpMaxIdleConns)
+	case httpMaxIdleConnsPerHost < 0:
+		log.Fatalf("HTTP_MAX_IDLE_CONNS_PER_HOST value %d is invalid; must be 0 or more", httpMaxIdleConnsPerHost)
+	case httpIdleConnTimeout < 0 || httpRequestTimeout < 0:
+		log.Fatalf("HTTP_IDLE_CONN_TIMEOUT and HTTP_REQUEST_TIMEOUT can't be negative")
+	}
+
+	// Every part being downloaded or uploaded holds a connection to the
+	// same host, and any fewer idle ones are closed and opened again
+	if httpMaxIdleConnsPerHost == 0 {
+		httpMaxIdleConnsPerHost = downloadConcurrency + uploadConcurrency
+	}
+	if httpMaxIdleConns == 0 {
+		httpMaxIdleConns = max(100, httpMaxIdleConnsPerHost)
+	}
+
+	if s3ProxyStr != "" {
+		if s3Proxy, err = url.Parse(s3ProxyStr); err != nil {
+			log.Fatalf("failed to parse S3_PROXY: %v", err)
+		}
+		switch s3Proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			log.Fatalf("S3_PROXY %s has scheme %q; must be http, https, socks5 or socks5h", s3Proxy.Redacted(), s3Proxy.Scheme)
+		}
+		awscliLog.Println("Using proxy", s3Proxy.Redacted())
+	}
+
+	if s3TLSConfig, err = loadTLSConfig(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadTLSConfig reads S3_CA_BUNDLE and the S3_CLIENT_CERT key pair, so a
+// bad file stops the run before any request is made.  It returns nil when
+// neither is set.
+func loadTLSConfig() (*tls.Config, error) {
+	if s3CABundle == "" && s3ClientCert == "" && s3ClientKey == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if s3CABundle != "" {
+		pem, err := os.ReadFile(s3CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read S3_CA_BUNDLE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("S3_CA_BUNDLE %s holds no PEM certificates", s3CABundle)
+		}
+		cfg.RootCAs = pool
+	}
+	if (s3ClientCert == "") != (s3ClientKey == "") {
+		return nil, fmt.Errorf("S3_CLIENT_CERT and S3_CLIENT_KEY must be set together")
+	}
+	if s3ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(s3ClientCert, s3ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load S3_CLIENT_CERT and S3_CLIENT_KEY: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// proxyFor returns the proxy for req: S3_PROXY, unless NO_PROXY says the
+// host is reached directly, or else the one HTTPS_PROXY or HTTP_PROXY give.
+func proxyFor(req *http.Request) (*url.URL, error) {
+	if s3Proxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	if noProxy(req.URL.Hostname(), req.URL.Port(), cmp.Or(os.Getenv("NO_PROXY"), os.Getenv("no_proxy"))) {
+		return nil, nil
+	}
+	return s3Proxy, nil
+}
+
+// noProxy reports whether host is matched by the comma separated list, of
+// "*", host names also matching their subdomains, IP addresses or CIDR
+// ranges, each with an optional port.
+func noProxy(host, port, list string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if e := net.ParseIP(entry); e != nil {
+			if ip != nil && e.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpClient returns the HTTP client for the S3 client of s.
+func (s s3Settings) httpClient() *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().WithTimeout(httpRequestTimeout).WithTransportOptions(func(tr *http.Transport) {
+		tr.MaxIdleConns = httpMaxIdleConns
+		tr.MaxIdleConnsPerHost = httpMaxIdleConnsPerHost
+		tr.IdleConnTimeout = httpIdleConnTimeout
+		tr.Proxy = proxyFor
+		if s3TLSConfig != nil {
+			tr.TLSClientConfig = s3TLSConfig.Clone()
+		}
+		if s3Insecure {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.InsecureSkipVerify = true
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// socks5Server accepts SOCKS5 CONNECTs without authentication and answers
+// the HTTP request sent through each itself, sending each address asked for
+// on addrs.
+func socks5Server(t *testing.T, addrs chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(r, greeting); err != nil {
+					return
+				}
+				io.CopyN(io.Discard, r, int64(greeting[1])) // The methods offered
+				conn.Write([]byte{5, 0})                    // No authentication
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(r, req); err != nil {
+					return
+				}
+				var host string
+				switch req[3] {
+				case 1: // IPv4
+					ip := make([]byte, 4)
+					io.ReadFull(r, ip)
+					host = net.IP(ip).String()
+				case 3: // Domain name
+					n, _ := r.ReadByte()
+					name := make([]byte, n)
+					io.ReadFull(r, name)
+					host = string(name)
+				default:
+					return
+				}
+				port := make([]byte, 2)
+				io.ReadFull(r, port)
+				addrs <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				if _, err := http.ReadRequest(r); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+			}()
+		}
+	}()
+	return l
+}
+
+func TestS3Proxy(t *testing.T) {
+	defer func(proxy *url.URL) { s3Proxy = proxy }(s3Proxy)
+	t.Setenv("NO_PROXY", "direct.example.com")
+
+	proxied := make(chan string, 1)
+	httpProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.Host
+		io.WriteString(w, "ok")
+	}))
+	defer httpProxy.Close()
+	socks := socks5Server(t, proxied)
+
+	for _, proxy := range []string{httpProxy.URL, "socks5h://" + socks.Addr().String()} {
+		var err error
+		if s3Proxy, err = url.Parse(proxy); err != nil {
+			t.Fatal(err)
+		}
+		client := s3Settings{}.httpClient()
+		req, _ := http.NewRequest(http.MethodGet, "http://bucket.s3.example.com:8080/key", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", proxy, err)
+		}
+		resp.Body.Close()
+		select {
+		case host := <-proxied:
+			if host != "bucket.s3.example.com:8080" {
+				t.Errorf("%s was asked for %s, want bucket.s3.example.com:8080", proxy, host)
+			}
+		default:
+			t.Errorf("%s wasn't used", proxy)
+		}
+
+		// Hosts in NO_PROXY are reached directly
+		req, _ = http.NewRequest(http.MethodGet, "http://direct.example.com/", nil)
+		if u, err := proxyFor(req); err != nil || u != nil {
+			t.Errorf("%s is used for a host in NO_PROXY", proxy)
+		}
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	list := "example.com, .internal, 10.0.0.0/8, 192.168.1.1, s3.local:9000"
+	tests := []struct {
+		host, port string
+		want       bool
+	}{
+		{"example.com", "", true},
+		{"bucket.example.com", "", true},
+		{"badexample.com", "", false},
+		{"s3.internal", "443", true},
+		{"10.1.2.3", "", true},
+		{"11.1.2.3", "", false},
+		{"192.168.1.1", "443", true},
+		{"s3.local", "9000", true},
+		{"s3.local", "443", false},
+	}
+	for _, tt := range tests {
+		if got := noProxy(tt.host, tt.port, list); got != tt.want {
+			t.Errorf("noProxy(%q, %q) = %v, want %v", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"log"
 	"os"
 	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-// Uploader listens for ArchiveFile on tasksCh, uploads them, and when the channel is closed sends a done
-func Uploader(ctx context.Context, tasksCh <-chan *ArchiveFile, doneCh chan<- struct{}) {
-	log.Println("Starting uploader...")
+// Uploader listens for ArchiveFile on tasksCh, uploads them to DST_BUCKET through client, and when the channel is closed sends a done
+func Uploader(ctx context.Context, client *s3.Client, tasksCh <-chan *ArchiveFile, doneCh chan<- struct{}) {
+	Infof("Starting uploader...")
 	defer close(doneCh) // Ensure doneCh is closed when the function exits
 
 	f, err := os.OpenFile("upload.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -22,27 +25,77 @@ func Uploader(ctx context.Context, tasksCh <-chan *ArchiveFile, doneCh chan<- st
 	for {
 		select {
 		case <-ctx.Done():
-			break
+			Println("Uploader cancelled...")
+			return
 		case task, ok := <-tasksCh:
-			if debug {
-				log.Printf("Uploader task: %#v %v\n", task, ok)
-			}
+			Debugf("Uploader task: %#v %v\n", task, ok)
 
 			if !ok {
 				Println("Closing uploader...")
 				return
 			}
 
-			if err := uploadFileInParts(ctx, dstBucket, task.Filename, task.Filename, 8); err != nil {
-				log.Fatal(err)
+			start := time.Now()
+			attrs := []any{"key", dstKey(task.Filename), "files", len(task.Contents)}
+			sp := startUploadSpan(dstKey(task.Filename), task.Contents)
+			files := task.Volumes // The volumes and their index, with VOLUME_SIZE
+			if len(files) == 0 {
+				files = []archiveVolume{{Name: task.Filename, CRC32C: task.CRC32C}}
+			}
+			var size int64
+			for _, file := range files {
+				if fi, err := os.Stat(file.Name); err == nil {
+					size += fi.Size()
+				}
+			}
+			if size > 0 {
+				attrs = append(attrs, "size", size) // Unknown for streamed archives
+				sp.set("bytes", size)
 			}
+			if len(task.Volumes) > 0 {
+				attrs = append(attrs, "volumes", len(task.Volumes)-1)
+			}
+			for _, file := range files {
+				uploadArchiveFile(ctx, client, task, file)
+			}
+			sp.finish(nil)
 			// Write successful uploads to log file
 			for _, fileName := range task.Contents {
 				fmt.Fprintln(f, fileName)
 			}
-			os.Remove(task.Filename)
+			checkpointArchived(task.Sources)
+			jobStateUploaded(task.Sources)
+			if deleteSource {
+				// Only reached once the archive is uploaded and verified
+				deleteArchived(ctx, task.Filename, task.Sources)
+			}
+			logger.Info("uploaded archive", append(attrs, "duration", time.Since(start))...)
 			atomic.AddInt64(&UploadedArchivedFiles, int64(len(task.Contents)))
 			atomic.AddInt64(&UploadedFiles, 1)
 		}
 	}
 }
+
+// uploadArchiveFile uploads a file of the archive task, the archive itself or
+// one of its volumes, or moves it to DST_DIR, and removes the local copy.
+func uploadArchiveFile(ctx context.Context, client *s3.Client, task *ArchiveFile, file archiveVolume) {
+	if task.Uploaded {
+		// Already in the bucket, with no local file to upload
+	} else if dstDir != "" {
+		if err := moveToDstDir(file.Name); err != nil {
+			log.Fatalf("failed to move %s to DST_DIR: %v", file.Name, err)
+		}
+	} else if err := uploadFileInParts(ctx, client, dstBucket, dstKey(file.Name), file.Name, nil, &archiveUpload{Tagging: task.Tagging}); err != nil {
+		// The failed upload is aborted already, but not those of the other
+		// archives under way
+		fatalf("%v", err)
+	}
+	if verifyUploads {
+		if err := verifyUpload(ctx, client, dstBucket, dstKey(file.Name), file.CRC32C); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if !task.Uploaded && dstDir == "" {
+		os.Remove(file.Name)
+	}
+}
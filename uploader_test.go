@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUploaderCancelled(t *testing.T) {
+	t.Chdir(t.TempDir()) // For upload.log
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go Uploader(ctx, nil, make(chan *ArchiveFile), done)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Uploader didn't return once cancelled")
+	}
+}
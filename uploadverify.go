@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// verifyUploads turns on CRC32C checksums for archive uploads, which are
+// compared with what S3 stored once each upload finishes.
+var verifyUploads = Env("VERIFY_UPLOAD", "", "Check each uploaded archive against a CRC32C computed while writing it") != ""
+
+// newArchiveChecksum returns the hash accumulated while an archive is written.
+func newArchiveChecksum() hash.Hash32 {
+	return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+}
+
+// encodeCRC32C formats a CRC32C the way S3 reports it.
+func encodeCRC32C(h hash.Hash32) string {
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// uploadChecksumAlgorithm returns the checksum to ask S3 to store.
+func uploadChecksumAlgorithm() types.ChecksumAlgorithm {
+	if verifyUploads {
+		return types.ChecksumAlgorithmCrc32c
+	}
+	return ""
+}
+
+// uploadChecksumType asks for a checksum of the whole object on multipart
+// uploads, rather than a checksum of the part checksums, so it can be
+// compared with the local one.
+func uploadChecksumType() types.ChecksumType {
+	if verifyUploads {
+		return types.ChecksumTypeFullObject
+	}
+	return ""
+}
+
+// verifyUpload compares the CRC32C of the whole object S3 stored against
+// the one computed locally.  On a mismatch the object is deleted so a corrupt
+// archive isn't mistaken for a good one.
+func verifyUpload(ctx context.Context, client *s3.Client, bucket, key, want string) error {
+	var attr *s3.GetObjectAttributesOutput
+	err := withRetry(ctx, uploadRetryMax, func() (err error) {
+		attr, err = client.GetObjectAttributes(ctx, &s3.GetObjectAttributesInput{
+			Bucket:           aws.String(bucket),
+			Key:              aws.String(key),
+			ObjectAttributes: []types.ObjectAttributes{types.ObjectAttributesChecksum},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get checksum of uploaded %s: %w", key, err)
+	}
+
+	var got string
+	if attr.Checksum != nil {
+		got = aws.ToString(attr.Checksum.ChecksumCRC32C)
+	}
+	if got == want {
+		return nil
+	}
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}); err != nil {
+		return fmt.Errorf("uploaded %s has CRC32C %q, expected %q, and could not be deleted: %w", key, got, want, err)
+	}
+	return fmt.Errorf("uploaded %s has CRC32C %q, expected %q; the object was deleted", key, got, want)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+)
+
+var (
+	volumeSizeStr = Env("VOLUME_SIZE", "", "Split each archive into volumes of this size, with an index of the byte range each holds, off if empty")
+	volumeSize    int64
+)
+
+// volumeIndexSuffix is added to the name of a split archive to name its
+// index.
+const volumeIndexSuffix = ".index"
+
+// checkVolumeSettings validates VOLUME_SIZE.
+func checkVolumeSettings() {
+	if volumeSizeStr == "" {
+		return
+	}
+	var err error
+	if volumeSize, err = parseByteSize(volumeSizeStr); err != nil {
+		log.Fatalf("failed to parse VOLUME_SIZE: %v", err)
+	} else if volumeSize < 64*1024 {
+		log.Fatalf("VOLUME_SIZE value %d is too small; must be at least 64K", volumeSize)
+	}
+}
+
+// archiveVolume is a file of a split archive to upload: a volume, or the
+// index once they are all written.
+type archiveVolume struct {
+	Name   string
+	CRC32C string // With VERIFY_UPLOAD
+}
+
+// volume is an entry of the index of a split archive.
+type volume struct {
+	name   string // Without the directory of the archive
+	offset int64  // Where it starts in the archive
+	size   int64
+	sha256 string
+}
+
+// volumeWriter writes an archive to volumes of VOLUME_SIZE, named after it
+// with a sequence number, and then the index of the volumes.  A volume ends
+// where the size is reached, so an entry can start in one and end in the
+// next.
+type volumeWriter struct {
+	ctx     context.Context
+	name    string
+	tagging string // Of each volume and the index
+	cur     io.WriteCloser
+	curName string
+	n       int64 // Written to cur
+	sum     hash.Hash
+	crc     hash.Hash32
+	vols    []volume
+	files   []archiveVolume
+	offset  int64 // Where cur starts
+}
+
+func newVolumeWriter(ctx context.Context, name, tagging string) *volumeWriter {
+	return &volumeWriter{ctx: ctx, name: name, tagging: tagging}
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		if w.cur == nil {
+			if err := w.next(); err != nil {
+				return total - len(p), err
+			}
+		}
+		c := int(min(int64(len(p)), volumeSize-w.n))
+		if _, err := w.cur.Write(p[:c]); err != nil {
+			return total - len(p), err
+		}
+		w.sum.Write(p[:c])
+		if w.crc != nil {
+			w.crc.Write(p[:c])
+		}
+		w.n += int64(c)
+		p = p[c:]
+		if w.n == volumeSize {
+			if err := w.finish(); err != nil {
+				return total - len(p), err
+			}
+		}
+	}
+	return total, nil
+}
+
+// next starts the next volume.
+func (w *volumeWriter) next() error {
+	name := fmt.Sprintf("%s.%03d", w.name, len(w.vols)+1)
+	f, err := createArchiveFile(w.ctx, name, w.tagging)
+	if err != nil {
+		return err
+	}
+	w.cur, w.curName, w.n, w.sum = f, name, 0, sha256.New()
+	if verifyUploads {
+		w.crc = newArchiveChecksum()
+	}
+	return nil
+}
+
+// finish closes the current volume and adds it to the index.
+func (w *volumeWriter) finish() error {
+	if f, ok := w.cur.(*os.File); ok {
+		f.Sync()
+	}
+	if err := w.cur.Close(); err != nil {
+		return err
+	}
+	w.vols = append(w.vols, volume{name: path.Base(w.curName), offset: w.offset, size: w.n, sha256: hex.EncodeToString(w.sum.Sum(nil))})
+	w.files = append(w.files, archiveVolume{Name: w.curName, CRC32C: w.checksum()})
+	w.offset += w.n
+	w.cur = nil
+	return nil
+}
+
+func (w *volumeWriter) checksum() string {
+	if w.crc == nil {
+		return ""
+	}
+	return encodeCRC32C(w.crc)
+}
+
+// Close finishes the last volume and writes the index.
+func (w *volumeWriter) Close() error {
+	if w.cur != nil {
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+	name := w.name + volumeIndexSuffix
+	f, err := createArchiveFile(w.ctx, name, w.tagging)
+	if err != nil {
+		return err
+	}
+	var crc hash.Hash32
+	var out io.Writer = f
+	if verifyUploads {
+		crc = newArchiveChecksum()
+		out = io.MultiWriter(f, crc)
+	}
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"volume", "offset", "size", "sha256"})
+	for _, v := range w.vols {
+		cw.Write([]string{v.name, strconv.FormatInt(v.offset, 10), strconv.FormatInt(v.size, 10), v.sha256})
+	}
+	if cw.Flush(); cw.Error() != nil {
+		f.Close()
+		return cw.Error()
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	file := archiveVolume{Name: name}
+	if crc != nil {
+		file.CRC32C = encodeCRC32C(crc)
+	}
+	w.files = append(w.files, file)
+	return nil
+}
+
+// volumeSet is a split archive being read, found by its index.
+type volumeSet struct {
+	dir  string // Of the archive, which the volumes are in
+	vols []volume
+}
+
+// openVolumeIndex reads the index of the split archive name.
+func openVolumeIndex(ctx context.Context, name string) (*volumeSet, error) {
+	rc, err := openArchiveFile(ctx, name+volumeIndexSuffix, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	records, err := csv.NewReader(rc).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading volume index: %w", err)
+	}
+	s := &volumeSet{dir: path.Dir(name)}
+	for i, rec := range records[min(1, len(records)):] { // After the header
+		line := i + 2
+		if len(rec) < 4 {
+			return nil, fmt.Errorf("volume index line %d %q is too short", line, rec)
+		}
+		v := volume{name: rec[0], sha256: rec[3]}
+		if v.offset, err = strconv.ParseInt(rec[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("volume index line %d has a bad offset %q", line, rec[1])
+		}
+		if v.size, err = strconv.ParseInt(rec[2], 10, 64); err != nil || v.size < 0 {
+			return nil, fmt.Errorf("volume index line %d has a bad size %q", line, rec[2])
+		}
+		if v.offset != s.size() {
+			return nil, fmt.Errorf("volume %s starts at %d, not where the one before ends", v.name, v.offset)
+		}
+		s.vols = append(s.vols, v)
+	}
+	return s, nil
+}
+
+// size returns the size of the archive the volumes hold.
+func (s *volumeSet) size() int64 {
+	if len(s.vols) == 0 {
+		return 0
+	}
+	last := s.vols[len(s.vols)-1]
+	return last.offset + last.size
+}
+
+// open reads the archive from start up to end, or to the end if end is 0,
+// opening each volume as the range reaches it.
+func (s *volumeSet) open(ctx context.Context, start, end int64) io.ReadCloser {
+	if end == 0 || end > s.size() {
+		end = s.size()
+	}
+	return &volumeReader{ctx: ctx, set: s, pos: start, end: end}
+}
+
+// volumeReader reads across the volumes of a split archive.  A volume read
+// whole is checked against the SHA-256 in the index as it streams, and a
+// mismatch fails the read before the next volume is opened.
+type volumeReader struct {
+	ctx      context.Context
+	set      *volumeSet
+	cur      io.ReadCloser
+	pos, end int64
+	curEnd   int64     // Where cur stops
+	curVol   *volume   // Being read
+	sum      hash.Hash // Of cur, when it is read whole
+	err      error     // From a volume that didn't match, so reading stops there
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if r.pos >= r.end {
+			return 0, io.EOF
+		}
+		if r.cur != nil && r.pos >= r.curEnd {
+			r.cur.Close()
+			r.cur = nil
+		}
+		if r.cur == nil {
+			var v *volume
+			for i := range r.set.vols {
+				if vv := &r.set.vols[i]; r.pos < vv.offset+vv.size {
+					v = vv
+					break
+				}
+			}
+			if v == nil {
+				return 0, fmt.Errorf("offset %d is past the end of the volumes: %w", r.pos, io.ErrUnexpectedEOF)
+			}
+			r.curEnd = min(r.end, v.offset+v.size)
+			rc, err := openWholeArchive(r.ctx, path.Join(r.set.dir, v.name), r.pos-v.offset, r.curEnd-v.offset)
+			if err != nil {
+				return 0, fmt.Errorf("volume %s: %w", v.name, err)
+			}
+			r.cur, r.curVol, r.sum = rc, v, nil
+			if r.pos == v.offset && r.curEnd == v.offset+v.size && v.sha256 != "" {
+				r.sum = sha256.New()
+			}
+		}
+		n, err := r.cur.Read(p[:min(int64(len(p)), r.curEnd-r.pos)])
+		r.pos += int64(n)
+		if r.sum != nil {
+			r.sum.Write(p[:n])
+			if r.pos == r.curEnd {
+				if got := hex.EncodeToString(r.sum.Sum(nil)); got != r.curVol.sha256 {
+					r.err = fmt.Errorf("volume %s SHA-256 %w: expected %s, got %s", r.curVol.name, errChecksumMismatch, r.curVol.sha256, got)
+					return n, r.err
+				}
+				r.sum = nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			r.cur.Close()
+			r.cur = nil
+			if r.pos < r.curEnd {
+				return n, fmt.Errorf("volume ends at %d, before the index says: %w", r.pos, io.ErrUnexpectedEOF)
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *volumeReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
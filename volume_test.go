@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeVolumes writes files as a tar archive split into volumes of size
+// bytes, and returns the archive name.
+func writeVolumes(t *testing.T, size int64, files []*WorkFile) string {
+	t.Helper()
+	defer func(size int64) { volumeSize = size }(volumeSize)
+	volumeSize = size
+	name := filepath.Join(t.TempDir(), "archive.tar")
+	w := newVolumeWriter(context.Background(), name, "")
+	tw := tar.NewWriter(w)
+	for _, wf := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: wf.Filename, Mode: 0600, Size: wf.Size}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(wf.Bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestVolumeStraddlingEntry(t *testing.T) {
+	files := []*WorkFile{
+		{Filename: "first", Size: 100, Bytes: bytes.Repeat([]byte("1"), 100)},
+		{Filename: "straddles", Size: 3000, Bytes: bytes.Repeat([]byte("0123456789"), 300)},
+		{Filename: "last", Size: 10, Bytes: []byte("0123456789")},
+	}
+	name := writeVolumes(t, 1024, files)
+	vs, err := openVolumeIndex(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs.vols) < 4 {
+		t.Fatalf("archive is in %d volumes, want at least 4", len(vs.vols))
+	}
+	for _, v := range vs.vols[:len(vs.vols)-1] {
+		if v.size != 1024 {
+			t.Errorf("volume %s holds %d bytes, want 1024", v.name, v.size)
+		}
+	}
+
+	// Read back whole across the volumes
+	tr := tar.NewReader(vs.open(context.Background(), 0, 0))
+	for _, want := range files {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != want.Filename || !bytes.Equal(got, want.Bytes) {
+			t.Errorf("got %s of %d bytes, want %s of %d", hdr.Name, len(got), want.Filename, want.Size)
+		}
+	}
+
+	// And a range starting in one volume and ending in another
+	// The first entry takes a header and a block, then straddles its header
+	contents := int64(3 * 512)
+	start, end := contents+100, contents+2100
+	rc := vs.open(context.Background(), start, end)
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := files[1].Bytes[100:2100]; !bytes.Equal(got, want) {
+		t.Errorf("range read %q..., want %q...", got[:min(len(got), 20)], want[:20])
+	}
+}
+
+func TestVolumeChecksum(t *testing.T) {
+	files := []*WorkFile{{Filename: "data", Size: 5000, Bytes: bytes.Repeat([]byte("abcdefghij"), 500)}}
+	name := writeVolumes(t, 1024, files)
+	vs, err := openVolumeIndex(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage the second volume, keeping its size
+	second := filepath.Join(vs.dir, vs.vols[1].name)
+	data, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[10] ^= 1
+	if err := os.WriteFile(second, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := vs.open(context.Background(), 0, 0)
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("got %v reading a damaged volume, want a checksum mismatch", err)
+	}
+	if end := vs.vols[1].offset + vs.vols[1].size; int64(len(got)) != end {
+		t.Errorf("read %d bytes, want to stop at the end of the damaged volume at %d", len(got), end)
+	}
+
+	// A range of the undamaged volumes reads as before
+	rc = vs.open(context.Background(), vs.vols[2].offset, 0)
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); err != nil {
+		t.Errorf("reading the volumes after the damaged one: %v", err)
+	}
+}
+
+func TestVolumeIndexBadNumbers(t *testing.T) {
+	for _, tt := range []struct{ index, want string }{
+		{"name,offset,size,sha256\na.001,x,10,sum\n", "line 2 has a bad offset"},
+		{"name,offset,size,sha256\na.001,0,10,sum\na.002,10,1O,sum\n", "line 3 has a bad size"},
+		{"name,offset,size,sha256\na.001,0,-1,sum\n", "line 2 has a bad size"},
+	} {
+		name := filepath.Join(t.TempDir(), "archive.tar")
+		if err := os.WriteFile(name+volumeIndexSuffix, []byte(tt.index), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openVolumeIndex(context.Background(), name); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("index %q: got %v, want %q", tt.index, err, tt.want)
+		}
+	}
+}
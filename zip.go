@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/flate"
+)
+
+var archiveFormat = Env("ARCHIVE_FORMAT", "tar", "Archive format, tar, or zip for a central directory that restore can seek to single entries with")
+
+const (
+	// zipMetaExtra is the ID of the extra field holding the PAX records of
+	// an entry with PRESERVE_METADATA, as JSON.
+	zipMetaExtra = 0x5053
+
+	// The headers Go's zip writer adds to an entry besides its name and
+	// extra fields: the local header and the zip64 data descriptor, and the
+	// central directory header with its zip64 field, with an extended
+	// timestamp in each.
+	zipLocalOverhead   = 30 + 24 + 9
+	zipCentralOverhead = 46 + 28 + 9
+
+	// zipTrailerSize is the end of central directory records, zip64 ones
+	// included.
+	zipTrailerSize = 56 + 20 + 22
+
+	// zipReadAhead is how much of a zip archive in DST_BUCKET or split into
+	// volumes each read fetches, so the central directory and small entries
+	// take few requests.
+	zipReadAhead = 4 * 1024 * 1024
+)
+
+// errZipArchive is returned by openArchiveStream for zip archives, which are
+// read through their central directory instead.
+var errZipArchive = errors.New("zip archive")
+
+// checkZipSettings validates the settings ARCHIVE_FORMAT zip can't be used
+// with.
+func checkZipSettings() {
+	switch {
+	case archiveFormat == "tar":
+		return
+	case archiveFormat != "zip":
+		log.Fatalf("ARCHIVE_FORMAT %q is unknown; must be tar or zip", archiveFormat)
+	case compression != "gzip":
+		log.Fatalf("COMPRESSION must be gzip with ARCHIVE_FORMAT zip, as the entries are deflated at GZIP_LEVEL")
+	case dedup:
+		log.Fatalf("DEDUP can't be used with ARCHIVE_FORMAT zip, which has no links")
+	case compressEachFile:
+		log.Fatalf("COMPRESS_EACH_FILE can't be used with ARCHIVE_FORMAT zip, which compresses each file already")
+	case gzipWorkers > 1:
+		log.Fatalf("GZIP_WORKERS can't be more than 1 with ARCHIVE_FORMAT zip")
+	}
+}
+
+// newZipWriter returns a zip writer to out deflating at GZIP_LEVEL.
+func newZipWriter(out io.Writer) *zip.Writer {
+	zw := zip.NewWriter(out)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, gzipLevel)
+	})
+	return zw
+}
+
+// zipHeader returns the zip header for the entry of task in an archive
+// opened at opened.  Files that are empty or compressed already are stored.
+func zipHeader(task *WorkFile, opened time.Time) *zip.FileHeader {
+	fh := &zip.FileHeader{Name: task.Filename, Method: zip.Deflate, Modified: entryTime(task, opened)}
+	fh.SetMode(0600)
+	if isDirectoryKey(task.Filename, task.Size) {
+		fh.SetMode(fs.ModeDir | 0700)
+	}
+	if task.Size == 0 || isCompressed(task) {
+		fh.Method = zip.Store
+	}
+	if records := paxRecords(task); records != nil {
+		data, _ := json.Marshal(records) // Strings always marshal
+		fh.Extra = binary.LittleEndian.AppendUint16(fh.Extra, zipMetaExtra)
+		fh.Extra = binary.LittleEndian.AppendUint16(fh.Extra, uint16(len(data)))
+		fh.Extra = append(fh.Extra, data...)
+	}
+	return fh
+}
+
+// zipEntrySize returns the bytes the entry of task takes in the zip file,
+// its central directory header included, if stored.
+func zipEntrySize(task *WorkFile) int64 {
+	names := int64(len(task.Filename) + len(zipHeader(task, time.Unix(0, 0)).Extra))
+	return zipLocalOverhead + zipCentralOverhead + 2*names + task.Size
+}
+
+// writeZip adds task to the zip archive and the manifest, and releases it.
+func (a *tarArchive) writeZip(task *WorkFile) {
+	// The offset of the local header is only known with the buffer flushed
+	if err := a.zw.Flush(); err != nil {
+		fatalf("failed to write to zip: %v", err)
+	}
+	entry := ManifestEntry{Key: task.Filename, Size: task.Size, Archive: a.name,
+		Compression: "zip", Offset: a.fileBytes.n, ETag: task.ETag, Checksum: task.manifestChecksum()}
+	w, err := a.zw.CreateHeader(zipHeader(task, a.opened))
+	if err != nil {
+		fatalf("failed to write zip header for %s: %v", task.Filename, err)
+	}
+	a.zipBytes += zipEntrySize(task)
+	a.bytesWritten += task.Size
+
+	h := sha256.New()
+	if task.Size > 0 {
+		fh, err := task.Reader()
+		if err != nil {
+			fatalf("failed to open %s for archiving: %v", task.Filename, err)
+		}
+		sp := startSpan("compress", task.Filename).set("archive.key", a.name).set("compression", "zip")
+		n, err := io.Copy(io.MultiWriter(w, h), fh)
+		if sp.set("bytes", n).finish(err); err != nil {
+			fatalf("failed to write file %s to zip: %v", task.Filename, err)
+		}
+		fh.Close()
+	}
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if want := task.sha256(); want != "" && want != entry.SHA256 {
+		fatalf("contents of %s changed since they were downloaded: SHA-256 %s, expected %s", task.Filename, entry.SHA256, want)
+	}
+	task.Release()
+	archiveManifest.add(entry)
+	Debugf("Wrote %s to zip", task.Filename)
+}
+
+// forEachZipEntry calls fn with each file in the named zip archive, read
+// through its central directory, with a tar header describing it.  An
+// archive in DST_BUCKET is read with ranged requests, so only the central
+// directory and the entries fn reads are fetched.
+func forEachZipEntry(ctx context.Context, name string, fn func(io.Reader, *tar.Header) error) error {
+	ra, size, closer, err := openArchiveAt(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: f.Name, Size: int64(f.UncompressedSize64),
+			ModTime: f.Modified, PAXRecords: zipRecords(f.Extra)}
+		if f.Mode().IsDir() {
+			hdr.Typeflag = tar.TypeDir
+		}
+		// Opened lazily, so entries fn skips aren't fetched
+		if err := fn(&zipEntryReader{f: f}, hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipEntryReader opens a zip entry on the first read.
+type zipEntryReader struct {
+	f  *zip.File
+	rc io.ReadCloser
+}
+
+func (z *zipEntryReader) Read(p []byte) (int, error) {
+	if z.rc == nil {
+		var err error
+		if z.rc, err = z.f.Open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := z.rc.Read(p)
+	if err == io.EOF {
+		z.rc.Close() // The CRC is checked by now, so this only frees the decompressor
+	}
+	return n, err
+}
+
+// zipRecords returns the PAX records kept in the extra fields of a zip entry
+// by zipHeader, or nil if there are none.
+func zipRecords(extra []byte) map[string]string {
+	for len(extra) >= 4 {
+		id, n := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+n {
+			return nil
+		}
+		if id == zipMetaExtra {
+			var records map[string]string
+			if json.Unmarshal(extra[4:4+n], &records) != nil {
+				return nil
+			}
+			return records
+		}
+		extra = extra[4+n:]
+	}
+	return nil
+}
+
+// openArchiveAt opens the named archive for reading at any offset, from a
+// local file or else from DST_BUCKET, and returns its size.  With
+// encryption it reads the archive decrypted.
+func openArchiveAt(ctx context.Context, name string) (io.ReaderAt, int64, io.Closer, error) {
+	ra, size, closer, err := openStoredArchiveAt(ctx, name)
+	if err != nil || !archiveEncryption() {
+		return ra, size, closer, err
+	}
+	stored := func(start, end int64) (io.ReadCloser, error) {
+		if end == 0 || end > size {
+			end = size
+		}
+		return io.NopCloser(io.NewSectionReader(ra, start, end-start)), nil
+	}
+	plain, err := encryptedSize(ctx, stored, size)
+	if err != nil {
+		closer.Close()
+		return nil, 0, nil, err
+	}
+	r := &rangeReaderAt{size: plain, open: func(start, end int64) (io.ReadCloser, error) {
+		return openEncryptedArchive(ctx, stored, start, end)
+	}}
+	return r, plain, closer, nil
+}
+
+// openStoredArchiveAt opens the archive name for openArchiveAt as it is
+// stored.
+func openStoredArchiveAt(ctx context.Context, name string) (io.ReaderAt, int64, io.Closer, error) {
+	f, err := findLocalArchive(name) // Not found in DST_DIR, it may be split
+	if f != nil {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, nil, err
+		}
+		return f, info.Size(), f, nil
+	}
+	r := &rangeReaderAt{open: func(start, end int64) (io.ReadCloser, error) {
+		return openWholeArchive(ctx, name, start, end)
+	}}
+	if err == nil {
+		head, herr := dstClient().HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(dstBucket), Key: aws.String(dstKey(name))})
+		if herr == nil {
+			r.size = aws.ToInt64(head.ContentLength)
+		} else {
+			err = fmt.Errorf("not found locally or in %s: %w", dstBucket, herr)
+		}
+	}
+	if err != nil {
+		// Split by VOLUME_SIZE, if it has an index
+		vs, verr := openVolumeIndex(ctx, name)
+		if verr != nil {
+			return nil, 0, nil, err
+		}
+		r.size = vs.size()
+		r.open = func(start, end int64) (io.ReadCloser, error) { return vs.open(ctx, start, end), nil }
+	}
+	return r, r.size, closerFunc(func() error { return nil }), nil
+}
+
+// rangeReaderAt reads an archive in DST_BUCKET or split into volumes at any
+// offset, with open reading each range, fetching zipReadAhead at a time and
+// keeping the last fetch.
+type rangeReaderAt struct {
+	open func(start, end int64) (io.ReadCloser, error)
+	size int64
+
+	mu     sync.Mutex
+	buf    []byte
+	bufOff int64
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if off < r.bufOff || off+int64(len(p)) > r.bufOff+int64(len(r.buf)) {
+		n := min(max(int64(len(p)), zipReadAhead), r.size-off)
+		rc, err := r.open(off, off+n)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(rc, buf); err != nil {
+			return 0, err
+		}
+		r.buf, r.bufOff = buf, off
+	}
+	c := copy(p, r.buf[off-r.bufOff:])
+	if c < len(p) {
+		return c, io.EOF
+	}
+	return c, nil
+}